@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// accessList allows or denies the client by address,
+// a denied address is always denied, when any allow entry
+// exists, only the allowed addresses can pass
+type accessList struct {
+	static ipRules
+	files  []*accessFile
+}
+
+type ipRules struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// accessFile is the included file, one entry per line
+//
+//	allow 10.0.0.0/8
+//	deny 10.1.2.3
+//
+// reloaded on change, the last good copy is kept
+// when the new one is invalid
+type accessFile struct {
+	path  string
+	rules atomic.Value // *ipRules
+}
+
+// newAccessList returns nil when nothing configured
+func newAccessList(c accessConf) (*accessList, error) {
+	if len(c.Allow) == 0 && len(c.Deny) == 0 && len(c.Include) == 0 {
+		return nil, nil
+	}
+
+	al := &accessList{}
+
+	var err error
+	if al.static.allow, err = parseIPNets(c.Allow); err != nil {
+		return nil, err
+	}
+	if al.static.deny, err = parseIPNets(c.Deny); err != nil {
+		return nil, err
+	}
+
+	for _, fn := range c.Include {
+		af, err := openAccessFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		al.files = append(al.files, af)
+	}
+
+	return al, nil
+}
+
+// parseIPNet parses the CIDR or a single address
+func parseIPNet(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func parseIPNets(s []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s1 := range s {
+		n, err := parseIPNet(s1)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func openAccessFile(fn string) (*accessFile, error) {
+	af := &accessFile{path: fn}
+	watchFile(fn, af.reload)
+	if err := af.load(); err != nil {
+		return nil, err
+	}
+	return af, nil
+}
+
+func (af *accessFile) reload() {
+	if err := af.load(); err != nil {
+		log.Printf("%s, keep the last copy", err)
+		return
+	}
+	log.Printf("%s: reloaded", af.path)
+}
+
+func (af *accessFile) load() error {
+	fp, err := os.Open(af.path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	rules := &ipRules{}
+	bad := 0
+	lineno := 0
+
+	s := bufio.NewScanner(fp)
+	for s.Scan() {
+		lineno++
+
+		line := s.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+
+		if len(f) != 2 {
+			log.Printf("%s:%d: invalid entry", af.path, lineno)
+			bad++
+			continue
+		}
+
+		n, err := parseIPNet(f[1])
+		if err != nil {
+			log.Printf("%s:%d: %s", af.path, lineno, err)
+			bad++
+			continue
+		}
+
+		switch strings.ToLower(f[0]) {
+		case "allow":
+			rules.allow = append(rules.allow, n)
+		case "deny":
+			rules.deny = append(rules.deny, n)
+		default:
+			log.Printf("%s:%d: invalid action %q", af.path, lineno, f[0])
+			bad++
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("%s: %s", af.path, err)
+	}
+
+	if bad > 0 {
+		return fmt.Errorf("%s: %d invalid lines", af.path, bad)
+	}
+
+	af.rules.Store(rules)
+	return nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether the client address can pass
+func (al *accessList) allowed(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	rules := []*ipRules{&al.static}
+	for _, af := range al.files {
+		rules = append(rules, af.rules.Load().(*ipRules))
+	}
+
+	hasAllow := false
+	for _, r := range rules {
+		if containsIP(r.deny, ip) {
+			return false
+		}
+		if len(r.allow) > 0 {
+			hasAllow = true
+		}
+	}
+
+	if !hasAllow {
+		return true
+	}
+
+	for _, r := range rules {
+		if containsIP(r.allow, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// check writes 403 and returns false when the client is denied
+func (al *accessList) check(w http.ResponseWriter, r *http.Request) bool {
+	if al.allowed(remoteIP(r)) {
+		return true
+	}
+	log.Printf("access: %s %s %s denied", r.RemoteAddr, r.Method, r.RequestURI)
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(w, "<h1>403 Forbidden</h1>")
+	return false
+}
+
+func (al *accessList) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if al.check(w, r) {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// remoteIP returns the client address of the request
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// realIPHandler replaces the RemoteAddr by the address from
+// X-Forwarded-For or X-Real-IP when the peer is a trusted proxy,
+// the right most untrusted address in X-Forwarded-For is the client
+type realIPHandler struct {
+	handler http.Handler
+	trusted []*net.IPNet
+}
+
+func newRealIPHandler(h http.Handler, trusted []*net.IPNet) http.Handler {
+	if len(trusted) == 0 {
+		return h
+	}
+	return &realIPHandler{handler: h, trusted: trusted}
+}
+
+func (rh *realIPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if ip := remoteIP(r); ip != nil && containsIP(rh.trusted, ip) {
+		if client := rh.clientIP(r); client != nil {
+			_, port, _ := net.SplitHostPort(r.RemoteAddr)
+			r.RemoteAddr = net.JoinHostPort(client.String(), port)
+		}
+	}
+	rh.handler.ServeHTTP(w, r)
+}
+
+func (rh *realIPHandler) clientIP(r *http.Request) net.IP {
+	var addrs []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, a := range strings.Split(v, ",") {
+			addrs = append(addrs, strings.TrimSpace(a))
+		}
+	}
+
+	for i := len(addrs) - 1; i >= 0; i-- {
+		ip := net.ParseIP(addrs[i])
+		if ip == nil {
+			// garbage, stop here
+			return nil
+		}
+		if !containsIP(rh.trusted, ip) || i == 0 {
+			return ip
+		}
+	}
+
+	return net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP")))
+}
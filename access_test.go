@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAccessList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "office.txt")
+	ioutil.WriteFile(fn, []byte("# office\nallow 192.168.1.0/24\ndeny 192.168.1.66 # printer\n"), 0644)
+
+	al, err := newAccessList(accessConf{
+		Allow:   []string{"10.0.0.0/8", "2001:db8::/32"},
+		Deny:    []string{"10.9.9.9"},
+		Include: []string{fn},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		ip    string
+		allow bool
+	}{
+		{"10.1.2.3", true},
+		{"10.9.9.9", false},
+		{"192.168.1.10", true},
+		{"192.168.1.66", false},
+		{"::ffff:192.168.1.10", true},
+		{"2001:db8::1", true},
+		{"172.16.0.1", false},
+	}
+
+	for _, tc := range testCases {
+		if al.allowed(net.ParseIP(tc.ip)) != tc.allow {
+			t.Errorf("%s: expected %v", tc.ip, tc.allow)
+		}
+	}
+
+	// the invalid file keeps the last copy
+	ioutil.WriteFile(fn, []byte("allow 192.168.2.0/24\npermit 1.2.3.4\n"), 0644)
+	time.Sleep(5 * reloadDelay)
+	if !al.allowed(net.ParseIP("192.168.1.10")) {
+		t.Errorf("last good copy dropped")
+	}
+
+	ioutil.WriteFile(fn, []byte("allow 192.168.2.0/24\n"), 0644)
+	for i := 0; i < 50 && !al.allowed(net.ParseIP("192.168.2.1")); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !al.allowed(net.ParseIP("192.168.2.1")) || al.allowed(net.ParseIP("192.168.1.10")) {
+		t.Errorf("include file not reloaded")
+	}
+
+	h := al.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "172.16.0.1:1234"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", w.Code)
+	}
+
+	if _, err := newAccessList(accessConf{Allow: []string{"10.0.0.300"}}); err == nil {
+		t.Errorf("invalid address accepted")
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	trusted, _ := parseIPNets([]string{"127.0.0.1", "10.0.0.0/8"})
+
+	var got string
+	h := newRealIPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.RemoteAddr
+	}), trusted)
+
+	testCases := []struct {
+		remote, xff, realIP string
+		expected            string
+	}{
+		{"127.0.0.1:1000", "1.2.3.4", "", "1.2.3.4:1000"},
+		// the left most is set by the client, never trusted
+		{"127.0.0.1:1000", "6.6.6.6, 1.2.3.4, 10.0.0.2", "", "1.2.3.4:1000"},
+		{"127.0.0.1:1000", "", "1.2.3.4", "1.2.3.4:1000"},
+		{"127.0.0.1:1000", "garbage", "", "127.0.0.1:1000"},
+		// untrusted peer
+		{"5.5.5.5:1000", "1.2.3.4", "", "5.5.5.5:1000"},
+	}
+
+	for _, tc := range testCases {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if tc.realIP != "" {
+			r.Header.Set("X-Real-IP", tc.realIP)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if got != tc.expected {
+			t.Errorf("%s %q: expected %s, got %s", tc.remote, tc.xff, tc.expected, got)
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyACL decides whether the user can access the destination
+// by the forward proxy
+//
+// the rules are checked in order, the first matched rule
+// decides, the request is denied when no rule matches
+type proxyACL struct {
+	rules  []*aclRule
+	member map[string][]string
+}
+
+type aclRule struct {
+	name    string
+	allow   bool
+	users   map[string]bool
+	groups  map[string]bool
+	hosts   []hostMatcher
+	ports   [][2]int
+	methods map[string]bool
+	times   []timeWindow
+}
+
+// hostMatcher matches the destination host by
+//
+//	example.com      the host only
+//	*.example.com    the sub domains only
+//	.example.com     the host and the sub domains
+//	10.0.0.0/8       the ip address in the network
+//
+// the host name is never resolved for the CIDR match
+type hostMatcher struct {
+	name   string
+	suffix string
+	exact  bool
+	ipnet  *net.IPNet
+}
+
+// timeWindow is the days of week and the minutes of day
+type timeWindow struct {
+	days       [7]bool
+	start, end int
+}
+
+func newProxyACL(c []proxyACLConf, groupFile string) (*proxyACL, error) {
+	acl := &proxyACL{}
+
+	needGroups := false
+	for i, rc := range c {
+		r, err := newACLRule(rc)
+		if err != nil {
+			name := rc.Name
+			if name == "" {
+				name = fmt.Sprintf("#%d", i+1)
+			}
+			return nil, fmt.Errorf("proxyacl %s: %s", name, err)
+		}
+		if r.name == "" {
+			r.name = fmt.Sprintf("#%d", i+1)
+		}
+		if len(r.groups) > 0 {
+			needGroups = true
+		}
+		acl.rules = append(acl.rules, r)
+	}
+
+	if needGroups {
+		if groupFile == "" {
+			return nil, fmt.Errorf("proxyacl: groupfile required for groups")
+		}
+		m, err := loadGroupFile(groupFile)
+		if err != nil {
+			return nil, err
+		}
+		acl.member = m
+	}
+
+	return acl, nil
+}
+
+func newACLRule(c proxyACLConf) (*aclRule, error) {
+	r := &aclRule{name: c.Name}
+
+	switch strings.ToLower(c.Action) {
+	case "allow":
+		r.allow = true
+	case "deny":
+	default:
+		return nil, fmt.Errorf("invalid action %q, only allow, deny allowed", c.Action)
+	}
+
+	if len(c.Users) > 0 {
+		r.users = map[string]bool{}
+		for _, u := range c.Users {
+			r.users[u] = true
+		}
+	}
+
+	if len(c.Groups) > 0 {
+		r.groups = map[string]bool{}
+		for _, g := range c.Groups {
+			r.groups[g] = true
+		}
+	}
+
+	for _, h := range c.Hosts {
+		m, err := parseHostMatcher(h)
+		if err != nil {
+			return nil, err
+		}
+		r.hosts = append(r.hosts, m)
+	}
+
+	for _, p := range c.Ports {
+		pr, err := parsePortRange(p)
+		if err != nil {
+			return nil, err
+		}
+		r.ports = append(r.ports, pr)
+	}
+
+	if len(c.Methods) > 0 {
+		r.methods = map[string]bool{}
+		for _, m := range c.Methods {
+			r.methods[strings.ToUpper(m)] = true
+		}
+	}
+
+	for _, t := range c.Times {
+		tw, err := parseTimeWindow(t)
+		if err != nil {
+			return nil, err
+		}
+		r.times = append(r.times, tw)
+	}
+
+	return r, nil
+}
+
+func parseHostMatcher(s string) (hostMatcher, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return hostMatcher{}, err
+		}
+		return hostMatcher{ipnet: n}, nil
+	}
+
+	switch {
+	case s == "":
+		return hostMatcher{}, fmt.Errorf("empty host")
+	case strings.HasPrefix(s, "*."):
+		return hostMatcher{suffix: s[1:]}, nil
+	case s[0] == '.':
+		return hostMatcher{name: s[1:], suffix: s}, nil
+	}
+	return hostMatcher{name: s, exact: true}, nil
+}
+
+func (hm hostMatcher) match(host string, ip net.IP) bool {
+	if hm.ipnet != nil {
+		return ip != nil && hm.ipnet.Contains(ip)
+	}
+	if hm.exact {
+		return host == hm.name
+	}
+	return (hm.name != "" && host == hm.name) || strings.HasSuffix(host, hm.suffix)
+}
+
+func parsePortRange(s string) ([2]int, error) {
+	f := strings.SplitN(s, "-", 2)
+
+	lo, err := strconv.Atoi(strings.TrimSpace(f[0]))
+	if err != nil {
+		return [2]int{}, fmt.Errorf("invalid port %q", s)
+	}
+
+	hi := lo
+	if len(f) == 2 {
+		if hi, err = strconv.Atoi(strings.TrimSpace(f[1])); err != nil {
+			return [2]int{}, fmt.Errorf("invalid port %q", s)
+		}
+	}
+
+	if lo < 1 || hi > 65535 || lo > hi {
+		return [2]int{}, fmt.Errorf("invalid port %q", s)
+	}
+	return [2]int{lo, hi}, nil
+}
+
+var weekdays = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// parseTimeWindow parses the time window like
+//
+//	Mon-Fri 09:00-18:00
+//	Sat,Sun
+//	22:00-06:00
+//
+// in local time, the range wraps around the week or the midnight
+func parseTimeWindow(s string) (timeWindow, error) {
+	tw := timeWindow{start: 0, end: 24 * 60}
+	daysSet := false
+
+	for _, f := range strings.Fields(s) {
+		if strings.Contains(f, ":") {
+			r := strings.SplitN(f, "-", 2)
+			if len(r) != 2 {
+				return tw, fmt.Errorf("invalid time range %q", f)
+			}
+			var err error
+			if tw.start, err = parseClock(r[0]); err != nil {
+				return tw, err
+			}
+			if tw.end, err = parseClock(r[1]); err != nil {
+				return tw, err
+			}
+			continue
+		}
+
+		for _, d := range strings.Split(f, ",") {
+			r := strings.SplitN(strings.ToLower(d), "-", 2)
+			lo, ok := weekdays[r[0]]
+			if !ok {
+				return tw, fmt.Errorf("invalid day %q", d)
+			}
+			hi := lo
+			if len(r) == 2 {
+				if hi, ok = weekdays[r[1]]; !ok {
+					return tw, fmt.Errorf("invalid day %q", d)
+				}
+			}
+			for i := lo; ; i = (i + 1) % 7 {
+				tw.days[i] = true
+				if i == hi {
+					break
+				}
+			}
+			daysSet = true
+		}
+	}
+
+	if !daysSet {
+		for i := range tw.days {
+			tw.days[i] = true
+		}
+	}
+	return tw, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		if s == "24:00" {
+			return 24 * 60, nil
+		}
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (tw timeWindow) match(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	day := int(t.Weekday())
+
+	if tw.start <= tw.end {
+		return tw.days[day] && m >= tw.start && m < tw.end
+	}
+
+	// wraps the midnight, the part after midnight
+	// belongs to the day before
+	if m >= tw.start {
+		return tw.days[day]
+	}
+	return m < tw.end && tw.days[(day+6)%7]
+}
+
+func (r *aclRule) match(user string, groups []string, method, host string, ip net.IP, port int, now time.Time) bool {
+	if r.users != nil || r.groups != nil {
+		ok := r.users[user]
+		for _, g := range groups {
+			if r.groups[g] {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	if r.methods != nil && !r.methods[method] {
+		return false
+	}
+
+	if len(r.ports) > 0 {
+		ok := false
+		for _, p := range r.ports {
+			if port >= p[0] && port <= p[1] {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	if len(r.hosts) > 0 {
+		ok := false
+		for _, h := range r.hosts {
+			if h.match(host, ip) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	if len(r.times) > 0 {
+		ok := false
+		for _, t := range r.times {
+			if t.match(now) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// check returns whether the request is allowed and
+// the name of the rule decided it
+func (acl *proxyACL) check(user, method, host string, port int, now time.Time) (bool, string) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+	groups := acl.member[user]
+
+	for _, r := range acl.rules {
+		if r.match(user, groups, method, host, ip, port, now) {
+			return r.allow, r.name
+		}
+	}
+	return false, "default"
+}
+
+// proxyDestination returns the host and port the proxy request goes to
+func proxyDestination(r *http.Request) (string, int) {
+	if isConnectUDP(r) {
+		if host, port, err := masqueTarget(r.URL.EscapedPath()); err == nil {
+			return host, port
+		}
+	}
+
+	hostport := r.URL.Host
+	if r.Method == http.MethodConnect && r.ProtoMajor == 1 {
+		hostport = r.RequestURI
+	}
+	if hostport == "" {
+		hostport = r.Host
+	}
+
+	// the extended CONNECT of http/2 goes to the :scheme port
+	defaultPort := 80
+	if r.URL.Scheme == "https" || r.Method == http.MethodConnect &&
+		(extendedProtocol(r) == "" || r.TLS != nil) {
+		defaultPort = 443
+	}
+
+	host, p, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return strings.Trim(hostport, "[]"), defaultPort
+	}
+
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return host, 0
+	}
+	return host, port
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestProxyACL(t *testing.T) {
+	fp, err := ioutil.TempFile("", "group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fp.Name())
+	fp.WriteString("ops: bob\n")
+	fp.Close()
+
+	acl, err := newProxyACL([]proxyACLConf{
+		{Name: "no-internal", Action: "deny", Hosts: []string{"10.0.0.0/8", ".corp.example.com"}},
+		{Name: "ops-all", Action: "allow", Groups: []string{"ops"}},
+		{Name: "office-hours", Action: "allow", Users: []string{"alice"},
+			Hosts: []string{"*.example.com", "example.org"}, Ports: []string{"443", "8000-8100"},
+			Methods: []string{"CONNECT", "get"}, Times: []string{"Mon-Fri 09:00-18:00"}},
+		{Name: "night", Action: "allow", Users: []string{"carol"}, Times: []string{"Fri 22:00-06:00"}},
+	}, fp.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2021-03-01 is monday
+	monday := time.Date(2021, 3, 1, 10, 0, 0, 0, time.Local)
+	sunday := time.Date(2021, 3, 7, 10, 0, 0, 0, time.Local)
+	saturdayNight := time.Date(2021, 3, 6, 2, 0, 0, 0, time.Local)
+
+	testCases := []struct {
+		user, method, host string
+		port               int
+		now                time.Time
+		allow              bool
+		rule               string
+	}{
+		{"bob", "CONNECT", "10.1.2.3", 22, monday, false, "no-internal"},
+		{"bob", "CONNECT", "::ffff:10.1.2.3", 22, monday, false, "no-internal"},
+		// CIDR never matches the name, even it resolves to the network
+		{"bob", "CONNECT", "10.1.2.3.nip.io", 22, monday, true, "ops-all"},
+		{"bob", "GET", "git.corp.example.com", 80, monday, false, "no-internal"},
+		{"bob", "GET", "corp.example.com", 80, monday, false, "no-internal"},
+		{"bob", "CONNECT", "ssh.example.net", 22, sunday, true, "ops-all"},
+		{"alice", "CONNECT", "www.example.com", 443, monday, true, "office-hours"},
+		{"alice", "CONNECT", "WWW.Example.COM.", 443, monday, true, "office-hours"},
+		{"alice", "GET", "example.org", 8080, monday, true, "office-hours"},
+		{"alice", "CONNECT", "example.com", 443, monday, false, "default"},
+		{"alice", "CONNECT", "www.example.com", 22, monday, false, "default"},
+		{"alice", "POST", "www.example.com", 443, monday, false, "default"},
+		{"alice", "CONNECT", "www.example.com", 443, sunday, false, "default"},
+		{"carol", "GET", "example.net", 80, saturdayNight, true, "night"},
+		{"carol", "GET", "example.net", 80, monday, false, "default"},
+		{"", "GET", "example.net", 80, monday, false, "default"},
+	}
+
+	for _, tc := range testCases {
+		allow, rule := acl.check(tc.user, tc.method, tc.host, tc.port, tc.now)
+		if allow != tc.allow || rule != tc.rule {
+			t.Errorf("%s %s %s:%d: expected %v by %s, got %v by %s",
+				tc.user, tc.method, tc.host, tc.port, tc.allow, tc.rule, allow, rule)
+		}
+	}
+}
+
+func TestProxyACLConfig(t *testing.T) {
+	for _, c := range []proxyACLConf{
+		{Action: "permit"},
+		{Action: "allow", Hosts: []string{"10.0.0.0/33"}},
+		{Action: "allow", Ports: []string{"0"}},
+		{Action: "allow", Ports: []string{"90-80"}},
+		{Action: "allow", Times: []string{"Mon-Xyz"}},
+		{Action: "allow", Times: []string{"9-18"}},
+		{Action: "allow", Groups: []string{"ops"}},
+	} {
+		if _, err := newProxyACL([]proxyACLConf{c}, ""); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+}
+
+func TestProxyDestination(t *testing.T) {
+	testCases := []struct {
+		method, uri string
+		host        string
+		port        int
+	}{
+		{"CONNECT", "www.example.com:8443", "www.example.com", 8443},
+		{"CONNECT", "www.example.com", "www.example.com", 443},
+		{"GET", "http://www.example.com/a", "www.example.com", 80},
+		{"GET", "https://www.example.com/a", "www.example.com", 443},
+		{"GET", "http://[::1]:8080/a", "::1", 8080},
+	}
+
+	for _, tc := range testCases {
+		r := httptest.NewRequest(tc.method, tc.uri, nil)
+		if tc.method == "CONNECT" {
+			r.RequestURI = tc.uri
+		}
+		host, port := proxyDestination(r)
+		if host != tc.host || port != tc.port {
+			t.Errorf("%s %s: expected %s:%d, got %s:%d", tc.method, tc.uri, tc.host, tc.port, host, port)
+		}
+	}
+}
+
+func TestProxyACLHandler(t *testing.T) {
+	acl, err := newProxyACL([]proxyACLConf{
+		{Action: "allow", Ports: []string{"443"}, Methods: []string{"CONNECT"}},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &handler{enableProxy: true, acl: acl}
+
+	r := httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", w.Code)
+	}
+}
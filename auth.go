@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	auth "github.com/fangdingjun/go-http-auth"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// authenticator checks the credentials carried by the request
+type authenticator interface {
+	// checkAuth returns the user name, empty string means failed
+	checkAuth(r *http.Request) string
+
+	// requireAuth asks the client for the credentials
+	requireAuth(w http.ResponseWriter, r *http.Request)
+}
+
+type digestAuthenticator struct {
+	*auth.DigestAuth
+}
+
+func (da digestAuthenticator) checkAuth(r *http.Request) string {
+	u, _ := da.CheckAuth(r)
+	return u
+}
+
+func (da digestAuthenticator) requireAuth(w http.ResponseWriter, r *http.Request) {
+	da.RequireAuth(w, r)
+}
+
+// basicAuthenticator verify the basic auth password
+// by the backend, see digestPwFile.checkPassword
+type basicAuthenticator struct {
+	realm string
+	pw    passwordChecker
+	proxy bool
+}
+
+func (ba basicAuthenticator) checkAuth(r *http.Request) string {
+	hdr := "Authorization"
+	if ba.proxy {
+		hdr = "Proxy-Authorization"
+	}
+
+	s := strings.SplitN(r.Header.Get(hdr), " ", 2)
+	if len(s) != 2 || !strings.EqualFold(s[0], "Basic") {
+		return ""
+	}
+
+	b, err := base64.StdEncoding.DecodeString(s[1])
+	if err != nil {
+		return ""
+	}
+
+	pair := strings.SplitN(string(b), ":", 2)
+	if len(pair) != 2 || pair[0] == "" {
+		return ""
+	}
+
+	if !ba.pw.checkPassword(pair[0], ba.realm, pair[1]) {
+		return ""
+	}
+	return pair[0]
+}
+
+func (ba basicAuthenticator) requireAuth(w http.ResponseWriter, r *http.Request) {
+	hdr, code := "WWW-Authenticate", http.StatusUnauthorized
+	if ba.proxy {
+		hdr, code = "Proxy-Authenticate", http.StatusProxyAuthRequired
+	}
+	w.Header().Set(hdr, fmt.Sprintf("Basic realm=%q", ba.realm))
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "<h1>%d %s</h1>", code, http.StatusText(code))
+}
+
+func newDigestAuthenticator(realm string, pw *digestPwFile, proxy bool) digestAuthenticator {
+	da := auth.NewDigestAuthenticator(realm, pw.getPw)
+	if proxy {
+		da.Headers = auth.ProxyHeaders
+	}
+	return digestAuthenticator{da}
+}
+
+// the passwd files shared by all the authenticators
+var pwFiles = struct {
+	sync.Mutex
+	m map[string]*digestPwFile
+}{m: map[string]*digestPwFile{}}
+
+func openPwFile(fn string) (*digestPwFile, error) {
+	pwFiles.Lock()
+	defer pwFiles.Unlock()
+
+	if pw, ok := pwFiles.m[fn]; ok {
+		return pw, nil
+	}
+
+	pw, err := newDigestSecret(fn)
+	if err != nil {
+		return nil, err
+	}
+	pwFiles.m[fn] = pw
+	return pw, nil
+}
+
+type ctxKey int
+
+const (
+	remoteUserKey ctxKey = iota
+	authParamsKey
+)
+
+// remoteUser returns the authenticated user of the request
+func remoteUser(r *http.Request) string {
+	u, _ := r.Context().Value(remoteUserKey).(string)
+	return u
+}
+
+// authParams returns the extra uwsgi params set by the authenticator
+func authParams(r *http.Request) map[string]string {
+	p, _ := r.Context().Value(authParamsKey).(map[string]string)
+	return p
+}
+
+// authHandler protects the local resources,
+// the authenticated user name is passed to the backend
+// as REMOTE_USER for uwsgi and fastcgi and X-Remote-User
+// header for the others
+type authHandler struct {
+	authenticator
+	users  map[string]bool
+	groups map[string]bool
+	member map[string][]string
+}
+
+func newAuthHandler(c authConf, res *resolver) (*authHandler, error) {
+	a, err := newAuthenticator(c, false, res)
+	if err != nil {
+		return nil, err
+	}
+
+	ah := &authHandler{
+		authenticator: a,
+		users:         map[string]bool{},
+		groups:        map[string]bool{},
+	}
+
+	for _, u := range c.Users {
+		ah.users[u] = true
+	}
+
+	for _, g := range c.Groups {
+		ah.groups[g] = true
+	}
+
+	if c.GroupFile != "" {
+		if ah.member, err = loadGroupFile(c.GroupFile); err != nil {
+			return nil, err
+		}
+	} else if len(c.Groups) > 0 {
+		return nil, fmt.Errorf("auth: groupfile required for groups")
+	}
+
+	return ah, nil
+}
+
+// allowed reports whether the user can access the resource
+func (ah *authHandler) allowed(user string) bool {
+	if len(ah.users) == 0 && len(ah.groups) == 0 {
+		return true
+	}
+
+	if ah.users[user] {
+		return true
+	}
+
+	for _, g := range ah.member[user] {
+		if ah.groups[g] {
+			return true
+		}
+	}
+	return false
+}
+
+func (ah *authHandler) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// never trust the header from client
+		r.Header.Del("X-Remote-User")
+
+		if cb, ok := ah.authenticator.(interface {
+			handleCallback(w http.ResponseWriter, r *http.Request) bool
+		}); ok && cb.handleCallback(w, r) {
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(),
+			authParamsKey, map[string]string{}))
+
+		user := ah.checkAuth(r)
+		if user == "" {
+			ah.requireAuth(w, r)
+			return
+		}
+
+		if !ah.allowed(user) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "<h1>403 Forbidden</h1>")
+			return
+		}
+
+		r.Header.Set("X-Remote-User", user)
+		h.ServeHTTP(w, r.WithContext(
+			context.WithValue(r.Context(), remoteUserKey, user)))
+	})
+}
+
+// loadGroupFile reads the apache style group file,
+//
+//	group1: user1 user2
+//
+// returns the groups of each user
+func loadGroupFile(fn string) (map[string][]string, error) {
+	fp, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	member := map[string][]string{}
+
+	s := bufio.NewScanner(fp)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+
+		g := strings.TrimSpace(line[:i])
+		for _, u := range strings.Fields(line[i+1:]) {
+			member[u] = append(member[u], g)
+		}
+	}
+
+	return member, s.Err()
+}
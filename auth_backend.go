@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// passwordChecker verify the plain password of user,
+// the backend of basic auth
+type passwordChecker interface {
+	checkPassword(user, realm, password string) bool
+}
+
+// newAuthenticator creates the authenticator from config,
+// proxy selects the Proxy-Authorization headers, the ldap,
+// oidc, jwks and auth request servers are resolved by res
+func newAuthenticator(c authConf, proxy bool, res *resolver) (authenticator, error) {
+	var pc passwordChecker
+
+	if c.Type == "oidc" {
+		if proxy {
+			return nil, fmt.Errorf("auth: oidc is not usable for proxy")
+		}
+		return newOIDCAuthenticator(c.OIDC, res)
+	}
+
+	if c.Type == "jwt" {
+		if proxy {
+			return nil, fmt.Errorf("auth: jwt is not usable for proxy")
+		}
+		return newJWTAuthenticator(c.Realm, c.JWT, res)
+	}
+
+	switch c.Backend {
+	case "", "file":
+		if c.PasswdFile == "" {
+			return nil, fmt.Errorf("auth: passwdfile required")
+		}
+		pw, err := openPwFile(c.PasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		if c.Type == "" || c.Type == "digest" {
+			return withLockout(c, newDigestAuthenticator(c.Realm, pw, proxy), proxy), nil
+		}
+		pc = pw
+	case "ldap":
+		if c.LDAP.URL == "" || c.LDAP.BindDN == "" {
+			return nil, fmt.Errorf("auth: ldap url and binddn required")
+		}
+		pc = &ldapChecker{c.LDAP, &resolvingDialer{d: &net.Dialer{Timeout: 5 * time.Second}, r: res}}
+	case "exec":
+		if len(c.Command) == 0 {
+			return nil, fmt.Errorf("auth: command required")
+		}
+		pc = &execChecker{command: c.Command, timeout: 10 * time.Second}
+	case "request":
+		if c.AuthRequest == "" {
+			return nil, fmt.Errorf("auth: authrequest url required")
+		}
+		return newAuthRequest(c, proxy, res), nil
+	default:
+		return nil, fmt.Errorf("auth: invalid backend: %s, only file, ldap, exec, request allowed", c.Backend)
+	}
+
+	switch c.Type {
+	case "basic":
+	case "", "digest":
+		return nil, fmt.Errorf("auth: %s backend only support basic auth", c.Backend)
+	default:
+		return nil, fmt.Errorf("auth: invalid type: %s, only digest, basic, oidc, jwt allowed", c.Type)
+	}
+
+	if c.CacheTime > 0 || c.NegativeCacheTime > 0 {
+		pc = newCachedChecker(pc, c.CacheTime, c.NegativeCacheTime)
+	}
+
+	return withLockout(c, basicAuthenticator{c.Realm, pc, proxy}, proxy), nil
+}
+
+// withLockout enables the failure tracking when configured
+func withLockout(c authConf, a authenticator, proxy bool) authenticator {
+	if c.Lockout.MaxFailures <= 0 {
+		return a
+	}
+	return lockoutAuth{a, newLockout(c.Lockout), proxy}
+}
+
+// ldapChecker verify the password by bind to the ldap server
+// as the user
+type ldapChecker struct {
+	ldapConf
+	dialer *resolvingDialer
+}
+
+func (lc *ldapChecker) checkPassword(user, realm, password string) bool {
+	if password == "" {
+		// empty password is a unauthenticated bind, always succeed
+		return false
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: lc.InsecureSkipVerify}
+
+	conn, err := lc.dial(tlsConfig)
+	if err != nil {
+		log.Printf("ldap: %s", err)
+		return false
+	}
+	defer conn.Close()
+
+	conn.SetTimeout(10 * time.Second)
+
+	if lc.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			log.Printf("ldap starttls: %s", err)
+			return false
+		}
+	}
+
+	dn := fmt.Sprintf(lc.BindDN, ldap.EscapeDN(user))
+	if err := conn.Bind(dn, password); err != nil {
+		if !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			log.Printf("ldap bind %s: %s", dn, err)
+		}
+		return false
+	}
+	return true
+}
+
+// dial connects the server by the resolver, ldapi is dialed
+// by the library
+func (lc *ldapChecker) dial(tlsConfig *tls.Config) (*ldap.Conn, error) {
+	u, err := url.Parse(lc.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	port := u.Port()
+	switch u.Scheme {
+	case "ldap":
+		if port == "" {
+			port = ldap.DefaultLdapPort
+		}
+	case "ldaps":
+		if port == "" {
+			port = ldap.DefaultLdapsPort
+		}
+	default:
+		return ldap.DialURL(lc.URL, ldap.DialWithTLSConfig(tlsConfig))
+	}
+
+	// the certificate of the name, not the address
+	tlsConfig.ServerName = u.Hostname()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := lc.dialer.DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "ldaps" {
+		tc := tls.Client(conn, tlsConfig)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+
+	c := ldap.NewConn(conn, u.Scheme == "ldaps")
+	c.Start()
+	return c, nil
+}
+
+// execChecker runs the external program to verify the password,
+// the user name and password are written to its stdin, one per line,
+// exit status 0 means success
+type execChecker struct {
+	command []string
+	timeout time.Duration
+}
+
+func (ec *execChecker) checkPassword(user, realm, password string) bool {
+	cmd := exec.Command(ec.command[0], ec.command[1:]...)
+	cmd.Stdin = strings.NewReader(user + "\n" + password + "\n")
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "AUTH_REALM="+realm)
+
+	if err := cmd.Start(); err != nil {
+		log.Printf("auth exec: %s", err)
+		return false
+	}
+
+	t := time.AfterFunc(ec.timeout, func() {
+		log.Printf("auth exec: %s timeout", ec.command[0])
+		cmd.Process.Kill()
+	})
+	defer t.Stop()
+
+	return cmd.Wait() == nil
+}
+
+type cacheEntry struct {
+	user    string
+	ok      bool
+	expires time.Time
+	// the WWW-Authenticate of the denied auth request
+	challenge []string
+}
+
+// authCache remembers the results of the slow backends
+type authCache struct {
+	ttl    time.Duration
+	negTTL time.Duration
+	mu     *sync.Mutex
+	m      map[string]cacheEntry
+}
+
+const maxAuthCacheEntries = 10000
+
+func newAuthCache(ttl, negTTL time.Duration) *authCache {
+	return &authCache{ttl: ttl, negTTL: negTTL, mu: new(sync.Mutex), m: map[string]cacheEntry{}}
+}
+
+func authCacheKey(s ...string) string {
+	h := sha256.New()
+	for _, s1 := range s {
+		io.WriteString(h, s1)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *authCache) get(key string) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.m[key]
+	if !ok || time.Now().After(e.expires) {
+		return e, false
+	}
+	return e, true
+}
+
+func (c *authCache) set(key, user string, ok bool) {
+	c.setEntry(key, cacheEntry{user: user, ok: ok})
+}
+
+// setEntry stores e, the expires is set by e.ok
+func (c *authCache) setEntry(key string, e cacheEntry) {
+	ttl := c.ttl
+	if !e.ok {
+		ttl = c.negTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.m) >= maxAuthCacheEntries {
+		for k, e := range c.m {
+			if now.After(e.expires) {
+				delete(c.m, k)
+			}
+		}
+		if len(c.m) >= maxAuthCacheEntries {
+			c.m = map[string]cacheEntry{}
+		}
+	}
+
+	e.expires = now.Add(ttl)
+	c.m[key] = e
+}
+
+type cachedChecker struct {
+	passwordChecker
+	cache *authCache
+}
+
+func newCachedChecker(pc passwordChecker, ttl, negTTL time.Duration) *cachedChecker {
+	return &cachedChecker{pc, newAuthCache(ttl, negTTL)}
+}
+
+func (cc *cachedChecker) checkPassword(user, realm, password string) bool {
+	key := authCacheKey(user, realm, password)
+	if e, ok := cc.cache.get(key); ok {
+		return e.ok
+	}
+
+	ok := cc.passwordChecker.checkPassword(user, realm, password)
+	cc.cache.set(key, user, ok)
+	return ok
+}
+
+// authRequest asks the url whether the request is allowed,
+// like the nginx auth_request module
+//
+// a GET request with the headers of the original request
+// and X-Original-URI, X-Original-Method is sent to the url,
+// 2xx means allowed and the user name is from X-Auth-User
+// response header, 401 and 403 mean denied
+//
+// the answer is for one request, it is cached by the credentials,
+// the uri, the method and the client address
+type authRequest struct {
+	url    string
+	proxy  bool
+	client *http.Client
+	cache  *authCache
+
+	// the denied requests, requireAuth sends their challenges
+	denied *authCache
+}
+
+// the denied request is kept for requireAuth in authChallengeTime
+const authChallengeTime = time.Minute
+
+func newAuthRequest(c authConf, proxy bool, res *resolver) *authRequest {
+	return &authRequest{
+		url:   c.AuthRequest,
+		proxy: proxy,
+		client: &http.Client{
+			Transport: resolvingTransport(res),
+			Timeout:   10 * time.Second,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		cache:  newAuthCache(c.CacheTime, c.NegativeCacheTime),
+		denied: newAuthCache(0, authChallengeTime),
+	}
+}
+
+func (ar *authRequest) cacheKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return authCacheKey(r.Header.Get("Authorization"),
+		r.Header.Get("Proxy-Authorization"), r.Header.Get("Cookie"),
+		r.Method, r.RequestURI, host)
+}
+
+func (ar *authRequest) checkAuth(r *http.Request) string {
+	key := ar.cacheKey(r)
+	if e, ok := ar.cache.get(key); ok {
+		if !e.ok {
+			ar.denied.setEntry(key, e)
+		}
+		return e.user
+	}
+
+	req, err := http.NewRequest(http.MethodGet, ar.url, nil)
+	if err != nil {
+		log.Printf("auth request: %s", err)
+		return ""
+	}
+
+	for k, v := range r.Header {
+		switch http.CanonicalHeaderKey(k) {
+		case "Connection", "Content-Length", "Transfer-Encoding", "Upgrade",
+			"Te", "Trailer", "Keep-Alive", "Expect":
+			continue
+		}
+		req.Header[k] = v
+	}
+
+	if ar.proxy {
+		// the auth server sees the proxy credentials as normal one
+		if v := r.Header.Get("Proxy-Authorization"); v != "" {
+			req.Header.Set("Authorization", v)
+		}
+	}
+
+	req.Header.Set("X-Original-URI", r.RequestURI)
+	req.Header.Set("X-Original-Method", r.Method)
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		req.Header.Set("X-Forwarded-For", host)
+	}
+
+	resp, err := ar.client.Do(req)
+	if err != nil {
+		log.Printf("auth request: %s", err)
+		return ""
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	var e cacheEntry
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		e.user = resp.Header.Get("X-Auth-User")
+		if e.user == "" {
+			e.user = "-"
+		}
+		e.ok = true
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		e.challenge = resp.Header["Www-Authenticate"]
+	default:
+		log.Printf("auth request: unexpected status %s", resp.Status)
+		return ""
+	}
+
+	ar.cache.setEntry(key, e)
+	if !e.ok {
+		ar.denied.setEntry(key, e)
+	}
+	return e.user
+}
+
+// requireAuth sends the challenge the url answered for r
+func (ar *authRequest) requireAuth(w http.ResponseWriter, r *http.Request) {
+	e, _ := ar.denied.get(ar.cacheKey(r))
+	challenge := e.challenge
+
+	hdr, code := "WWW-Authenticate", http.StatusUnauthorized
+	if ar.proxy {
+		hdr, code = "Proxy-Authenticate", http.StatusProxyAuthRequired
+	}
+	for _, v := range challenge {
+		w.Header().Add(hdr, v)
+	}
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "<h1>%d %s</h1>", code, http.StatusText(code))
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ldapStub accepts the simple bind of the dn with the password
+func ldapStub(t *testing.T, dn, password string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				for {
+					p, err := ber.ReadPacket(c)
+					if err != nil || len(p.Children) < 2 {
+						return
+					}
+					op := p.Children[1]
+					if op.Tag != ldapBindRequest || len(op.Children) < 3 {
+						return
+					}
+
+					code := int64(49) // invalid credentials
+					if op.Children[1].Value == dn && op.Children[2].Data.String() == password {
+						code = 0
+					}
+
+					resp := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+					resp.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, p.Children[0].Value, ""))
+					r := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldapBindResponse, nil, "")
+					r.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+					r.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+					r.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+					resp.AppendChild(r)
+					c.Write(resp.Bytes())
+				}
+			}(c)
+		}
+	}()
+
+	t.Cleanup(func() { l.Close() })
+	return "ldap://" + l.Addr().String()
+}
+
+const (
+	ldapBindRequest  = 0
+	ldapBindResponse = 1
+)
+
+func TestLdapChecker(t *testing.T) {
+	u := ldapStub(t, "uid=test,ou=people,dc=example,dc=com", "secret")
+
+	// the server is resolved by the resolver
+	res, _ := newResolver(resolverConf{Hosts: map[string][]string{"ldap.test": {"127.0.0.1"}}})
+	lc := &ldapChecker{ldapConf{URL: strings.Replace(u, "127.0.0.1", "ldap.test", 1),
+		BindDN: "uid=%s,ou=people,dc=example,dc=com"}, &resolvingDialer{d: &net.Dialer{}, r: res}}
+	if !lc.checkPassword("test", "", "secret") {
+		t.Errorf("valid password rejected")
+	}
+	if lc.checkPassword("test", "", "bad") {
+		t.Errorf("invalid password accepted")
+	}
+	if lc.checkPassword("test", "", "") {
+		t.Errorf("empty password accepted")
+	}
+}
+
+func TestExecChecker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authexec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "check.sh")
+	ioutil.WriteFile(script, []byte("#!/bin/sh\nread u\nread p\n[ \"$u:$p\" = \"test:secret\" ]\n"), 0755)
+
+	c := newCachedChecker(&execChecker{command: []string{script}, timeout: time.Second},
+		time.Minute, time.Minute)
+	if !c.checkPassword("test", "", "secret") {
+		t.Errorf("valid password rejected")
+	}
+	if c.checkPassword("test", "", "bad") {
+		t.Errorf("invalid password accepted")
+	}
+
+	// served from cache
+	os.Remove(script)
+	if !c.checkPassword("test", "", "secret") {
+		t.Errorf("cached result not used")
+	}
+}
+
+func TestAuthRequest(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		uri := r.Header.Get("X-Original-URI")
+		if uri == "/public" && r.Header.Get("X-Forwarded-For") == "192.0.2.1" {
+			w.Header().Set("X-Auth-User", "anon")
+			return
+		}
+		if u, p, _ := r.BasicAuth(); u == "test" && p == "secret" && uri == "/a/b" {
+			w.Header().Set("X-Auth-User", u)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", uri))
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	a, err := newAuthenticator(authConf{Backend: "request", AuthRequest: srv.URL,
+		CacheTime: time.Minute, NegativeCacheTime: time.Minute}, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/a/b", nil)
+		r.SetBasicAuth("test", "secret")
+		if u := a.checkAuth(r); u != "test" {
+			t.Errorf("expected user test, got %q", u)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("expected 1 subrequest, got %d", calls)
+	}
+
+	// the answer is not reused for the other uri, method or client
+	testCases := []struct {
+		method string
+		uri    string
+		ip     string
+		user   string
+	}{
+		{http.MethodGet, "/public", "192.0.2.1", "anon"},
+		{http.MethodGet, "/a/b", "192.0.2.1", ""},
+		{http.MethodGet, "/public", "192.0.2.2", ""},
+		{http.MethodGet, "/c", "192.0.2.1", ""},
+		{http.MethodPost, "/a/b", "192.0.2.1", ""},
+	}
+
+	var reqs []*http.Request
+	for _, tc := range testCases {
+		r := httptest.NewRequest(tc.method, tc.uri, nil)
+		r.RemoteAddr = tc.ip + ":1234"
+		if u := a.checkAuth(r); u != tc.user {
+			t.Errorf("%s %s from %s: expected %q, got %q", tc.method, tc.uri, tc.ip, tc.user, u)
+		}
+		reqs = append(reqs, r)
+	}
+	if calls != 6 {
+		t.Errorf("expected 6 subrequests, got %d", calls)
+	}
+
+	// each request gets its own challenge
+	for _, r := range reqs[1:] {
+		w := httptest.NewRecorder()
+		a.requireAuth(w, r)
+		if c := w.Header().Get("WWW-Authenticate"); w.Code != http.StatusUnauthorized ||
+			c != fmt.Sprintf("Basic realm=%q", r.RequestURI) {
+			t.Errorf("%s: unexpected challenge %d %q", r.RequestURI, w.Code, c)
+		}
+	}
+}
+
+func TestNewAuthenticatorErrors(t *testing.T) {
+	for _, c := range []authConf{
+		{Backend: "ldap", Type: "digest", LDAP: ldapConf{URL: "ldap://a", BindDN: "%s"}},
+		{Backend: "exec"},
+		{Backend: "nis"},
+		{Type: "basic"},
+	} {
+		if _, err := newAuthenticator(c, false, nil); err == nil {
+			t.Errorf("%s: expected error", fmt.Sprintf("%+v", c))
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuthHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	groupfile := filepath.Join(dir, "group")
+	ioutil.WriteFile(groupfile, []byte("admin: test\n"), 0644)
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", remoteUser(r), r.Header.Get("X-Remote-User"))
+	})
+
+	testData := []struct {
+		c    authConf
+		user string
+		pass string
+		code int
+	}{
+		{authConf{Type: "basic", Realm: "example.com"}, "test", "test", http.StatusOK},
+		{authConf{Type: "basic", Realm: "example.com"}, "test", "bad", http.StatusUnauthorized},
+		{authConf{Type: "basic", Realm: "example.com"}, "", "", http.StatusUnauthorized},
+		{authConf{Type: "basic", Realm: "other"}, "test", "test", http.StatusUnauthorized},
+		{authConf{Type: "basic", Realm: "example.com", Users: []string{"u1"}}, "test", "test", http.StatusForbidden},
+		{authConf{Type: "basic", Realm: "example.com", Groups: []string{"admin"}}, "test", "test", http.StatusOK},
+		{authConf{Type: "digest", Realm: "example.com"}, "", "", http.StatusUnauthorized},
+	}
+
+	for i, d := range testData {
+		d.c.PasswdFile = "passwdfile"
+		d.c.GroupFile = groupfile
+		ah, err := newAuthHandler(d.c, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Remote-User", "spoofed")
+		if d.user != "" {
+			r.SetBasicAuth(d.user, d.pass)
+		}
+		ah.middleware(ok).ServeHTTP(w, r)
+
+		if w.Code != d.code {
+			t.Errorf("%d: expected %d, got %d", i, d.code, w.Code)
+		}
+		if w.Code == http.StatusOK && w.Body.String() != "test test" {
+			t.Errorf("%d: expected user test, got %q", i, w.Body.String())
+		}
+	}
+}
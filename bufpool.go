@@ -0,0 +1,24 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+const copyBufferSize = 64 * 1024
+
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
+// copyBuffer is io.Copy with the buffer from pool,
+// io.ReaderFrom and io.WriterTo are still preferred,
+// so sendfile and splice are used when possible
+func copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	b := bufPool.Get().(*[]byte)
+	defer bufPool.Put(b)
+	return io.CopyBuffer(dst, src, *b)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"github.com/go-yaml/yaml"
 	"io/ioutil"
+	"time"
 )
 
 type conf []server
@@ -14,9 +15,60 @@ type server struct {
 	URLRules    []rule
 	EnableProxy bool
 	EnableAuth  bool
+	AuthType    string
 	PasswdFile  string
 	Realm       string
 	Vhost       []vhost
+
+	// replace authtype, passwdfile and realm when set
+	Auth *authConf
+
+	// max number of paths keep the opened files, 0 disables the cache
+	OpenFileCache int
+
+	// the forward proxy access rules, checked in order
+	ProxyACL []proxyACLConf
+
+	// the client address control, for all the requests
+	Access accessConf
+	// the X-Forwarded-For from these addresses is trusted,
+	// and they must send the PROXY header when proxyprotocol enabled
+	TrustedProxies []string
+	ProxyProtocol  bool
+
+	// the forward proxy goes through the parent proxies
+	ParentProxy []parentProxyConf
+	ProxyRoutes []proxyRouteConf
+
+	// listen SOCKS5 and SOCKS4a on host:socksport, 0 disables it,
+	// it shares enableproxy, auth and proxyacl with the http proxy
+	SocksPort int
+
+	// serve http, tls and socks(when enableproxy) on the same port,
+	// the protocol is detected by the first byte
+	SniffProtocol bool
+
+	Timeouts timeoutConf
+
+	// the connection pool of the forward proxy
+	ProxyPool poolConf
+
+	// the Via and X-Forwarded-For policy of the forward proxy
+	ProxyHeaders proxyHeaderConf
+
+	// the destinations the forward proxy can not reach
+	ProxyGuard proxyGuardConf
+
+	// the domain block and allow lists of the forward proxy
+	ProxyFilter proxyFilterConf
+
+	// the dns of all the outbound connections, the proxy, the url
+	// backends and the auth servers
+	Resolver resolverConf
+
+	FollowSymlinks string
+	DenyDotfiles   bool
+	DenyFiles      []string
 }
 
 type vhost struct {
@@ -25,14 +77,259 @@ type vhost struct {
 	Cert     string
 	Key      string
 	URLRules []rule
+	Auth     *authConf
+	Access   accessConf
+
+	FollowSymlinks string
+	DenyDotfiles   bool
+	DenyFiles      []string
 }
 
 type rule struct {
-	URLPrefix string
-	IsRegex   bool
-	Docroot   string
-	Type      string
-	Target    target
+	URLPrefix  string
+	IsRegex    bool
+	Docroot    string
+	Type       string
+	Target     target
+	ReadOnly   bool
+	MaxSize    int64
+	AllowedExt []string
+	TempDir    string
+	SecureLink secureLinkConf
+	Auth       *authConf
+	Access     accessConf
+}
+
+type authConf struct {
+	// digest, basic, oidc or jwt
+	Type       string
+	Realm      string
+	PasswdFile string
+	GroupFile  string
+
+	// the users and the groups allowed,
+	// all the valid users are allowed when both empty
+	Users  []string
+	Groups []string
+
+	// file(default), ldap, exec or request
+	Backend     string
+	LDAP        ldapConf
+	OIDC        oidcConf
+	JWT         jwtConf
+	Command     []string
+	AuthRequest string
+
+	// cache the results of backend
+	CacheTime         time.Duration
+	NegativeCacheTime time.Duration
+
+	// lock the client and user after too many failures,
+	// digest and basic only
+	Lockout lockoutConf
+}
+
+// lockoutConf enables the brute force protection when maxfailures > 0
+type lockoutConf struct {
+	MaxFailures int
+	// the failures are counted in window, default 10m
+	Window time.Duration
+	// the first lock time, doubled on each lock, default 1m
+	LockTime time.Duration
+	// default 1h
+	MaxLockTime time.Duration
+}
+
+// accessConf is the client address allow and deny lists,
+// the entries are CIDR or single address, the include files
+// have lines like "allow 10.0.0.0/8" and are reloaded on change
+type accessConf struct {
+	Allow   []string
+	Deny    []string
+	Include []string
+}
+
+// timeoutConf is the timeouts of the server and the forward proxy,
+// 0 means the default, the negative one disables the timeout
+type timeoutConf struct {
+	// the http server
+	ReadHeader time.Duration
+	Read       time.Duration
+	Write      time.Duration
+	Idle       time.Duration
+
+	// the forward proxy to the destination or the parent proxy
+	Dial           time.Duration
+	TLSHandshake   time.Duration
+	ResponseHeader time.Duration
+
+	// the CONNECT, socks tunnel and socks udp association
+	TunnelIdle time.Duration
+}
+
+// poolConf is the upstream connection pool of the forward proxy,
+// 0 means the default
+type poolConf struct {
+	MaxIdle        int
+	MaxIdlePerHost int
+	// 0 means no limit
+	MaxPerHost int
+	IdleTime   time.Duration
+
+	DisableKeepAlives bool
+	// http/2 is used for https upstreams when the server supports it
+	DisableHTTP2 bool
+}
+
+// proxyHeaderConf is the header policy, see headerPolicy
+type proxyHeaderConf struct {
+	// add, strip or anonymize
+	Via string
+	// the pseudonym in Via, gserver by default
+	ViaName string
+	// pass, add, strip or anonymize
+	XForwardedFor string
+}
+
+// proxyGuardConf is the destination filter of the forward proxy,
+// see dialGuard, it is enabled by default
+type proxyGuardConf struct {
+	Disable bool
+	// CIDR or single address, loopback, private
+	// and link-local by default
+	Deny []string
+	// the exceptions of deny
+	Allow []string
+	// the ports the CONNECT, socks and connect-udp tunnels
+	// can reach, like 443 or 8000-8999, empty allows all
+	ConnectPorts []string
+}
+
+// proxyFilterConf is the domain lists of the forward proxy,
+// see domainFilter, the files are reloaded on change
+type proxyFilterConf struct {
+	Block []string
+	Allow []string
+	// allow(default) or block the hosts not in the lists
+	Default string
+	// page(default) replies 403 with the block page,
+	// reset closes the connection
+	Action string
+	// the html file replaces the built-in block page
+	BlockPage string
+}
+
+// resolverConf is the dns of the outbound connections,
+// see resolver, the system resolver when nothing set
+type resolverConf struct {
+	// the static addresses, host: [address, ...]
+	Hosts map[string][]string
+	// udp://, tcp://, tls:// or https://, udp by default
+	Servers []string
+	// ipv4(default), ipv6, ipv4only or ipv6only
+	Prefer string
+	// 0 means the default, the negative maxttl and
+	// negativettl disable the cache
+	MinTTL      time.Duration
+	MaxTTL      time.Duration
+	NegativeTTL time.Duration
+	CacheSize   int
+}
+
+// parentProxyConf is the upstream proxy of the forward proxy
+type parentProxyConf struct {
+	Name string
+	// http, https, h2 or socks5 url, with the credentials
+	URL                string
+	InsecureSkipVerify bool
+}
+
+// proxyRouteConf sends the request to hosts by the parent proxy
+// named via, or direct, hosts is required, "*" matches any host
+type proxyRouteConf struct {
+	Hosts []string
+	Via   string
+}
+
+// proxyACLConf is a forward proxy access rule,
+// all the conditions must match, the empty one matches any
+//
+// the CIDR hosts match the ip address requests only, the host name
+// is not resolved, deny the addresses by proxyguard, which checks
+// the resolved ones at dial time
+type proxyACLConf struct {
+	Name string
+	// allow or deny
+	Action  string
+	Users   []string
+	Groups  []string
+	Hosts   []string
+	Ports   []string
+	Methods []string
+	Times   []string
+}
+
+type jwtConf struct {
+	// the HS256 shared secret
+	Secret string
+	// the PEM public key or certificate file
+	PublicKey string
+	// the JWKS file or url, and the reload interval, default 1h
+	JWKS        string
+	JWKSRefresh time.Duration
+
+	// the allowed algorithms, default all supported by the keys
+	Algorithms []string
+	Issuer     string
+	Audience   []string
+	Leeway     time.Duration
+
+	// claim: value, empty value only requires the claim exists
+	RequiredClaims map[string]string
+
+	// the claim used as user name, default sub
+	UserClaim string
+	// claim: name, pass the claims to backend as headers or uwsgi params
+	Headers map[string]string
+	Params  map[string]string
+}
+
+type oidcConf struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// the callback url, must be in the protected path
+	RedirectURL string
+	Scopes      []string
+
+	// the key to encrypt the session cookie
+	CookieSecret string
+	CookieName   string
+	SessionTime  time.Duration
+
+	// the claim used as user name, default email
+	UserClaim   string
+	GroupsClaim string
+
+	// the email domains and the groups allowed,
+	// all users are allowed when empty
+	AllowedDomains []string
+	AllowedGroups  []string
+}
+
+type ldapConf struct {
+	// ldap://host:389 or ldaps://host:636
+	URL string
+	// %s is replaced by the user name,
+	// like uid=%s,ou=people,dc=example,dc=com
+	BindDN             string
+	StartTLS           bool
+	InsecureSkipVerify bool
+}
+
+type secureLinkConf struct {
+	Secret  string
+	CheckIP bool
 }
 
 type target struct {
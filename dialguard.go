@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+)
+
+// the networks the forward proxy never reaches by default,
+// loopback, private, link-local(the cloud metadata), the shared
+// address space, multicast, broadcast, the unspecified ones and
+// the nat64 prefix, which maps to any ipv4 one
+var defaultDenyNets = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"224.0.0.0/4",
+	"255.255.255.255/32",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+var errDestinationDenied = errors.New("destination not allowed")
+
+// dialGuard keeps the direct connections of the forward proxy
+// away from the internal networks
+//
+// the host is resolved once by resolvingDialer, all the addresses
+// are checked and only the vetted one is dialed, the dns rebinding
+// has no chance to return another address between the check and
+// the dial. the parent proxies resolve and dial by themselves, the
+// requests through them are not checked
+type dialGuard struct {
+	deny  []*net.IPNet
+	allow []*net.IPNet
+
+	// the ports of the CONNECT, socks and connect-udp tunnels,
+	// empty allows all
+	connectPorts [][2]int
+}
+
+// newDialGuard returns nil when disabled, the nil one allows all
+func newDialGuard(c proxyGuardConf) (*dialGuard, error) {
+	if c.Disable {
+		return nil, nil
+	}
+
+	g := &dialGuard{}
+
+	deny := c.Deny
+	if len(deny) == 0 {
+		deny = defaultDenyNets
+	}
+
+	var err error
+	if g.deny, err = parseIPNets(deny); err != nil {
+		return nil, fmt.Errorf("proxyguard: %s", err)
+	}
+	if g.allow, err = parseIPNets(c.Allow); err != nil {
+		return nil, fmt.Errorf("proxyguard: %s", err)
+	}
+
+	for _, p := range c.ConnectPorts {
+		pr, err := parsePortRange(p)
+		if err != nil {
+			return nil, fmt.Errorf("proxyguard: %s", err)
+		}
+		g.connectPorts = append(g.connectPorts, pr)
+	}
+
+	return g, nil
+}
+
+func (g *dialGuard) allowIP(ip net.IP) bool {
+	if g == nil {
+		return true
+	}
+	return !containsIP(g.deny, ip) || containsIP(g.allow, ip)
+}
+
+func (g *dialGuard) allowPort(port int) bool {
+	if g == nil || len(g.connectPorts) == 0 {
+		return true
+	}
+	for _, pr := range g.connectPorts {
+		if port >= pr[0] && port <= pr[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// filter returns the allowed addresses of host,
+// errDestinationDenied when none
+func (g *dialGuard) filter(host string, ips []net.IP) ([]net.IP, error) {
+	if g == nil {
+		return ips, nil
+	}
+
+	var allowed []net.IP
+	for _, ip := range ips {
+		if g.allowIP(ip) {
+			allowed = append(allowed, ip)
+		}
+	}
+
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("%s: %w", host, errDestinationDenied)
+	}
+	return allowed, nil
+}
+
+// checkConnect reports whether the tunnel can go to the port,
+// method is CONNECT, SOCKS or UDP, the denied request is logged
+func (g *dialGuard) checkConnect(method, host string, port int, from string) bool {
+	if g.allowPort(port) {
+		return true
+	}
+	log.Printf("proxy guard: %s %s:%d from %s denied, port not allowed",
+		method, host, port, from)
+	return false
+}
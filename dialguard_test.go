@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestDialGuard(t *testing.T) {
+	g, err := newDialGuard(proxyGuardConf{Allow: []string{"10.1.2.0/24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		ip    string
+		allow bool
+	}{
+		{"127.0.0.1", false},
+		{"169.254.169.254", false},
+		{"192.168.1.1", false},
+		{"10.0.0.1", false},
+		{"10.1.2.3", true},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"224.0.0.251", false},
+		{"255.255.255.255", false},
+		{"ff02::1", false},
+		{"64:ff9b::7f00:1", false},
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::1", true},
+	}
+
+	for _, tc := range testCases {
+		if ok := g.allowIP(net.ParseIP(tc.ip)); ok != tc.allow {
+			t.Errorf("%s: expected %v, got %v", tc.ip, tc.allow, ok)
+		}
+	}
+
+	if !g.allowPort(443) || !g.allowPort(22) {
+		t.Errorf("all the ports expected by default")
+	}
+
+	g, _ = newDialGuard(proxyGuardConf{ConnectPorts: []string{"22", "8000-8999"}})
+	if !g.allowPort(22) || !g.allowPort(8080) || g.allowPort(443) {
+		t.Errorf("unexpected connect ports %v", g.connectPorts)
+	}
+
+	if g, _ := newDialGuard(proxyGuardConf{Disable: true}); g != nil || !g.allowIP(net.ParseIP("127.0.0.1")) {
+		t.Errorf("expected the disabled guard allows all")
+	}
+
+	for _, c := range []proxyGuardConf{{Deny: []string{"x"}}, {Allow: []string{"1.1.1.1/33"}}, {ConnectPorts: []string{"0"}}} {
+		if _, err := newDialGuard(c); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+}
+
+func TestDialGuardRebinding(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	g, _ := newDialGuard(proxyGuardConf{Allow: []string{"127.0.0.1"}})
+	r, _ := newResolver(resolverConf{Hosts: map[string][]string{
+		"rebind.test":   {"10.0.0.1", "127.0.0.1"},
+		"internal.test": {"192.168.0.1"},
+	}})
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	d := &resolvingDialer{d: &net.Dialer{}, r: r, g: g}
+	dial := d.DialContext
+
+	// the denied address is never dialed
+	conn, err := dial(context.Background(), "tcp", net.JoinHostPort("rebind.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := conn.RemoteAddr().(*net.TCPAddr); !a.IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("unexpected address %s", a)
+	}
+	conn.Close()
+
+	for _, host := range []string{"internal.test", "127.0.0.2"} {
+		_, err = dial(context.Background(), "tcp", net.JoinHostPort(host, port))
+		if !errors.Is(err, errDestinationDenied) {
+			t.Errorf("%s: expected denied, got %v", host, err)
+		}
+	}
+}
+
+func TestHandlerGuard(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "internal")
+	}))
+	defer ts.Close()
+
+	g, _ := newDialGuard(proxyGuardConf{})
+	ur, err := newUpstreamRouter(nil, nil, timeoutConf{}, poolConf{}, g, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ps := httptest.NewServer(&handler{enableProxy: true, upstreams: ur, guard: g})
+	defer ps.Close()
+
+	u, _ := url.Parse(ps.URL)
+	c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+
+	resp, err := c.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", resp.StatusCode)
+	}
+
+	for _, host := range []string{ts.Listener.Addr().String(), "127.0.0.1:443"} {
+		req, _ := http.NewRequest(http.MethodConnect, ps.URL, nil)
+		req.Host = host
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("CONNECT %s: expected 403, got %d", host, resp.StatusCode)
+		}
+	}
+}
@@ -2,89 +2,170 @@ package main
 
 import (
 	"bufio"
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
 	"os"
 	"strings"
-	"sync"
-	"time"
+	"sync/atomic"
 )
 
+// digestPwFile is the passwd file, reloaded when it changes,
+// the last good copy is kept when the new one is invalid
 type digestPwFile struct {
 	path  string
-	entry []pwEntry
-	mtime time.Time
-	mu    *sync.Mutex
+	table atomic.Value // *pwTable
 }
 
-type pwEntry struct {
-	user   string
-	realm  string
-	hashPw string
+// pwTable is the parsed passwd file
+type pwTable struct {
+	// user:realm -> md5(user:realm:password)
+	digest map[pwKey]string
+	// user -> htpasswd hash
+	htpasswd map[string]string
+}
+
+type pwKey struct {
+	user  string
+	realm string
 }
 
 func newDigestSecret(f string) (*digestPwFile, error) {
-	a := &digestPwFile{path: f, mu: new(sync.Mutex)}
+	a := &digestPwFile{path: f}
+	watchFile(f, a.reload)
 	if err := a.loadFile(); err != nil {
 		return nil, err
 	}
-	go a.tryReload()
 	return a, nil
 }
 
-func (df *digestPwFile) tryReload() {
-	for {
-		time.Sleep(10 * time.Second)
-		fi, _ := os.Stat(df.path)
-		t1 := fi.ModTime()
-		if t1 != df.mtime {
-			df.loadFile()
-		}
+func (df *digestPwFile) reload() {
+	if err := df.loadFile(); err != nil {
+		log.Printf("%s, keep the last copy", err)
+		return
 	}
+	log.Printf("%s: reloaded", df.path)
 }
 
 func (df *digestPwFile) loadFile() error {
-	df.mu.Lock()
-	defer df.mu.Unlock()
-
 	fp, err := os.Open(df.path)
 	if err != nil {
 		return err
 	}
-
 	defer fp.Close()
 
-	entry := []pwEntry{}
+	t, err := parsePwFile(fp, df.path)
+	if err != nil {
+		return err
+	}
 
-	r := bufio.NewReader(fp)
-	for {
-		line, err := r.ReadString('\n')
+	df.table.Store(t)
+	return nil
+}
+
+// parsePwFile parses the passwd file, the invalid lines are logged
+// with the line number, and a error returned when any found
+func parsePwFile(r io.Reader, name string) (*pwTable, error) {
+	t := &pwTable{digest: map[pwKey]string{}, htpasswd: map[string]string{}}
+
+	bad := 0
+	lineno := 0
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		lineno++
+
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) < 2 || fields[0] == "" {
+			log.Printf("%s:%d: invalid entry", name, lineno)
+			bad++
+			continue
+		}
 
-		if err != nil {
-			break
+		user := fields[0]
+
+		// htpasswd, user:hashed_password
+		if len(fields) == 2 {
+			hashPw := fields[1]
+			if !supportedHash(hashPw) {
+				log.Printf("%s:%d: unsupported hash for user %s, ignored", name, lineno, user)
+				continue
+			}
+			if _, ok := t.htpasswd[user]; ok {
+				log.Printf("%s:%d: duplicate user %s", name, lineno, user)
+			}
+			t.htpasswd[user] = hashPw
+			continue
 		}
 
-		line1 := strings.Trim(line, " \r\n")
-		if line1 == "" || line1[0] == '#' {
+		// user:realm:md5(user:realm:password)
+		realm, hashPw := fields[1], fields[2]
+		if realm == "" {
+			log.Printf("%s:%d: empty realm for user %s", name, lineno, user)
+			bad++
+			continue
+		}
+		if b, err := hex.DecodeString(hashPw); err != nil || len(b) != md5.Size {
+			log.Printf("%s:%d: invalid digest hash for user %s", name, lineno, user)
+			bad++
 			continue
 		}
-		fields := strings.SplitN(line1, ":", 3)
-		entry = append(entry, pwEntry{fields[0], fields[1], fields[2]})
+
+		k := pwKey{user, realm}
+		if _, ok := t.digest[k]; ok {
+			log.Printf("%s:%d: duplicate user %s in realm %s", name, lineno, user, realm)
+		}
+		t.digest[k] = strings.ToLower(hashPw)
 	}
 
-	df.entry = entry
-	fi, _ := os.Stat(df.path)
-	df.mtime = fi.ModTime()
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
 
-	return nil
+	if bad > 0 {
+		return nil, fmt.Errorf("%s: %d invalid lines", name, bad)
+	}
+
+	return t, nil
+}
+
+func (df *digestPwFile) getTable() *pwTable {
+	return df.table.Load().(*pwTable)
 }
 
 func (df *digestPwFile) getPw(user, realm string) string {
-	df.mu.Lock()
-	defer df.mu.Unlock()
+	if realm == "" {
+		// the htpasswd entry is not usable for digest
+		return ""
+	}
+	return df.getTable().digest[pwKey{user, realm}]
+}
 
-	for i := range df.entry {
-		if df.entry[i].user == user && df.entry[i].realm == realm {
-			return df.entry[i].hashPw
-		}
+// checkPassword verify the plain password of user,
+// the htpasswd entry is preferred, the digest entry
+// of the realm is used when the user has no htpasswd entry
+func (df *digestPwFile) checkPassword(user, realm, password string) bool {
+	if hashPw := df.getHtpasswd(user); hashPw != "" {
+		return verifyPassword(hashPw, password)
 	}
-	return ""
+
+	hashPw := df.getPw(user, realm)
+	if hashPw == "" {
+		return false
+	}
+
+	h := md5.Sum([]byte(fmt.Sprintf("%s:%s:%s", user, realm, password)))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(h[:])), []byte(hashPw)) == 1
+}
+
+func (df *digestPwFile) getHtpasswd(user string) string {
+	return df.getTable().htpasswd[user]
 }
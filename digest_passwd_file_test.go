@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePwFile(t *testing.T) {
+	// no trailing newline on the last line
+	data := "# comment\n" +
+		"test:example.com:3441b753b98a6dc702183c989e35970f\n" +
+		"test:other.com:0123456789ABCDEF0123456789abcdef\n" +
+		"user1:$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"
+
+	pt, err := parsePwFile(strings.NewReader(data), "passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pt.digest[pwKey{"test", "example.com"}] != "3441b753b98a6dc702183c989e35970f" {
+		t.Errorf("realm example.com entry missing")
+	}
+	if pt.digest[pwKey{"test", "other.com"}] != "0123456789abcdef0123456789abcdef" {
+		t.Errorf("realm other.com entry missing")
+	}
+	if pt.htpasswd["user1"] == "" {
+		t.Errorf("last line without newline dropped")
+	}
+
+	for _, bad := range []string{
+		"nocolon\n",
+		":example.com:3441b753b98a6dc702183c989e35970f\n",
+		"test::3441b753b98a6dc702183c989e35970f\n",
+		"test:example.com:xyz\n",
+	} {
+		if _, err := parsePwFile(strings.NewReader(data+"\n"+bad), "passwd"); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+}
+
+func TestPwFileReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pwfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "passwd")
+	ioutil.WriteFile(fn, []byte("test:example.com:3441b753b98a6dc702183c989e35970f\n"), 0644)
+
+	pw, err := newDigestSecret(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor := func(cond func() bool) bool {
+		for i := 0; i < 50; i++ {
+			if cond() {
+				return true
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		return false
+	}
+
+	// replaced by rename, like most editors do
+	tmp := filepath.Join(dir, "passwd.tmp")
+	ioutil.WriteFile(tmp, []byte("test2:example.com:0123456789abcdef0123456789abcdef\n"), 0644)
+	os.Rename(tmp, fn)
+
+	if !waitFor(func() bool { return pw.getPw("test2", "example.com") != "" }) {
+		t.Fatalf("new file not loaded")
+	}
+	if pw.getPw("test", "example.com") != "" {
+		t.Errorf("old entry still present")
+	}
+
+	// invalid content, keep the last good copy
+	ioutil.WriteFile(fn, []byte("test3:example.com:bad\n"), 0644)
+	time.Sleep(5 * reloadDelay)
+	if pw.getPw("test2", "example.com") == "" {
+		t.Errorf("last good copy dropped on invalid file")
+	}
+
+	// removed, keep the last good copy
+	os.Remove(fn)
+	time.Sleep(5 * reloadDelay)
+	if pw.getPw("test2", "example.com") == "" {
+		t.Errorf("last good copy dropped on remove")
+	}
+
+	// created again
+	ioutil.WriteFile(fn, []byte("test4:example.com:0123456789abcdef0123456789abcdef\n"), 0644)
+	if !waitFor(func() bool { return pw.getPw("test4", "example.com") != "" }) {
+		t.Errorf("recreated file not loaded")
+	}
+}
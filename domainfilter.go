@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// domainFilter blocks the forward proxy requests by the host,
+// a host in the allow lists passes, a host in the block lists is
+// blocked, the others follow the default
+//
+// the list files are reloaded on change, the last good copy is
+// kept when the new one is invalid
+type domainFilter struct {
+	files []*domainFile
+
+	// block the hosts not in the lists
+	blockDefault bool
+
+	// reset the connection instead of the block page
+	reset bool
+	page  []byte
+}
+
+// domainFile is the list file, one entry per line
+//
+//	example.com                the name only
+//	.example.com               the name and the subdomains,
+//	*.example.com              the same
+//	/^ad[0-9]*\./              the regexp
+//	0.0.0.0 a.com b.com        the hosts file, the names only
+//	||example.com^             the AdBlock domain rule, the name
+//	                           and the subdomains
+//	@@||example.com^           the AdBlock exception, allowed
+//
+// the lines begin with # or ! are comments, the AdBlock rules
+// with options or paths are skipped, they are not for the host
+type domainFile struct {
+	path  string
+	allow bool
+	rules atomic.Value // *domainRules
+}
+
+type domainRules struct {
+	block domainSet
+	allow domainSet
+}
+
+type domainSet struct {
+	exact  map[string]bool
+	suffix map[string]bool
+	regex  []*regexp.Regexp
+}
+
+var errBlocked = errors.New("blocked by the proxy filter")
+
+const defaultBlockPage = `<html>
+<head><title>403 Forbidden</title></head>
+<body>
+<h1>403 Forbidden</h1>
+<p>The access to %s is blocked by the proxy policy.</p>
+</body>
+</html>
+`
+
+// newDomainFilter returns nil when no list configured
+func newDomainFilter(c proxyFilterConf) (*domainFilter, error) {
+	if len(c.Block) == 0 && len(c.Allow) == 0 {
+		return nil, nil
+	}
+
+	f := &domainFilter{}
+
+	switch c.Default {
+	case "", "allow":
+	case "block":
+		f.blockDefault = true
+	default:
+		return nil, fmt.Errorf("proxyfilter: invalid default %s, only allow, block allowed", c.Default)
+	}
+
+	switch c.Action {
+	case "", "page":
+	case "reset":
+		f.reset = true
+	default:
+		return nil, fmt.Errorf("proxyfilter: invalid action %s, only page, reset allowed", c.Action)
+	}
+
+	if c.BlockPage != "" {
+		b, err := os.ReadFile(c.BlockPage)
+		if err != nil {
+			return nil, fmt.Errorf("proxyfilter: %s", err)
+		}
+		f.page = b
+	}
+
+	for _, fn := range c.Block {
+		df, err := openDomainFile(fn, false)
+		if err != nil {
+			return nil, fmt.Errorf("proxyfilter: %s", err)
+		}
+		f.files = append(f.files, df)
+	}
+	for _, fn := range c.Allow {
+		df, err := openDomainFile(fn, true)
+		if err != nil {
+			return nil, fmt.Errorf("proxyfilter: %s", err)
+		}
+		f.files = append(f.files, df)
+	}
+
+	return f, nil
+}
+
+func openDomainFile(fn string, allow bool) (*domainFile, error) {
+	df := &domainFile{path: fn, allow: allow}
+	watchFile(fn, df.reload)
+	if err := df.load(); err != nil {
+		return nil, err
+	}
+	return df, nil
+}
+
+func (df *domainFile) reload() {
+	if err := df.load(); err != nil {
+		log.Printf("%s, keep the last copy", err)
+		return
+	}
+	log.Printf("%s: reloaded", df.path)
+}
+
+func (df *domainFile) load() error {
+	fp, err := os.Open(df.path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	rules, err := parseDomainList(fp, df.path, df.allow)
+	if err != nil {
+		return err
+	}
+
+	df.rules.Store(rules)
+	return nil
+}
+
+func newDomainSet() domainSet {
+	return domainSet{exact: map[string]bool{}, suffix: map[string]bool{}}
+}
+
+// parseDomainList parses the list, all the entries are allowed
+// when allow is true
+func parseDomainList(r io.Reader, name string, allow bool) (*domainRules, error) {
+	rules := &domainRules{block: newDomainSet(), allow: newDomainSet()}
+	bad := 0
+	lineno := 0
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		lineno++
+
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+
+		set := &rules.block
+		if allow {
+			set = &rules.allow
+		}
+
+		if strings.HasPrefix(line, "@@") {
+			set = &rules.allow
+			line = line[2:]
+		}
+
+		// regexp
+		if len(line) > 2 && line[0] == '/' && line[len(line)-1] == '/' {
+			re, err := regexp.Compile(line[1 : len(line)-1])
+			if err != nil {
+				log.Printf("%s:%d: %s", name, lineno, err)
+				bad++
+				continue
+			}
+			set.regex = append(set.regex, re)
+			continue
+		}
+
+		// AdBlock
+		if strings.HasPrefix(line, "||") {
+			d := strings.TrimSuffix(strings.TrimSuffix(line[2:], "|"), "^")
+			if strings.ContainsAny(d, "$/*^|") {
+				continue
+			}
+			set.suffix[normalizeHost(d)] = true
+			continue
+		}
+
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+
+		// hosts file
+		if net.ParseIP(f[0]) != nil {
+			for _, d := range f[1:] {
+				set.exact[normalizeHost(d)] = true
+			}
+			continue
+		}
+
+		if len(f) != 1 || strings.ContainsAny(f[0], "/|^$@") {
+			log.Printf("%s:%d: invalid entry", name, lineno)
+			bad++
+			continue
+		}
+
+		d := f[0]
+		switch {
+		case strings.HasPrefix(d, "*."):
+			set.suffix[normalizeHost(d[2:])] = true
+		case d[0] == '.':
+			set.suffix[normalizeHost(d[1:])] = true
+		default:
+			set.exact[normalizeHost(d)] = true
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+
+	if bad > 0 {
+		return nil, fmt.Errorf("%s: %d invalid lines", name, bad)
+	}
+
+	return rules, nil
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func (ds *domainSet) match(host string) bool {
+	if ds.exact[host] {
+		return true
+	}
+
+	for h := host; h != ""; {
+		if ds.suffix[h] {
+			return true
+		}
+		i := strings.IndexByte(h, '.')
+		if i < 0 {
+			break
+		}
+		h = h[i+1:]
+	}
+
+	for _, re := range ds.regex {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// blocked reports whether the host is blocked,
+// the nil filter blocks nothing
+func (f *domainFilter) blocked(host string) bool {
+	if f == nil {
+		return false
+	}
+
+	host = normalizeHost(strings.Trim(host, "[]"))
+
+	var rules []*domainRules
+	for _, df := range f.files {
+		rules = append(rules, df.rules.Load().(*domainRules))
+	}
+
+	for _, r := range rules {
+		if r.allow.match(host) {
+			return false
+		}
+	}
+
+	for _, r := range rules {
+		if r.block.match(host) {
+			return true
+		}
+	}
+
+	return f.blockDefault
+}
+
+// check replies the block page or resets the connection,
+// returns false when the request is blocked
+func (f *domainFilter) check(w http.ResponseWriter, r *http.Request, host string) bool {
+	if !f.blocked(host) {
+		return true
+	}
+
+	log.Printf("proxy filter: %s %s from %s blocked", r.Method, host, r.RemoteAddr)
+
+	if f.reset {
+		if r.ProtoMajor == 2 {
+			// RST_STREAM
+			panic(http.ErrAbortHandler)
+		}
+		if hj, ok := w.(http.Hijacker); ok {
+			if c, _, err := hj.Hijack(); err == nil {
+				resetConn(c)
+				return false
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	if f.page != nil {
+		w.Write(f.page)
+	} else {
+		fmt.Fprintf(w, defaultBlockPage, html.EscapeString(host))
+	}
+	return false
+}
+
+// resetConn closes c with the tcp RST
+func resetConn(c net.Conn) {
+	for {
+		switch c1 := c.(type) {
+		case *tls.Conn:
+			c = c1.NetConn()
+			continue
+		case *bufConn:
+			c = c1.Conn
+			continue
+		case *sniffConn:
+			c = c1.Conn
+			continue
+		case *proxyConn:
+			c = c1.Conn
+			continue
+		case *net.TCPConn:
+			c1.SetLinger(0)
+		}
+		break
+	}
+	c.Close()
+}
+
+// tunnel checks the server name of the tls ClientHello the client
+// sends first in the tunnel, the blocked tunnel is reset
+func (f *domainFilter) tunnel(c net.Conn, host, from string) net.Conn {
+	if f == nil {
+		return c
+	}
+	return &sniConn{c, f.sniReader(c, host, from, func() { resetConn(c) })}
+}
+
+// body is tunnel for the http/2 stream
+func (f *domainFilter) body(body io.ReadCloser, host, from string) io.ReadCloser {
+	if f == nil {
+		return body
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{f.sniReader(body, host, from, nil), body}
+}
+
+func (f *domainFilter) sniReader(r io.Reader, host, from string, reset func()) *sniReader {
+	return &sniReader{r: r, check: func(sni string) error {
+		if sni == "" || !f.blocked(sni) {
+			return nil
+		}
+		log.Printf("proxy filter: CONNECT %s sni %s from %s blocked", host, sni, from)
+		if reset != nil {
+			reset()
+		}
+		return errBlocked
+	}}
+}
+
+type sniConn struct {
+	net.Conn
+	r *sniReader
+}
+
+func (sc *sniConn) Read(b []byte) (int, error) {
+	return sc.r.Read(b)
+}
+
+// sniReader peeks the ClientHello on the first read,
+// the data peeked is returned later
+type sniReader struct {
+	r     io.Reader
+	check func(sni string) error
+
+	peeked bool
+	buf    []byte
+	err    error
+}
+
+func (sr *sniReader) Read(b []byte) (int, error) {
+	if !sr.peeked {
+		sr.peeked = true
+		var sni string
+		sni, sr.buf, sr.err = peekSNI(sr.r)
+		if err := sr.check(sni); err != nil {
+			sr.buf = nil
+			sr.err = err
+		}
+	}
+
+	if len(sr.buf) > 0 {
+		n := copy(b, sr.buf)
+		sr.buf = sr.buf[n:]
+		return n, nil
+	}
+
+	if sr.err != nil {
+		return 0, sr.err
+	}
+
+	return sr.r.Read(b)
+}
+
+var errPeekDone = errors.New("peek done")
+
+// peekSNI reads the tls ClientHello from r, returns the server name
+// and all the data read, the name is empty when it is not tls
+func peekSNI(r io.Reader) (string, []byte, error) {
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(r, first); err != nil {
+		return "", nil, err
+	}
+
+	// the tls handshake record
+	if first[0] != 0x16 {
+		return "", first, nil
+	}
+
+	buf := bytes.NewBuffer(first)
+	sni := ""
+
+	c := tls.Server(&peekConn{r: io.MultiReader(bytes.NewReader(first), io.TeeReader(r, buf))}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = hello.ServerName
+			return nil, errPeekDone
+		},
+	})
+
+	err := c.Handshake()
+	if errors.Is(err, errPeekDone) {
+		err = nil
+	}
+
+	var oe *net.OpError
+	if errors.As(err, &oe) && oe.Op == "peek" {
+		// the read error, like EOF
+		return sni, buf.Bytes(), oe.Err
+	}
+
+	// not the valid ClientHello, pass it to the server
+	return sni, buf.Bytes(), nil
+}
+
+// peekConn is the read only connection for the tls handshake,
+// the alert is not sent
+type peekConn struct {
+	r io.Reader
+}
+
+func (pc *peekConn) Read(b []byte) (int, error) {
+	n, err := pc.r.Read(b)
+	if err != nil {
+		err = &net.OpError{Op: "peek", Err: err}
+	}
+	return n, err
+}
+
+func (pc *peekConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (pc *peekConn) Close() error                       { return nil }
+func (pc *peekConn) LocalAddr() net.Addr                { return nil }
+func (pc *peekConn) RemoteAddr() net.Addr               { return nil }
+func (pc *peekConn) SetDeadline(t time.Time) error      { return nil }
+func (pc *peekConn) SetReadDeadline(t time.Time) error  { return nil }
+func (pc *peekConn) SetWriteDeadline(t time.Time) error { return nil }
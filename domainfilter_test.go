@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testBlockList = `# the formats
+[Adblock Plus 2.0]
+! adblock comment
+ads.example.com
+.tracker.com
+*.cdn.test
+/^ad[0-9]+\./
+0.0.0.0 evil.com www.evil.com # hosts
+||adnet.org^
+||adnet.org^$third-party
+||example.org/ads/*
+@@||good.tracker.com^
+`
+
+func TestDomainFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	block := filepath.Join(dir, "block.txt")
+	allow := filepath.Join(dir, "allow.txt")
+	ioutil.WriteFile(block, []byte(testBlockList), 0644)
+	ioutil.WriteFile(allow, []byte("safe.ads.example.com\n.mirror.evil.com\n"), 0644)
+
+	f, err := newDomainFilter(proxyFilterConf{Block: []string{block}, Allow: []string{allow}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		host    string
+		blocked bool
+	}{
+		{"ads.example.com", true},
+		{"ADS.Example.com.", true},
+		{"x.ads.example.com", false},
+		{"example.com", false},
+		{"tracker.com", true},
+		{"a.b.tracker.com", true},
+		{"good.tracker.com", false},
+		{"cdn.test", true},
+		{"img.cdn.test", true},
+		{"ad12.foo.net", true},
+		{"adx.foo.net", false},
+		{"evil.com", true},
+		{"www.evil.com", true},
+		{"mail.evil.com", false},
+		{"adnet.org", true},
+		{"x.adnet.org", true},
+		{"example.org", false},
+		{"safe.ads.example.com", false},
+		{"mirror.evil.com", false},
+	}
+
+	for _, tc := range testCases {
+		if b := f.blocked(tc.host); b != tc.blocked {
+			t.Errorf("%s: expected %v, got %v", tc.host, tc.blocked, b)
+		}
+	}
+
+	// the invalid file keeps the last copy
+	ioutil.WriteFile(block, []byte("news.test\n/[/\n"), 0644)
+	time.Sleep(5 * reloadDelay)
+	if !f.blocked("evil.com") {
+		t.Errorf("last good copy dropped")
+	}
+
+	ioutil.WriteFile(block, []byte("news.test\n"), 0644)
+	for i := 0; i < 50 && !f.blocked("news.test"); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !f.blocked("news.test") || f.blocked("evil.com") {
+		t.Errorf("list file not reloaded")
+	}
+
+	// the allow list only
+	f, err = newDomainFilter(proxyFilterConf{Allow: []string{allow}, Default: "block"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.blocked("mirror.evil.com") || !f.blocked("example.com") {
+		t.Errorf("unexpected allow list only result")
+	}
+
+	for _, c := range []proxyFilterConf{
+		{Block: []string{block}, Default: "x"},
+		{Block: []string{block}, Action: "x"},
+		{Block: []string{filepath.Join(dir, "none")}},
+	} {
+		if _, err := newDomainFilter(c); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+}
+
+func TestPeekSNI(t *testing.T) {
+	c1, c2 := net.Pipe()
+	go func() {
+		tls.Client(c1, &tls.Config{ServerName: "www.example.com"}).Handshake()
+		c1.Close()
+	}()
+
+	sni, b, err := peekSNI(c2)
+	c2.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sni != "www.example.com" || len(b) < 5 || b[0] != 0x16 {
+		t.Errorf("unexpected sni %q %d bytes", sni, len(b))
+	}
+
+	sni, b, err = peekSNI(strings.NewReader("GET / HTTP/1.1\r\n"))
+	if err != nil || sni != "" || string(b) != "G" {
+		t.Errorf("unexpected result %q %q %v", sni, b, err)
+	}
+
+	// the data peeked is read again
+	sr := &sniReader{r: strings.NewReader("\x16\x03\x01\x00\x01x"), check: func(string) error { return nil }}
+	if b, _ := io.ReadAll(sr); string(b) != "\x16\x03\x01\x00\x01x" {
+		t.Errorf("unexpected data %q", b)
+	}
+}
+
+func TestProxyFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	block := filepath.Join(dir, "block.txt")
+	ioutil.WriteFile(block, []byte("blocked.test\n"), 0644)
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello")
+	}))
+	defer ts.Close()
+
+	for _, action := range []string{"page", "reset"} {
+		f, err := newDomainFilter(proxyFilterConf{Block: []string{block}, Action: action})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ps := httptest.NewServer(&handler{enableProxy: true, filter: f})
+		u, _ := url.Parse(ps.URL)
+		c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+
+		resp, err := c.Get("http://blocked.test/")
+		if action == "page" {
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusForbidden || !strings.Contains(string(b), "blocked.test") {
+				t.Errorf("unexpected block page %d %q", resp.StatusCode, b)
+			}
+		} else if err == nil {
+			resp.Body.Close()
+			t.Errorf("expected the connection reset, got %d", resp.StatusCode)
+		}
+
+		// the CONNECT host is allowed, the sni is checked
+		for _, sni := range []string{"ok.test", "blocked.test"} {
+			conn, err := net.Dial("tcp", u.Host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", ts.Listener.Addr(), ts.Listener.Addr())
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil || resp.StatusCode != http.StatusOK {
+				t.Fatalf("CONNECT failed %v", err)
+			}
+
+			tc := tls.Client(&bufConn{conn, br}, &tls.Config{ServerName: sni, InsecureSkipVerify: true})
+			err = tc.Handshake()
+			if (err != nil) != (sni == "blocked.test") {
+				t.Errorf("%s: unexpected handshake result %v", sni, err)
+			}
+			conn.Close()
+		}
+
+		ps.Close()
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// the extended CONNECT of http/2, rfc 8441, see extendedProtocol
+// for the :protocol pseudo header
+//
+//	websocket    and the other protocols, the request is sent to
+//	             upstream as the http/1.1 upgrade
+//	connect-udp  the udp tunnel, rfc 9298, the datagrams are
+//	             carried by the capsules, rfc 9297
+//
+// go only accepts it when GODEBUG contains http2xconnect=1
+
+const masqueUDPPrefix = "/.well-known/masque/udp/"
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// extendedProtocol returns the :protocol of the extended CONNECT,
+// empty for the others, the http/2 server of net/http and x/net
+// keeps it in r.Header, the handlers never read it there directly
+func extendedProtocol(r *http.Request) string {
+	if r.ProtoMajor != 2 || r.Method != http.MethodConnect {
+		return ""
+	}
+	return r.Header.Get(":protocol")
+}
+
+func isConnectUDP(r *http.Request) bool {
+	return strings.EqualFold(extendedProtocol(r), "connect-udp")
+}
+
+// masqueTarget parses the target of connect-udp from the path of
+// the default template /.well-known/masque/udp/{host}/{port}/
+func masqueTarget(path string) (string, int, error) {
+	if !strings.HasPrefix(path, masqueUDPPrefix) {
+		return "", 0, fmt.Errorf("invalid connect-udp path %s", path)
+	}
+
+	s := strings.Split(strings.TrimSuffix(path[len(masqueUDPPrefix):], "/"), "/")
+	if len(s) != 2 {
+		return "", 0, fmt.Errorf("invalid connect-udp path %s", path)
+	}
+
+	host, err := url.PathUnescape(s[0])
+	if err != nil || host == "" {
+		return "", 0, fmt.Errorf("invalid connect-udp host %s", s[0])
+	}
+
+	port, err := strconv.Atoi(s[1])
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid connect-udp port %s", s[1])
+	}
+
+	return strings.Trim(host, "[]"), port, nil
+}
+
+func (h *handler) handleExtendedConnect(w http.ResponseWriter, r *http.Request) {
+	proto := extendedProtocol(r)
+	if strings.EqualFold(proto, "connect-udp") {
+		h.handleConnectUDP(w, r)
+		return
+	}
+
+	hp := h.headers
+	if hp == nil {
+		hp = defaultHeaderPolicy
+	}
+
+	// the :scheme, the tls state is only set for https
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	hdr := r.Header.Clone()
+	hdr.Del(":protocol")
+	removeHopHeaders(hdr)
+	hdr.Set("Connection", "Upgrade")
+	hdr.Set("Upgrade", proto)
+
+	// the key is not in the http/2 websocket handshake
+	key := ""
+	if strings.EqualFold(proto, "websocket") {
+		b := make([]byte, 16)
+		rand.Read(b)
+		key = base64.StdEncoding.EncodeToString(b)
+		hdr.Set("Sec-WebSocket-Key", key)
+	}
+
+	out := (&http.Request{
+		Method: http.MethodGet,
+		URL: &url.URL{
+			Scheme:   scheme,
+			Host:     r.Host,
+			Path:     r.URL.Path,
+			RawPath:  r.URL.RawPath,
+			RawQuery: r.URL.RawQuery,
+		},
+		Proto:      r.Proto,
+		ProtoMajor: r.ProtoMajor,
+		ProtoMinor: r.ProtoMinor,
+		Header:     hdr,
+		Host:       r.Host,
+		RemoteAddr: r.RemoteAddr,
+	}).WithContext(r.Context())
+
+	hp.request(out)
+
+	host, _ := proxyDestination(r)
+	resp, err := h.upstreams.pick(host).transport.RoundTrip(out)
+	if errors.Is(err, errDestinationDenied) {
+		h.denyDestination(w, r, err)
+		return
+	}
+	if err != nil {
+		log.Printf("RoundTrip: %s", err)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// the upstream refused, like 403, pass it to client
+		removeHopHeaders(resp.Header)
+		hp.response(resp)
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		copyBuffer(w, resp.Body)
+		return
+	}
+
+	backConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok || !strings.EqualFold(upgradeType(resp.Header), proto) ||
+		(key != "" && resp.Header.Get("Sec-WebSocket-Accept") != websocketAccept(key)) {
+		log.Printf("extended connect %s %s: invalid upgrade response", proto, out.URL)
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "<h1>502 Bad Gateway</h1>")
+		return
+	}
+
+	removeHopHeaders(resp.Header)
+	resp.Header.Del("Sec-WebSocket-Accept")
+	hp.response(resp)
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+
+	h.pipeStream(w, r, backConn)
+}
+
+func websocketAccept(key string) string {
+	s := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(s[:])
+}
+
+// handleConnectUDP relays the udp payload in the DATAGRAM
+// capsules, the acl is checked with the UDP method
+func (h *handler) handleConnectUDP(w http.ResponseWriter, r *http.Request) {
+	host, port, err := masqueTarget(r.URL.EscapedPath())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	if !h.guard.checkConnect("UDP", host, port, r.RemoteAddr) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "<h1>403 Forbidden</h1>")
+		return
+	}
+
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+
+	ctx, cancel := withTimeout(r.Context(), h.timeouts.dial())
+	conn, err := h.dialer().DialContext(ctx, "udp", addr)
+	cancel()
+	if errors.Is(err, errDestinationDenied) {
+		h.denyDestination(w, r, err)
+		return
+	}
+	if err != nil {
+		log.Printf("dial udp %s: %s", addr, err)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "dial to %s failed: %s", addr, err)
+		return
+	}
+	defer conn.Close()
+
+	it := newIdleTimer(h.timeouts.tunnelIdle(), func() { conn.Close() })
+	defer it.stop()
+
+	w.Header().Set("Capsule-Protocol", "?1")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	ch := make(chan int, 2)
+	go func() {
+		br := bufio.NewReader(it.reader(r.Body))
+		for {
+			payload, err := readDatagramCapsule(br)
+			if err != nil {
+				break
+			}
+			if payload != nil {
+				conn.Write(payload)
+			}
+		}
+		ch <- 1
+	}()
+
+	go func() {
+		b := make([]byte, 65535)
+		rd := it.reader(conn)
+		fw := flushWriter{w}
+		for {
+			n, err := rd.Read(b)
+			if err != nil {
+				break
+			}
+			if _, err := fw.Write(appendDatagramCapsule(nil, b[:n])); err != nil {
+				break
+			}
+		}
+		ch <- 1
+	}()
+
+	<-ch
+}
+
+// pipeStream copies the data between the http/2 stream and conn
+func (h *handler) pipeStream(w http.ResponseWriter, r *http.Request, conn io.ReadWriteCloser) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("recover %+v", err)
+		}
+	}()
+
+	defer conn.Close()
+
+	it := newIdleTimer(h.timeouts.tunnelIdle(), func() { conn.Close() })
+	defer it.stop()
+
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	ch := make(chan int, 2)
+	go func() {
+		it.copy(conn, r.Body)
+		ch <- 1
+	}()
+
+	go func() {
+		it.copy(flushWriter{w}, conn)
+		ch <- 1
+	}()
+
+	<-ch
+}
+
+// the capsule is Type(i) Length(i) Value, the DATAGRAM capsule
+// of connect-udp is Type 0 and Value Context ID(i) Payload,
+// the context 0 is the udp payload
+const (
+	capsuleDatagram = 0x00
+	maxCapsuleSize  = 65535 + 16
+)
+
+var errCapsuleTooLarge = errors.New("capsule too large")
+
+// readDatagramCapsule returns the udp payload,
+// nil for the other capsules
+func readDatagramCapsule(br *bufio.Reader) ([]byte, error) {
+	t, err := readVarint(br)
+	if err != nil {
+		return nil, err
+	}
+	n, err := readVarint(br)
+	if err != nil {
+		return nil, err
+	}
+
+	if n > maxCapsuleSize {
+		return nil, errCapsuleTooLarge
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(br, b); err != nil {
+		return nil, err
+	}
+
+	if t != capsuleDatagram {
+		return nil, nil
+	}
+
+	ctxID, l := parseVarint(b)
+	if l == 0 || ctxID != 0 {
+		return nil, nil
+	}
+	return b[l:], nil
+}
+
+func appendDatagramCapsule(b []byte, payload []byte) []byte {
+	b = appendVarint(b, capsuleDatagram)
+	b = appendVarint(b, uint64(len(payload)+1))
+	b = appendVarint(b, 0)
+	return append(b, payload...)
+}
+
+// the variable length integer of quic, rfc 9000 16
+func readVarint(br *bufio.Reader) (uint64, error) {
+	c, err := br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	v := uint64(c & 0x3f)
+	for i := 1; i < 1<<(c>>6); i++ {
+		c, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+// parseVarint returns the value and the length, 0 length on error
+func parseVarint(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	n := 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0
+	}
+	v := uint64(b[0] & 0x3f)
+	for i := 1; i < n; i++ {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, n
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case v < 1<<30:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32),
+			byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMasqueTarget(t *testing.T) {
+	testCases := []struct {
+		path string
+		host string
+		port int
+		err  bool
+	}{
+		{"/.well-known/masque/udp/192.0.2.6/443/", "192.0.2.6", 443, false},
+		{"/.well-known/masque/udp/example.com/53", "example.com", 53, false},
+		{"/.well-known/masque/udp/2001%3Adb8%3A%3A42/53/", "2001:db8::42", 53, false},
+		{"/.well-known/masque/udp/example.com/0/", "", 0, true},
+		{"/.well-known/masque/udp/example.com/", "", 0, true},
+		{"/.well-known/masque/udp//53/", "", 0, true},
+		{"/masque/udp/example.com/53/", "", 0, true},
+	}
+
+	for _, tc := range testCases {
+		host, port, err := masqueTarget(tc.path)
+		if (err != nil) != tc.err || host != tc.host || port != tc.port {
+			t.Errorf("%s: got %s %d %v", tc.path, host, port, err)
+		}
+	}
+}
+
+func TestDatagramCapsule(t *testing.T) {
+	for _, v := range []uint64{0, 63, 64, 16383, 16384, 1<<30 - 1, 1 << 30} {
+		b := appendVarint(nil, v)
+		if v2, n := parseVarint(b); v2 != v || n != len(b) {
+			t.Errorf("varint %d: got %d %d", v, v2, n)
+		}
+	}
+
+	var buf []byte
+	buf = appendDatagramCapsule(buf, []byte("hello"))
+	// the unknown capsule is skipped
+	buf = append(buf, 0x17, 2, 'x', 'y')
+	buf = appendDatagramCapsule(buf, bytes.Repeat([]byte("a"), 100))
+
+	br := bufio.NewReader(bytes.NewReader(buf))
+	for _, want := range []string{"hello", "", strings.Repeat("a", 100)} {
+		b, err := readDatagramCapsule(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("expected %q, got %q", want, b)
+		}
+	}
+	if _, err := readDatagramCapsule(br); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+// newH2Proxy starts the http/2 proxy for the test
+func newH2Proxy() *httptest.Server {
+	ps := httptest.NewUnstartedServer(&handler{
+		enableProxy:  true,
+		localDomains: []string{"local.invalid"},
+	})
+	ps.EnableHTTP2 = true
+	ps.StartTLS()
+	return ps
+}
+
+// h2ProxyClient returns the client sends all the requests
+// to the http/2 proxy
+func h2ProxyClient(t *testing.T) (*http2.Transport, func()) {
+	ps := newH2Proxy()
+
+	tr := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			d := &tls.Dialer{Config: &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}}}
+			return d.DialContext(ctx, "tcp", ps.Listener.Addr().String())
+		},
+	}
+	return tr, func() {
+		tr.CloseIdleConnections()
+		ps.Close()
+	}
+}
+
+// h2Stream is the extended CONNECT stream by the raw frames, the client
+// of x/net can not send :protocol on all the versions, the newer one
+// checks the headers by net/http and refuses it
+type h2Stream struct {
+	conn net.Conn
+	fr   *http2.Framer
+	mu   sync.Mutex
+
+	resp chan *http.Response
+	pr   *io.PipeReader
+	pw   *io.PipeWriter
+}
+
+// dialExtendedConnect sends the extended CONNECT to the proxy at addr
+func dialExtendedConnect(t *testing.T, addr, protocol, authority, path string, hdr http.Header) *h2Stream {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &h2Stream{conn: conn, fr: http2.NewFramer(conn, conn), resp: make(chan *http.Response, 1)}
+	s.fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	s.pr, s.pw = io.Pipe()
+
+	io.WriteString(conn, http2.ClientPreface)
+	s.fr.WriteSettings()
+
+	// the server announces SETTINGS_ENABLE_CONNECT_PROTOCOL first
+	f, err := s.fr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sf, ok := f.(*http2.SettingsFrame); !ok || sf.IsAck() {
+		t.Fatalf("unexpected frame %v", f)
+	} else if v, _ := sf.Value(http2.SettingEnableConnectProtocol); v != 1 {
+		t.Fatalf("extended CONNECT not enabled")
+	}
+	s.fr.WriteSettingsAck()
+
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	enc.WriteField(hpack.HeaderField{Name: ":method", Value: http.MethodConnect})
+	enc.WriteField(hpack.HeaderField{Name: ":protocol", Value: protocol})
+	enc.WriteField(hpack.HeaderField{Name: ":scheme", Value: "http"})
+	enc.WriteField(hpack.HeaderField{Name: ":authority", Value: authority})
+	enc.WriteField(hpack.HeaderField{Name: ":path", Value: path})
+	for k, v := range hdr {
+		for _, v1 := range v {
+			enc.WriteField(hpack.HeaderField{Name: strings.ToLower(k), Value: v1})
+		}
+	}
+	if err := s.fr.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: buf.Bytes(),
+		EndHeaders:    true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	go s.readFrames()
+	return s
+}
+
+// readFrames passes the response and the data of stream 1,
+// the connection level frames are answered
+func (s *h2Stream) readFrames() {
+	for {
+		f, err := s.fr.ReadFrame()
+		if err != nil {
+			s.pw.CloseWithError(err)
+			close(s.resp)
+			return
+		}
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				s.mu.Lock()
+				s.fr.WriteSettingsAck()
+				s.mu.Unlock()
+			}
+		case *http2.PingFrame:
+			if !f.IsAck() {
+				s.mu.Lock()
+				s.fr.WritePing(true, f.Data)
+				s.mu.Unlock()
+			}
+		case *http2.MetaHeadersFrame:
+			resp := &http.Response{Header: http.Header{}, Body: s.pr}
+			for _, hf := range f.RegularFields() {
+				resp.Header.Add(hf.Name, hf.Value)
+			}
+			resp.StatusCode, _ = strconv.Atoi(f.PseudoValue("status"))
+			s.resp <- resp
+			if f.StreamEnded() {
+				s.pw.Close()
+			}
+		case *http2.DataFrame:
+			b := f.Data()
+			if len(b) > 0 {
+				s.pw.Write(b)
+				s.mu.Lock()
+				s.fr.WriteWindowUpdate(0, uint32(len(b)))
+				s.fr.WriteWindowUpdate(1, uint32(len(b)))
+				s.mu.Unlock()
+			}
+			if f.StreamEnded() {
+				s.pw.Close()
+			}
+		case *http2.RSTStreamFrame:
+			s.pw.CloseWithError(fmt.Errorf("stream reset %v", f.ErrCode))
+		case *http2.GoAwayFrame:
+			s.pw.CloseWithError(fmt.Errorf("goaway %v", f.ErrCode))
+		}
+	}
+}
+
+// response waits the response headers
+func (s *h2Stream) response(t *testing.T) *http.Response {
+	select {
+	case resp, ok := <-s.resp:
+		if !ok {
+			t.Fatal("connection closed")
+		}
+		return resp
+	case <-time.After(5 * time.Second):
+		t.Fatal("response timeout")
+	}
+	return nil
+}
+
+func (s *h2Stream) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.fr.WriteData(1, false, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (s *h2Stream) Close() error {
+	return s.conn.Close()
+}
+
+func TestH2ProxyBody(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %d %v %s", r.Method, r.ContentLength, r.TransferEncoding, b)
+	}))
+	defer ts.Close()
+
+	tr, closeProxy := h2ProxyClient(t)
+	defer closeProxy()
+
+	testCases := []struct {
+		method string
+		body   io.Reader
+		want   string
+	}{
+		{http.MethodPatch, strings.NewReader("abc"), "PATCH 3 [] abc"},
+		{http.MethodDelete, strings.NewReader("abc"), "DELETE 3 [] abc"},
+		{http.MethodGet, nil, "GET 0 [] "},
+		{http.MethodOptions, io.MultiReader(strings.NewReader("a"), strings.NewReader("bc")), "OPTIONS -1 [chunked] abc"},
+	}
+
+	for _, tc := range testCases {
+		req, _ := http.NewRequest(tc.method, ts.URL+"/a", tc.body)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != tc.want {
+			t.Errorf("%s: expected %q, got %q", tc.method, tc.want, b)
+		}
+	}
+}
+
+// the go http/2 server reads GODEBUG at the start only,
+// the extended CONNECT is tested in a subprocess
+func TestExtendedConnect(t *testing.T) {
+	if os.Getenv("GSERVER_TEST_XCONNECT") != "1" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestExtendedConnect$", "-test.v")
+		cmd.Env = append(os.Environ(), "GSERVER_TEST_XCONNECT=1", "GODEBUG=http2xconnect=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%s\n%s", err, out)
+		}
+		return
+	}
+
+	t.Run("websocket", testExtendedConnectWebsocket)
+	t.Run("connect-udp", testExtendedConnectUDP)
+}
+
+func testExtendedConnectWebsocket(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Sec-WebSocket-Key")
+		if upgradeType(r.Header) != "websocket" || key == "" || r.URL.Path != "/ws" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		c, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+			websocketAccept(key))
+		brw.Flush()
+		io.Copy(c, brw)
+	}))
+	defer ts.Close()
+
+	ps := newH2Proxy()
+	defer ps.Close()
+
+	u, _ := url.Parse(ts.URL)
+	st := dialExtendedConnect(t, ps.Listener.Addr().String(), "websocket", u.Host, "/ws",
+		http.Header{"Sec-Websocket-Version": {"13"}})
+	defer st.Close()
+
+	resp := st.response(t)
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Sec-WebSocket-Accept") != "" {
+		t.Fatalf("unexpected response %d %v", resp.StatusCode, resp.Header)
+	}
+
+	fmt.Fprintf(st, "ping\n")
+	if line, _ := bufio.NewReader(resp.Body).ReadString('\n'); line != "ping\n" {
+		t.Errorf("unexpected data %q", line)
+	}
+}
+
+func testExtendedConnectUDP(t *testing.T) {
+	uc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, addr, err := uc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			uc.WriteTo(append([]byte("echo "), b[:n]...), addr)
+		}
+	}()
+
+	ps := newH2Proxy()
+	defer ps.Close()
+
+	_, port, _ := net.SplitHostPort(uc.LocalAddr().String())
+	st := dialExtendedConnect(t, ps.Listener.Addr().String(), "connect-udp", "proxy.example.com",
+		"/.well-known/masque/udp/127.0.0.1/"+port+"/", http.Header{"Capsule-Protocol": {"?1"}})
+	defer st.Close()
+
+	resp := st.response(t)
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Capsule-Protocol") != "?1" {
+		t.Fatalf("unexpected response %d %v", resp.StatusCode, resp.Header)
+	}
+
+	st.Write(appendDatagramCapsule(nil, []byte("hello")))
+
+	b, err := readDatagramCapsule(bufio.NewReader(resp.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "echo hello" {
+		t.Errorf("unexpected datagram %q", b)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// the fastcgi record types and the responder role
+const (
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+
+	fcgiResponder = 1
+
+	fcgiMaxContent = 65535
+)
+
+// fastCGI passes the request to the fastcgi responder like php-fpm,
+// one connection for each request
+//
+// the script is the file of the url path in docroot, the path after
+// ".php" is PATH_INFO, index.php is used for the directory. the
+// params are the same as uwsgi, REMOTE_USER is the authenticated user
+type fastCGI struct {
+	network string
+	addr    string
+	docroot string
+	dialer  *resolvingDialer
+}
+
+func newFastCGI(network, addr, docroot string, res *resolver) *fastCGI {
+	return &fastCGI{network: network, addr: addr, docroot: docroot,
+		dialer: &resolvingDialer{d: &net.Dialer{}, r: res}}
+}
+
+// ServeHTTP implements the http.Handler interface
+func (fc *fastCGI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body := r.Body
+	if r.ContentLength < 0 {
+		// the responder needs CONTENT_LENGTH
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "read body failed", http.StatusBadRequest)
+			return
+		}
+		r.ContentLength = int64(len(b))
+		body = io.NopCloser(bytes.NewReader(b))
+	}
+
+	conn, err := fc.dialer.DialContext(r.Context(), fc.network, fc.addr)
+	if err != nil {
+		log.Printf("fastcgi %s: %s", fc.addr, err)
+		http.Error(w, "502 Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	go func() {
+		if err := fc.writeRequest(conn, fc.params(r), body); err != nil {
+			conn.Close()
+		}
+	}()
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(readFastCGI(conn, pw))
+	}()
+	defer pr.Close()
+
+	br := bufio.NewReader(pr)
+	hdr, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil {
+		log.Printf("fastcgi %s: %s", fc.addr, err)
+		http.Error(w, "502 Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	code := http.StatusOK
+	if s := hdr.Get("Status"); s != "" {
+		if code, err = strconv.Atoi(strings.SplitN(s, " ", 2)[0]); err != nil || code < 100 {
+			log.Printf("fastcgi %s: invalid status %q", fc.addr, s)
+			http.Error(w, "502 Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		hdr.Del("Status")
+	} else if hdr.Get("Location") != "" {
+		code = http.StatusFound
+	}
+
+	for k, v := range hdr {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(code)
+	copyBuffer(w, br)
+}
+
+// script splits the url path to the script and PATH_INFO
+func (fc *fastCGI) script(p string) (string, string) {
+	if i := strings.Index(p, ".php/"); i >= 0 {
+		return p[:i+4], p[i+4:]
+	}
+	if strings.HasSuffix(p, "/") {
+		return p + "index.php", ""
+	}
+	return p, ""
+}
+
+func (fc *fastCGI) params(r *http.Request) map[string]string {
+	params := map[string]string{}
+	for k, v := range buildParams(r, "") {
+		params[k] = strings.Join(v, ", ")
+	}
+
+	p := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") && p != "/" {
+		p += "/"
+	}
+	name, pathInfo := fc.script(p)
+
+	params["GATEWAY_INTERFACE"] = "CGI/1.1"
+	params["SERVER_SOFTWARE"] = "gserver"
+	params["REDIRECT_STATUS"] = "200"
+	params["DOCUMENT_ROOT"] = fc.docroot
+	params["SCRIPT_NAME"] = name
+	params["SCRIPT_FILENAME"] = filepath.Join(fc.docroot, filepath.FromSlash(name))
+	params["PATH_INFO"] = pathInfo
+	params["CONTENT_LENGTH"] = strconv.FormatInt(r.ContentLength, 10)
+	return params
+}
+
+// writeRequest sends the request with id 1,
+// the connection is closed by the responder when done
+func (fc *fastCGI) writeRequest(conn net.Conn, params map[string]string, body io.Reader) error {
+	bw := bufio.NewWriter(conn)
+
+	if err := writeFastCGIRecord(bw, fcgiBeginRequest, []byte{0, fcgiResponder, 0, 0, 0, 0, 0, 0}); err != nil {
+		return err
+	}
+
+	var b []byte
+	for k, v := range params {
+		b = appendFastCGILen(b, len(k))
+		b = appendFastCGILen(b, len(v))
+		b = append(b, k...)
+		b = append(b, v...)
+	}
+	if err := writeFastCGIStream(bw, fcgiParams, b); err != nil {
+		return err
+	}
+	if err := writeFastCGIRecord(bw, fcgiParams, nil); err != nil {
+		return err
+	}
+
+	buf := make([]byte, fcgiMaxContent)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if err1 := writeFastCGIRecord(bw, fcgiStdin, buf[:n]); err1 != nil {
+				return err1
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := writeFastCGIRecord(bw, fcgiStdin, nil); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// readFastCGI copies the stdout of the responder to w
+// until the end of the request, stderr is logged
+func readFastCGI(conn net.Conn, w io.Writer) error {
+	br := bufio.NewReader(conn)
+	hdr := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(br, hdr); err != nil {
+			return err
+		}
+		n := int(binary.BigEndian.Uint16(hdr[4:6]))
+		content := make([]byte, n+int(hdr[6]))
+		if _, err := io.ReadFull(br, content); err != nil {
+			return err
+		}
+		content = content[:n]
+
+		switch hdr[1] {
+		case fcgiStdout:
+			if _, err := w.Write(content); err != nil {
+				return err
+			}
+		case fcgiStderr:
+			if len(content) > 0 {
+				log.Printf("fastcgi: %s", bytes.TrimSpace(content))
+			}
+		case fcgiEndRequest:
+			return io.EOF
+		}
+	}
+}
+
+func writeFastCGIStream(w io.Writer, typ byte, b []byte) error {
+	for len(b) > 0 {
+		n := len(b)
+		if n > fcgiMaxContent {
+			n = fcgiMaxContent
+		}
+		if err := writeFastCGIRecord(w, typ, b[:n]); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func writeFastCGIRecord(w io.Writer, typ byte, b []byte) error {
+	if len(b) > fcgiMaxContent {
+		return errors.New("fastcgi: record too large")
+	}
+	pad := -len(b) & 7
+	hdr := []byte{1, typ, 0, 1, 0, 0, byte(pad), 0}
+	binary.BigEndian.PutUint16(hdr[4:6], uint16(len(b)))
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	_, err := w.Write(make([]byte, pad))
+	return err
+}
+
+// appendFastCGILen appends the length of the name-value pair,
+// one byte when < 128, four bytes with the high bit set otherwise
+func appendFastCGILen(b []byte, n int) []byte {
+	if n < 128 {
+		return append(b, byte(n))
+	}
+	return append(b, byte(n>>24)|0x80, byte(n>>16), byte(n>>8), byte(n))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFastCGI(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go fcgi.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env := fcgi.ProcessEnv(r)
+		b, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Test", "1")
+		if r.URL.Query().Get("missing") != "" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		fmt.Fprintf(w, "%s|%s|%s|%s", env["REMOTE_USER"], env["SCRIPT_FILENAME"], r.Method, b)
+	}))
+
+	fc := newFastCGI("tcp", ln.Addr().String(), "/srv/www", nil)
+
+	testCases := []struct {
+		method string
+		path   string
+		user   string
+		body   io.Reader
+		code   int
+		want   string
+	}{
+		{http.MethodGet, "/a/b.php", "alice", nil, 200, "alice|/srv/www/a/b.php|GET|"},
+		{http.MethodGet, "/a/index.php/x/y?missing=1", "", nil, 404, "|/srv/www/a/index.php|GET|"},
+		{http.MethodGet, "/a/", "", nil, 200, "|/srv/www/a/index.php|GET|"},
+		{http.MethodPost, "/b.php", "bob", strings.NewReader("hello"), 200, "bob|/srv/www/b.php|POST|hello"},
+		// the unknown length is read first
+		{http.MethodPost, "/b.php", "", io.MultiReader(strings.NewReader("a"), strings.NewReader("bc")), 200, "|/srv/www/b.php|POST|abc"},
+	}
+
+	for _, tc := range testCases {
+		r := httptest.NewRequest(tc.method, tc.path, tc.body)
+		if tc.user != "" {
+			r = r.WithContext(context.WithValue(r.Context(), remoteUserKey, tc.user))
+		}
+		w := httptest.NewRecorder()
+		fc.ServeHTTP(w, r)
+		if w.Code != tc.code || w.Body.String() != tc.want || w.Header().Get("X-Test") != "1" {
+			t.Errorf("%s %s: unexpected response %d %q %v", tc.method, tc.path, w.Code, w.Body.String(), w.Header())
+		}
+	}
+
+	// the path after .php
+	p := fc.params(httptest.NewRequest(http.MethodGet, "/a/index.php/x/y", nil))
+	if p["SCRIPT_NAME"] != "/a/index.php" || p["PATH_INFO"] != "/x/y" {
+		t.Errorf("unexpected script %s %s", p["SCRIPT_NAME"], p["PATH_INFO"])
+	}
+
+	// the responder is down
+	ln.Close()
+	w := httptest.NewRecorder()
+	fc.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/a.php", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected 502, got %d", w.Code)
+	}
+}
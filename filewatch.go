@@ -0,0 +1,81 @@
+package main
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// the delay after the change event, wait for the writer to finish
+const reloadDelay = 200 * time.Millisecond
+
+// watchFile calls reload when the file changes, the directory is
+// watched so the file replaced by rename is seen, polls the mtime
+// when inotify is not available
+//
+// the watch is set up before return, call it before the first load,
+// so no change is missed. reload is not called when the file is
+// removed, the caller keeps the last copy
+func watchFile(path string, reload func()) {
+	w, err := fsnotify.NewWatcher()
+	if err == nil {
+		if err = w.Add(filepath.Dir(path)); err != nil {
+			w.Close()
+		}
+	}
+
+	if err != nil {
+		log.Printf("%s: watch failed, polling: %s", path, err)
+		var mtime time.Time
+		if fi, err := os.Stat(path); err == nil {
+			mtime = fi.ModTime()
+		}
+		go pollFile(path, mtime, reload)
+		return
+	}
+
+	go func() {
+		name := filepath.Clean(path)
+		var timer <-chan time.Time
+
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(ev.Name) == name {
+					timer = time.After(reloadDelay)
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("%s: watch: %s", path, err)
+			case <-timer:
+				timer = nil
+				if _, err := os.Stat(path); os.IsNotExist(err) {
+					log.Printf("%s: removed, keep the last copy", path)
+					continue
+				}
+				reload()
+			}
+		}
+	}()
+}
+
+func pollFile(path string, mtime time.Time, reload func()) {
+	for {
+		time.Sleep(10 * time.Second)
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if !fi.ModTime().Equal(mtime) {
+			mtime = fi.ModTime()
+			reload()
+		}
+	}
+}
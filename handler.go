@@ -1,12 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	auth "github.com/fangdingjun/go-http-auth"
+	"golang.org/x/net/http/httpguts"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -17,21 +19,24 @@ type handler struct {
 	handler      http.Handler
 	enableProxy  bool
 	enableAuth   bool
-	authMethod   *auth.DigestAuth
+	authMethod   authenticator
+	acl          *proxyACL
+	access       *accessList
+	upstreams    *upstreamRouter
+	headers      *headerPolicy
+	guard        *dialGuard
+	filter       *domainFilter
+	resolver     *resolver
+	timeouts     timeoutConf
 	localDomains []string
 }
 
-var defaultTransport http.RoundTripper = &http.Transport{
-	//DialContext:         dialContext,
-	MaxIdleConns:          50,
-	IdleConnTimeout:       30 * time.Second,
-	MaxIdleConnsPerHost:   3,
-	DisableKeepAlives:     true,
-	ResponseHeaderTimeout: 2 * time.Second,
-}
-
 // ServeHTTP implements the http.Handler interface
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.access != nil && !h.access.check(w, r) {
+		return
+	}
+
 	// http/1.1 local request
 	if r.ProtoMajor == 1 && r.RequestURI[0] == '/' {
 		if h.handler != nil {
@@ -42,8 +47,8 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// http/2.0 local request
-	if r.ProtoMajor == 2 && h.isLocalRequest(r) {
+	// http/2.0 local request, the extended CONNECT is always proxied
+	if r.ProtoMajor == 2 && r.Method != http.MethodConnect && h.isLocalRequest(r) {
 		if h.handler != nil {
 			h.handler.ServeHTTP(w, r)
 		} else {
@@ -60,14 +65,32 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	user := ""
 	if h.enableAuth {
-		u, _ := h.authMethod.CheckAuth(r)
-		if u == "" {
-			h.authMethod.RequireAuth(w, r)
+		user = h.authMethod.checkAuth(r)
+		if user == "" {
+			h.authMethod.requireAuth(w, r)
 			return
 		}
 	}
 
+	if h.acl != nil {
+		method := r.Method
+		if isConnectUDP(r) {
+			method = "UDP"
+		}
+		host, port := proxyDestination(r)
+		if !h.checkACL(user, method, host, port, r.RemoteAddr) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "<h1>403 Forbidden</h1>")
+			return
+		}
+	}
+
+	if host, _ := proxyDestination(r); !h.filter.check(w, r, host) {
+		return
+	}
+
 	if r.Method == http.MethodConnect {
 		// CONNECT request
 		h.handleCONNECT(w, r)
@@ -77,26 +100,70 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// checkACL reports whether the user can access host:port,
+// the denied request is logged
+func (h *handler) checkACL(user, method, host string, port int, from string) bool {
+	if h.acl == nil {
+		return true
+	}
+	ok, rule := h.acl.check(user, method, host, port, time.Now())
+	if !ok {
+		log.Printf("proxy acl: %s %s %s:%d from %s denied by rule %s",
+			user, method, host, port, from, rule)
+	}
+	return ok
+}
+
 func (h *handler) handleHTTP(w http.ResponseWriter, r *http.Request) {
 
 	var resp *http.Response
 	var err error
 
-	r.Header.Del("proxy-connection")
-	r.Header.Del("proxy-authorization")
+	hp := h.headers
+	if hp == nil {
+		hp = defaultHeaderPolicy
+	}
+
+	upType := upgradeType(r.Header)
+	trailers := httpguts.HeaderValuesContainsToken(r.Header["Te"], "trailers")
+
+	// the Connection: close of client closes the client connection
+	// only, the upstream one goes back to the pool
+	removeHopHeaders(r.Header)
+	r.Close = false
+
+	if upType != "" {
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", upType)
+	}
+	if trailers {
+		r.Header.Set("Te", "trailers")
+	}
+
+	hp.request(r)
 
 	if r.ProtoMajor == 2 {
+		// the h2 server sets TLS only for :scheme https
 		r.URL.Scheme = "http"
+		if r.TLS != nil {
+			r.URL.Scheme = "https"
+		}
 		r.URL.Host = r.Host
 		r.RequestURI = r.URL.String()
-		if r.Method != http.MethodPost && r.Method != http.MethodPut {
-			r.ContentLength = 0
+		// the body is streamed for all the methods,
+		// the empty one is not sent as chunked
+		if r.ContentLength == 0 {
 			r.Body.Close()
-			r.Body = nil
+			r.Body = http.NoBody
 		}
 	}
 
-	resp, err = defaultTransport.RoundTrip(r)
+	host, _ := proxyDestination(r)
+	resp, err = h.upstreams.pick(host).transport.RoundTrip(r)
+	if errors.Is(err, errDestinationDenied) {
+		h.denyDestination(w, r, err)
+		return
+	}
 	if err != nil {
 		log.Printf("RoundTrip: %s", err)
 		w.Header().Set("Content-Type", "text/plain")
@@ -107,9 +174,15 @@ func (h *handler) handleHTTP(w http.ResponseWriter, r *http.Request) {
 
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		h.handleUpgrade(w, r, resp, upType, hp)
+		return
+	}
+
 	hdr := w.Header()
 
-	resp.Header.Del("connection")
+	removeHopHeaders(resp.Header)
+	hp.response(resp)
 
 	for k, v := range resp.Header {
 		for _, v1 := range v {
@@ -117,8 +190,75 @@ func (h *handler) handleHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// announce the trailers, they are sent after the body
+	for k := range resp.Trailer {
+		hdr.Add("Trailer", k)
+	}
+
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	copyBuffer(w, resp.Body)
+
+	for k, v := range resp.Trailer {
+		hdr[k] = v
+	}
+}
+
+// handleUpgrade switches the client connection to the protocol
+// upstream accepted, like WebSocket, the data is copied then
+func (h *handler) handleUpgrade(w http.ResponseWriter, r *http.Request, resp *http.Response, upType string, hp *headerPolicy) {
+	resUpType := upgradeType(resp.Header)
+	if upType == "" || !strings.EqualFold(upType, resUpType) {
+		log.Printf("upgrade %s: upstream switched to %q, requested %q", r.URL, resUpType, upType)
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "<h1>502 Bad Gateway</h1>")
+		return
+	}
+
+	backConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "<h1>502 Bad Gateway</h1>")
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		backConn.Close()
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "<h1>502 Bad Gateway</h1>")
+		return
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		backConn.Close()
+		log.Printf("hijack: %s", err)
+		return
+	}
+
+	removeHopHeaders(resp.Header)
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Upgrade", resUpType)
+	hp.response(resp)
+
+	res := &http.Response{
+		StatusCode: resp.StatusCode,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     resp.Header,
+	}
+	if err := res.Write(brw); err != nil {
+		conn.Close()
+		backConn.Close()
+		return
+	}
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		backConn.Close()
+		return
+	}
+
+	pipeAndClose(backConn, &bufConn{conn, brw.Reader}, h.timeouts.tunnelIdle())
 }
 
 type flushWriter struct {
@@ -132,6 +272,11 @@ func (fw flushWriter) Write(buf []byte) (int, error) {
 }
 
 func (h *handler) handleCONNECT(w http.ResponseWriter, r *http.Request) {
+	if extendedProtocol(r) != "" {
+		h.handleExtendedConnect(w, r)
+		return
+	}
+
 	host := r.RequestURI
 
 	if r.ProtoMajor == 2 {
@@ -145,9 +290,25 @@ func (h *handler) handleCONNECT(w http.ResponseWriter, r *http.Request) {
 	var conn net.Conn
 	var err error
 
-	conn, err = net.Dial("tcp", host)
+	h1, p, _ := net.SplitHostPort(host)
+	port, _ := strconv.Atoi(p)
+	if !h.guard.checkConnect(http.MethodConnect, h1, port, r.RemoteAddr) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "<h1>403 Forbidden</h1>")
+		return
+	}
+
+	up := h.upstreams.pick(h1)
+
+	ctx, cancel := withTimeout(r.Context(), h.timeouts.dial())
+	conn, err = up.dial(ctx, host)
+	cancel()
+	if errors.Is(err, errDestinationDenied) {
+		h.denyDestination(w, r, err)
+		return
+	}
 	if err != nil {
-		log.Printf("net.dial: %s", err)
+		log.Printf("dial %s via %s: %s", host, up.name, err)
 		w.Header().Set("Content-Type", "text/plain")
 		w.WriteHeader(http.StatusServiceUnavailable)
 		fmt.Fprintf(w, "dial to %s failed: %s", host, err)
@@ -161,35 +322,25 @@ func (h *handler) handleCONNECT(w http.ResponseWriter, r *http.Request) {
 
 		fmt.Fprintf(conn1, "%s 200 connection established\r\n\r\n", r.Proto)
 
-		pipeAndClose(conn, conn1)
+		pipeAndClose(conn, h.filter.tunnel(conn1, h1, r.RemoteAddr), h.timeouts.tunnelIdle())
 		return
 	}
 
 	// HTTP/2.0
+	r.Body = h.filter.body(r.Body, h1, r.RemoteAddr)
+	h.pipeStream(w, r, conn)
+}
 
-	defer func() {
-		if err := recover(); err != nil {
-			log.Printf("recover %+v", err)
-		}
-	}()
-
-	defer conn.Close()
-
-	w.WriteHeader(http.StatusOK)
-	w.(http.Flusher).Flush()
-
-	ch := make(chan int, 2)
-	go func() {
-		io.Copy(conn, r.Body)
-		ch <- 1
-	}()
-
-	go func() {
-		io.Copy(flushWriter{w}, conn)
-		ch <- 1
-	}()
+// dialer dials the destination directly
+func (h *handler) dialer() *resolvingDialer {
+	return &resolvingDialer{d: h.timeouts.dialer(), r: h.resolver, g: h.guard}
+}
 
-	<-ch
+// denyDestination replies the request the guard refused
+func (h *handler) denyDestination(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("proxy guard: %s %s from %s denied: %s", r.Method, r.Host, r.RemoteAddr, err)
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(w, "<h1>403 Forbidden</h1>")
 }
 
 // isLocalRequest determine the http2 request is local path request
@@ -217,7 +368,9 @@ func (h *handler) isLocalRequest(r *http.Request) bool {
 	return false
 }
 
-func pipeAndClose(r1, r2 io.ReadWriteCloser) {
+// pipeAndClose copies the data between r1 and r2, both are closed
+// when either side finished or no data read in idle
+func pipeAndClose(r1, r2 io.ReadWriteCloser, idle time.Duration) {
 	defer func() {
 		if err := recover(); err != nil {
 			log.Printf("recover %+v", err)
@@ -227,14 +380,23 @@ func pipeAndClose(r1, r2 io.ReadWriteCloser) {
 	defer r1.Close()
 	defer r2.Close()
 
+	clearDeadline(r1)
+	clearDeadline(r2)
+
+	it := newIdleTimer(idle, func() {
+		r1.Close()
+		r2.Close()
+	})
+	defer it.stop()
+
 	ch := make(chan int, 2)
 	go func() {
-		io.Copy(r1, r2)
+		it.copy(r1, r2)
 		ch <- 1
 	}()
 
 	go func() {
-		io.Copy(r2, r1)
+		it.copy(r2, r1)
 		ch <- 1
 	}()
 
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+// proxyTarget returns the target server and the number of
+// the connections it accepted
+func proxyTarget() (*httptest.Server, *int32) {
+	var conns int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Connection") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "1")
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	}))
+	ts.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	ts.Start()
+	return ts, &conns
+}
+
+func proxyClient(t testing.TB, p poolConf) (*http.Client, func()) {
+	ur, err := newUpstreamRouter(nil, nil, timeoutConf{}, p, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := httptest.NewServer(&handler{enableProxy: true, upstreams: ur})
+	u, _ := url.Parse(ps.URL)
+
+	c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+	return c, ps.Close
+}
+
+func TestProxyPool(t *testing.T) {
+	ts, conns := proxyTarget()
+	defer ts.Close()
+
+	c, closeProxy := proxyClient(t, poolConf{})
+	defer closeProxy()
+
+	for i := 0; i < 5; i++ {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/a", nil)
+		// close the client connection, not the upstream one
+		req.Close = true
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || string(b) != "hello /a" {
+			t.Fatalf("unexpected response %d %q", resp.StatusCode, b)
+		}
+		if resp.Header.Get("X-Hop") != "" {
+			t.Errorf("hop header not removed")
+		}
+	}
+
+	if n := atomic.LoadInt32(conns); n != 1 {
+		t.Errorf("expected 1 upstream connection, got %d", n)
+	}
+}
+
+func benchmarkProxy(b *testing.B, p poolConf) {
+	ts, _ := proxyTarget()
+	defer ts.Close()
+
+	c, closeProxy := proxyClient(b, p)
+	defer closeProxy()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resp, err := c.Get(ts.URL + "/a")
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	})
+}
+
+func BenchmarkProxyPooled(b *testing.B) {
+	benchmarkProxy(b, poolConf{})
+}
+
+// the behavior before the pool
+func BenchmarkProxyNoKeepAlive(b *testing.B) {
+	benchmarkProxy(b, poolConf{DisableKeepAlives: true})
+}
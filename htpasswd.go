@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// verifyPassword checks the password against the hash in htpasswd file,
+// supported formats
+//
+//	$2y$...               bcrypt (htpasswd -B)
+//	$5$... $6$...         SHA-crypt (mkpasswd -m sha-512)
+//	$argon2id$... $argon2i$...  argon2 PHC string
+//	{SHA}...              SHA1, for compatibility only
+//
+// the MD5 based apr1 and the crypt(3) DES are not supported
+func verifyPassword(hashed, password string) bool {
+	switch {
+	case strings.HasPrefix(hashed, "$2a$"), strings.HasPrefix(hashed, "$2b$"),
+		strings.HasPrefix(hashed, "$2x$"), strings.HasPrefix(hashed, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password)) == nil
+	case strings.HasPrefix(hashed, "$5$"), strings.HasPrefix(hashed, "$6$"):
+		h, err := shaCrypt(password, hashed)
+		return err == nil && subtle.ConstantTimeCompare([]byte(h), []byte(hashed)) == 1
+	case strings.HasPrefix(hashed, "$argon2"):
+		ok, err := verifyArgon2(hashed, password)
+		return err == nil && ok
+	case strings.HasPrefix(hashed, "{SHA}"):
+		h := sha1.Sum([]byte(password))
+		s := "{SHA}" + base64.StdEncoding.EncodeToString(h[:])
+		return subtle.ConstantTimeCompare([]byte(s), []byte(hashed)) == 1
+	}
+	return false
+}
+
+// supportedHash reports whether the hash format can be verified
+func supportedHash(hashed string) bool {
+	for _, p := range []string{"$2a$", "$2b$", "$2x$", "$2y$", "$5$", "$6$", "$argon2i$", "$argon2id$", "{SHA}"} {
+		if strings.HasPrefix(hashed, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyArgon2 checks the PHC string like
+//
+//	$argon2id$v=19$m=65536,t=3,p=4$salt$hash
+func verifyArgon2(hashed, password string) (bool, error) {
+	f := strings.Split(hashed, "$")
+	if len(f) != 6 || f[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return false, fmt.Errorf("invalid argon2 hash")
+	}
+
+	var m, t uint32
+	var p uint8
+	if _, err := fmt.Sscanf(f[3], "m=%d,t=%d,p=%d", &m, &t, &p); err != nil {
+		return false, fmt.Errorf("invalid argon2 parameter: %s", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(f[4])
+	if err != nil {
+		return false, err
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(f[5])
+	if err != nil {
+		return false, err
+	}
+
+	var k []byte
+	switch f[1] {
+	case "argon2id":
+		k = argon2.IDKey([]byte(password), salt, t, m, p, uint32(len(key)))
+	case "argon2i":
+		k = argon2.Key([]byte(password), salt, t, m, p, uint32(len(key)))
+	default:
+		return false, fmt.Errorf("unsupported hash %s", f[1])
+	}
+
+	return subtle.ConstantTimeCompare(k, key) == 1, nil
+}
+
+const cryptB64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// the byte order of the SHA-crypt output encoding
+var (
+	sha256CryptOrder = [][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+	}
+	sha512CryptOrder = [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	}
+)
+
+// shaCrypt computes the SHA-crypt hash of password with the
+// salt and rounds from setting, as described by
+// https://www.akkadia.org/drepper/SHA-crypt.txt
+func shaCrypt(password, setting string) (string, error) {
+	var newHash func() hash.Hash
+	var magic string
+	switch {
+	case strings.HasPrefix(setting, "$5$"):
+		newHash, magic = sha256.New, "$5$"
+	case strings.HasPrefix(setting, "$6$"):
+		newHash, magic = sha512.New, "$6$"
+	default:
+		return "", fmt.Errorf("invalid sha-crypt setting")
+	}
+
+	s := setting[3:]
+	rounds := 5000
+	customRounds := false
+	if strings.HasPrefix(s, "rounds=") {
+		i := strings.Index(s, "$")
+		if i < 0 {
+			return "", fmt.Errorf("invalid sha-crypt rounds")
+		}
+		n, err := strconv.Atoi(s[7:i])
+		if err != nil {
+			return "", fmt.Errorf("invalid sha-crypt rounds")
+		}
+		if n < 1000 {
+			n = 1000
+		}
+		if n > 999999999 {
+			n = 999999999
+		}
+		rounds, customRounds, s = n, true, s[i+1:]
+	}
+
+	if i := strings.Index(s, "$"); i >= 0 {
+		s = s[:i]
+	}
+	if len(s) > 16 {
+		s = s[:16]
+	}
+
+	pw, salt := []byte(password), []byte(s)
+
+	h := newHash()
+	h.Write(pw)
+	h.Write(salt)
+	h.Write(pw)
+	b := h.Sum(nil)
+
+	h.Reset()
+	h.Write(pw)
+	h.Write(salt)
+	h.Write(repeatBytes(b, len(pw)))
+	for n := len(pw); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(pw)
+		}
+	}
+	a := h.Sum(nil)
+
+	h.Reset()
+	for i := 0; i < len(pw); i++ {
+		h.Write(pw)
+	}
+	p := repeatBytes(h.Sum(nil), len(pw))
+
+	h.Reset()
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write(salt)
+	}
+	ss := repeatBytes(h.Sum(nil), len(salt))
+
+	c := a
+	for i := 0; i < rounds; i++ {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(ss)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(nil)
+	}
+
+	var out bytes.Buffer
+	out.WriteString(magic)
+	if customRounds {
+		fmt.Fprintf(&out, "rounds=%d$", rounds)
+	}
+	out.Write(salt)
+	out.WriteByte('$')
+
+	b64 := func(b2, b1, b0 byte, n int) {
+		w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+		for ; n > 0; n-- {
+			out.WriteByte(cryptB64[w&0x3f])
+			w >>= 6
+		}
+	}
+
+	if magic == "$5$" {
+		for _, o := range sha256CryptOrder {
+			b64(c[o[0]], c[o[1]], c[o[2]], 4)
+		}
+		b64(0, c[31], c[30], 3)
+	} else {
+		for _, o := range sha512CryptOrder {
+			b64(c[o[0]], c[o[1]], c[o[2]], 4)
+		}
+		b64(0, 0, c[63], 2)
+	}
+
+	return out.String(), nil
+}
+
+// repeatBytes returns n bytes by repeating b
+func repeatBytes(b []byte, n int) []byte {
+	ret := make([]byte, 0, n)
+	for len(ret) < n {
+		if n-len(ret) < len(b) {
+			ret = append(ret, b[:n-len(ret)]...)
+		} else {
+			ret = append(ret, b...)
+		}
+	}
+	return ret
+}
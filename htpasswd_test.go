@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	bc, _ := bcrypt.GenerateFromPassword([]byte("Hello world!"), bcrypt.MinCost)
+
+	salt := []byte("somesaltsomesalt")
+	key := argon2.IDKey([]byte("Hello world!"), salt, 1, 64*1024, 2, 32)
+	a2 := fmt.Sprintf("$argon2id$v=19$m=65536,t=1,p=2$%s$%s",
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))
+
+	// the SHA-crypt hashes are created by openssl passwd -5 / -6
+	hashes := []string{
+		"$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5",
+		"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+		"$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.",
+		"{SHA}00hq6RNueFa8QiEjhep5cJRHWAI=",
+		string(bc),
+		a2,
+	}
+
+	for _, h := range hashes {
+		if !verifyPassword(h, "Hello world!") {
+			t.Errorf("%s: valid password rejected", h)
+		}
+		if verifyPassword(h, "hello world!") {
+			t.Errorf("%s: invalid password accepted", h)
+		}
+	}
+
+	if verifyPassword("$apr1$abc$def", "Hello world!") {
+		t.Errorf("unsupported hash accepted")
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	fp, err := ioutil.TempFile("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fp.Name())
+
+	fmt.Fprintf(fp, "user1:$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5\n")
+	fmt.Fprintf(fp, "test:example.com:3441b753b98a6dc702183c989e35970f\n")
+	fp.Close()
+
+	pw, err := newDigestSecret(fp.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !pw.checkPassword("user1", "example.com", "Hello world!") {
+		t.Errorf("htpasswd user rejected")
+	}
+	if !pw.checkPassword("test", "example.com", "test") {
+		t.Errorf("digest user rejected")
+	}
+	if pw.checkPassword("test", "other.com", "test") {
+		t.Errorf("digest user of other realm accepted")
+	}
+	if pw.getPw("user1", "example.com") != "" {
+		t.Errorf("htpasswd entry used for digest")
+	}
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwtAuthenticator validates the Authorization: Bearer token,
+// the configured claims are passed to the backend as
+// headers or uwsgi params
+type jwtAuthenticator struct {
+	conf      jwtConf
+	realm     string
+	algs      []jose.SignatureAlgorithm
+	publicKey interface{}
+	jwks      *jwksCache
+}
+
+// errInsufficientScope means the token is valid but the
+// required claims do not match
+var errInsufficientScope = errors.New("required claims not match")
+
+var supportedAlgs = map[string]jose.SignatureAlgorithm{
+	"HS256": jose.HS256,
+	"RS256": jose.RS256,
+	"ES256": jose.ES256,
+	"EdDSA": jose.EdDSA,
+}
+
+func newJWTAuthenticator(realm string, c jwtConf, res *resolver) (*jwtAuthenticator, error) {
+	ja := &jwtAuthenticator{conf: c, realm: realm}
+
+	n := 0
+	for _, s := range []string{c.Secret, c.PublicKey, c.JWKS} {
+		if s != "" {
+			n++
+		}
+	}
+	if n != 1 {
+		return nil, fmt.Errorf("jwt: exactly one of secret, publickey, jwks required")
+	}
+
+	if ja.conf.UserClaim == "" {
+		ja.conf.UserClaim = "sub"
+	}
+
+	var defaultAlgs []string
+
+	switch {
+	case c.Secret != "":
+		if len(c.Secret) < 32 {
+			return nil, fmt.Errorf("jwt: secret must be at least 32 bytes")
+		}
+		defaultAlgs = []string{"HS256"}
+	case c.PublicKey != "":
+		key, err := loadPublicKey(c.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		ja.publicKey = key
+		switch key.(type) {
+		case *rsa.PublicKey:
+			defaultAlgs = []string{"RS256"}
+		case *ecdsa.PublicKey:
+			defaultAlgs = []string{"ES256"}
+		case ed25519.PublicKey:
+			defaultAlgs = []string{"EdDSA"}
+		default:
+			return nil, fmt.Errorf("jwt: unsupported key type %T", key)
+		}
+	default:
+		refresh := c.JWKSRefresh
+		if refresh == 0 {
+			refresh = time.Hour
+		}
+		ja.jwks = &jwksCache{src: c.JWKS, refresh: refresh, mu: new(sync.Mutex),
+			client: &http.Client{Transport: resolvingTransport(res), Timeout: 10 * time.Second}}
+		if err := ja.jwks.load(); err != nil {
+			// the url may be available later
+			log.Printf("jwt: %s", err)
+		}
+		defaultAlgs = []string{"RS256", "ES256", "EdDSA"}
+	}
+
+	algs := c.Algorithms
+	if len(algs) == 0 {
+		algs = defaultAlgs
+	}
+
+	for _, a := range algs {
+		alg, ok := supportedAlgs[a]
+		if !ok {
+			return nil, fmt.Errorf("jwt: unsupported algorithm %s, only HS256, RS256, ES256, EdDSA allowed", a)
+		}
+		if (alg == jose.HS256) != (c.Secret != "") {
+			return nil, fmt.Errorf("jwt: algorithm %s not usable with the key", a)
+		}
+		ja.algs = append(ja.algs, alg)
+	}
+
+	return ja, nil
+}
+
+func (ja *jwtAuthenticator) checkAuth(r *http.Request) string {
+	for _, h := range ja.conf.Headers {
+		r.Header.Del(h)
+	}
+
+	claims, err := ja.verify(r)
+	if err != nil {
+		return ""
+	}
+
+	user := claimString(claims[ja.conf.UserClaim])
+	if user == "" {
+		return ""
+	}
+
+	for c, h := range ja.conf.Headers {
+		if v, ok := claims[c]; ok {
+			r.Header.Set(h, claimString(v))
+		}
+	}
+
+	if params := authParams(r); params != nil {
+		for c, p := range ja.conf.Params {
+			if v, ok := claims[c]; ok {
+				params[p] = claimString(v)
+			}
+		}
+	}
+
+	return user
+}
+
+// requireAuth sends the Bearer challenge, with the reason
+// when the token is present, see RFC 6750 section 3
+func (ja *jwtAuthenticator) requireAuth(w http.ResponseWriter, r *http.Request) {
+	challenge := fmt.Sprintf("Bearer realm=%q", ja.realm)
+	code := http.StatusUnauthorized
+
+	if bearerToken(r) != "" {
+		_, err := ja.verify(r)
+		switch err {
+		case nil:
+			// the user claim missing
+			challenge += `, error="invalid_token", error_description="no user"`
+		case errInsufficientScope:
+			challenge += `, error="insufficient_scope"`
+			code = http.StatusForbidden
+		default:
+			challenge += fmt.Sprintf(`, error="invalid_token", error_description=%q`, err.Error())
+		}
+	}
+
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "<h1>%d %s</h1>", code, http.StatusText(code))
+}
+
+// verify checks the signature and the claims of the token
+func (ja *jwtAuthenticator) verify(r *http.Request) (map[string]interface{}, error) {
+	s := bearerToken(r)
+	if s == "" {
+		return nil, fmt.Errorf("no token")
+	}
+
+	tok, err := jwt.ParseSigned(s, ja.algs)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	key, err := ja.key(tok.Headers[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var std jwt.Claims
+	var claims map[string]interface{}
+	if err := tok.Claims(key, &std, &claims); err != nil {
+		return nil, fmt.Errorf("invalid signature")
+	}
+
+	if std.Expiry == nil {
+		return nil, fmt.Errorf("no expiry")
+	}
+
+	leeway := ja.conf.Leeway
+	if leeway == 0 {
+		leeway = jwt.DefaultLeeway
+	}
+
+	if err := std.ValidateWithLeeway(jwt.Expected{
+		Issuer:      ja.conf.Issuer,
+		AnyAudience: jwt.Audience(ja.conf.Audience),
+		Time:        time.Now(),
+	}, leeway); err != nil {
+		return nil, err
+	}
+
+	for c, v := range ja.conf.RequiredClaims {
+		if !claimMatch(claims[c], v) {
+			return nil, errInsufficientScope
+		}
+	}
+
+	return claims, nil
+}
+
+// key returns the verification key for the token
+func (ja *jwtAuthenticator) key(h jose.Header) (interface{}, error) {
+	switch {
+	case ja.conf.Secret != "":
+		return []byte(ja.conf.Secret), nil
+	case ja.publicKey != nil:
+		return ja.publicKey, nil
+	}
+
+	k := ja.jwks.key(h.KeyID)
+	if k == nil {
+		return nil, fmt.Errorf("unknown key %q", h.KeyID)
+	}
+	return k, nil
+}
+
+func bearerToken(r *http.Request) string {
+	s := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(s) != 2 || !strings.EqualFold(s[0], "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(s[1])
+}
+
+// claimMatch reports whether the claim has the value,
+// the array claim matches when any element has the value
+func claimMatch(c interface{}, v string) bool {
+	if c == nil {
+		return false
+	}
+	if v == "" {
+		return true
+	}
+
+	switch c1 := c.(type) {
+	case []interface{}:
+		for _, e := range c1 {
+			if claimString(e) == v {
+				return true
+			}
+		}
+		return false
+	case string:
+		// the space separated scope claim
+		for _, e := range strings.Fields(c1) {
+			if e == v {
+				return true
+			}
+		}
+	}
+	return claimString(c) == v
+}
+
+// claimString formats the claim as header value,
+// the array is joined by comma
+func claimString(c interface{}) string {
+	switch c1 := c.(type) {
+	case nil:
+		return ""
+	case string:
+		return c1
+	case float64:
+		return strconv.FormatFloat(c1, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(c1)
+	case []interface{}:
+		s := make([]string, 0, len(c1))
+		for _, e := range c1 {
+			s = append(s, claimString(e))
+		}
+		return strings.Join(s, ",")
+	}
+	b, _ := json.Marshal(c)
+	return string(b)
+}
+
+func loadPublicKey(fn string) (interface{}, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	b, _ := pem.Decode(data)
+	if b == nil {
+		return nil, fmt.Errorf("jwt: %s: no PEM data", fn)
+	}
+
+	if b.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(b.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("jwt: %s: %s", fn, err)
+		}
+		return cert.PublicKey, nil
+	}
+
+	key, err := x509.ParsePKIXPublicKey(b.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("jwt: %s: %s", fn, err)
+	}
+	return key, nil
+}
+
+// jwksCache keeps the key set from file or url,
+// reloads it every refresh interval, or when a unknown
+// key id seen, at most once a minute
+//
+// the keys are fetched without the lock, one fetch at a time,
+// the cached keys are used until it is done
+type jwksCache struct {
+	src     string
+	refresh time.Duration
+	client  *http.Client
+
+	mu      *sync.Mutex
+	keys    *jose.JSONWebKeySet
+	loaded  time.Time
+	checked time.Time
+	call    *jwksCall
+}
+
+// jwksCall is the fetch in progress, the requests without
+// a cached key wait for it
+type jwksCall struct {
+	done chan struct{}
+}
+
+const jwksMinInterval = time.Minute
+
+func (jc *jwksCache) key(kid string) interface{} {
+	jc.mu.Lock()
+
+	now := time.Now()
+	k := findJWK(jc.keys, kid)
+	if jc.keys != nil && now.Sub(jc.loaded) <= jc.refresh &&
+		(k != nil || now.Sub(jc.checked) <= jwksMinInterval) {
+		jc.mu.Unlock()
+		return k
+	}
+
+	call := jc.call
+	if call == nil {
+		jc.checked = now
+		call = &jwksCall{done: make(chan struct{})}
+		jc.call = call
+		go jc.reload(call)
+	}
+	jc.mu.Unlock()
+
+	if k != nil {
+		return k
+	}
+
+	<-call.done
+
+	jc.mu.Lock()
+	defer jc.mu.Unlock()
+	return findJWK(jc.keys, kid)
+}
+
+func (jc *jwksCache) reload(call *jwksCall) {
+	keys, err := jc.fetch()
+
+	jc.mu.Lock()
+	if err != nil {
+		// keep the old keys
+		log.Printf("jwt: %s", err)
+	} else {
+		jc.keys, jc.loaded = keys, time.Now()
+	}
+	jc.call = nil
+	jc.mu.Unlock()
+
+	close(call.done)
+}
+
+func (jc *jwksCache) load() error {
+	jc.mu.Lock()
+	defer jc.mu.Unlock()
+
+	keys, err := jc.fetch()
+	if err != nil {
+		return err
+	}
+	jc.keys, jc.loaded, jc.checked = keys, time.Now(), time.Now()
+	return nil
+}
+
+func (jc *jwksCache) fetch() (*jose.JSONWebKeySet, error) {
+	var data []byte
+	var err error
+
+	if strings.HasPrefix(jc.src, "http://") || strings.HasPrefix(jc.src, "https://") {
+		var resp *http.Response
+		resp, err = jc.client.Get(jc.src)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("get %s: %s", jc.src, resp.Status)
+		}
+		data, err = ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	} else {
+		data, err = ioutil.ReadFile(jc.src)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys := new(jose.JSONWebKeySet)
+	if err := json.Unmarshal(data, keys); err != nil {
+		return nil, fmt.Errorf("%s: %s", jc.src, err)
+	}
+	return keys, nil
+}
+
+// findJWK returns the public key of kid, the only key
+// is used when the token has no key id
+func findJWK(keys *jose.JSONWebKeySet, kid string) interface{} {
+	if keys == nil {
+		return nil
+	}
+
+	if kid == "" {
+		if len(keys.Keys) == 1 {
+			return keys.Keys[0].Public().Key
+		}
+		return nil
+	}
+
+	for _, k := range keys.Key(kid) {
+		if k.Use == "" || k.Use == "sig" {
+			return k.Public().Key
+		}
+	}
+	return nil
+}
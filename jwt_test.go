@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func signJWT(t *testing.T, alg jose.SignatureAlgorithm, key interface{}, kid string, claims map[string]interface{}) string {
+	opts := new(jose.SignerOptions).WithType("JWT")
+	if kid != "" {
+		opts = opts.WithHeader("kid", kid)
+	}
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := jwt.Signed(sig).Claims(claims).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestJWTAuth(t *testing.T) {
+	secret := "0123456789abcdef0123456789abcdef"
+
+	ah, err := newAuthHandler(authConf{Type: "jwt", Realm: "api", JWT: jwtConf{
+		Secret:         secret,
+		Issuer:         "https://issuer.example.com",
+		Audience:       []string{"api"},
+		RequiredClaims: map[string]string{"scope": "read"},
+		Headers:        map[string]string{"email": "X-Auth-Email"},
+		Params:         map[string]string{"roles": "AUTH_ROLES"},
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var params map[string][]string
+	h := ah.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params = buildParams(r, "")
+		w.Write([]byte(remoteUser(r) + " " + r.Header.Get("X-Auth-Email")))
+	}))
+
+	claims := func(mod func(c map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":   "https://issuer.example.com",
+			"aud":   "api",
+			"sub":   "alice",
+			"email": "alice@example.com",
+			"roles": []string{"dev", "ops"},
+			"scope": "read write",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+		}
+		if mod != nil {
+			mod(c)
+		}
+		return c
+	}
+
+	testCases := []struct {
+		name      string
+		token     string
+		code      int
+		challenge string
+	}{
+		{"valid", signJWT(t, jose.HS256, []byte(secret), "", claims(nil)), 200, ""},
+		{"no token", "", 401, `Bearer realm="api"`},
+		{"bad signature", signJWT(t, jose.HS256, []byte(strings.Repeat("x", 32)), "", claims(nil)), 401, `error="invalid_token"`},
+		{"expired", signJWT(t, jose.HS256, []byte(secret), "", claims(func(c map[string]interface{}) {
+			c["exp"] = time.Now().Add(-time.Hour).Unix()
+		})), 401, `error="invalid_token"`},
+		{"no exp", signJWT(t, jose.HS256, []byte(secret), "", claims(func(c map[string]interface{}) {
+			delete(c, "exp")
+		})), 401, `error="invalid_token"`},
+		{"wrong audience", signJWT(t, jose.HS256, []byte(secret), "", claims(func(c map[string]interface{}) {
+			c["aud"] = "other"
+		})), 401, `error="invalid_token"`},
+		{"wrong issuer", signJWT(t, jose.HS256, []byte(secret), "", claims(func(c map[string]interface{}) {
+			c["iss"] = "https://evil.example.com"
+		})), 401, `error="invalid_token"`},
+		{"missing scope", signJWT(t, jose.HS256, []byte(secret), "", claims(func(c map[string]interface{}) {
+			c["scope"] = "write"
+		})), 403, `error="insufficient_scope"`},
+	}
+
+	for _, tc := range testCases {
+		r := httptest.NewRequest(http.MethodGet, "/api", nil)
+		r.Header.Set("X-Auth-Email", "spoofed@example.com")
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != tc.code {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.code, w.Code)
+			continue
+		}
+
+		if tc.code == 200 {
+			if w.Body.String() != "alice alice@example.com" {
+				t.Errorf("%s: unexpected body %q", tc.name, w.Body.String())
+			}
+			if v := params["AUTH_ROLES"]; len(v) != 1 || v[0] != "dev,ops" {
+				t.Errorf("%s: unexpected uwsgi param %v", tc.name, v)
+			}
+			continue
+		}
+
+		if c := w.Header().Get("WWW-Authenticate"); !strings.HasPrefix(c, "Bearer ") ||
+			!strings.Contains(c, tc.challenge) {
+			t.Errorf("%s: unexpected challenge %q", tc.name, c)
+		}
+	}
+}
+
+func TestJWTAuthJWKS(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	keys := []jose.JSONWebKey{{Key: ecKey.Public(), KeyID: "ec1", Algorithm: "ES256", Use: "sig"}}
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: keys})
+	}))
+	defer srv.Close()
+
+	a, err := newAuthenticator(authConf{Type: "jwt", JWT: jwtConf{JWKS: srv.URL}}, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := map[string]interface{}{"sub": "bob", "exp": time.Now().Add(time.Hour).Unix()}
+
+	check := func(tok string) string {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+tok)
+		return a.checkAuth(r)
+	}
+
+	if u := check(signJWT(t, jose.ES256, ecKey, "ec1", claims)); u != "bob" {
+		t.Errorf("ES256: expected bob, got %q", u)
+	}
+
+	// key rotated, the unknown kid triggers reload
+	keys = append(keys, jose.JSONWebKey{Key: edKey.Public(), KeyID: "ed1", Algorithm: "EdDSA", Use: "sig"})
+	a.(*jwtAuthenticator).jwks.checked = time.Time{}
+	if u := check(signJWT(t, jose.EdDSA, edKey, "ed1", claims)); u != "bob" {
+		t.Errorf("EdDSA: expected bob, got %q", u)
+	}
+
+	// unknown kid within the interval uses the cached keys
+	if u := check(signJWT(t, jose.EdDSA, edKey, "ed2", claims)); u != "" {
+		t.Errorf("unknown kid accepted")
+	}
+
+	if fetches != 2 {
+		t.Errorf("expected 2 fetches, got %d", fetches)
+	}
+
+	// HS256 with the public key is never accepted
+	if u := check(signJWT(t, jose.HS256, []byte(strings.Repeat("k", 32)), "ec1", claims)); u != "" {
+		t.Errorf("HS256 accepted with jwks")
+	}
+}
+
+// the slow fetch does not block the requests with the cached keys
+func TestJWKSCacheRefresh(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	set := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: ecKey.Public(), KeyID: "ec1", Algorithm: "ES256", Use: "sig"}}}
+
+	var fetches int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&fetches, 1) > 1 {
+			<-release
+		}
+		json.NewEncoder(w).Encode(set)
+	}))
+	defer srv.Close()
+
+	jc := &jwksCache{src: srv.URL, refresh: time.Hour, client: &http.Client{Timeout: 5 * time.Second}, mu: new(sync.Mutex)}
+	if err := jc.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	jc.mu.Lock()
+	jc.loaded = time.Now().Add(-2 * time.Hour)
+	jc.mu.Unlock()
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if jc.key("ec1") == nil {
+			t.Fatalf("cached key not served")
+		}
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("blocked by the fetch for %s", d)
+	}
+
+	// the unknown key waits for the same fetch
+	done := make(chan interface{})
+	go func() {
+		done <- jc.key("ec2")
+	}()
+	select {
+	case <-done:
+		t.Errorf("the unknown key returned before the fetch")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if k := <-done; k != nil {
+		t.Errorf("unexpected key for ec2")
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("expected 2 fetches, got %d", n)
+	}
+}
+
+func TestJWTAuthConfig(t *testing.T) {
+	for _, c := range []jwtConf{
+		{},
+		{Secret: "short"},
+		{Secret: strings.Repeat("s", 32), JWKS: "/tmp/jwks.json"},
+		{Secret: strings.Repeat("s", 32), Algorithms: []string{"RS256"}},
+		{Secret: strings.Repeat("s", 32), Algorithms: []string{"none"}},
+	} {
+		if _, err := newJWTAuthenticator("", c, nil); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+
+	if _, err := newAuthenticator(authConf{Type: "jwt", JWT: jwtConf{Secret: strings.Repeat("s", 32)}}, true, nil); err == nil {
+		t.Errorf("jwt for proxy: expected error")
+	}
+}
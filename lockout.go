@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lockout tracks the authentication failures per client address
+// and per user name, the client or the user is locked after
+// maxFailures failures in window, the lock time doubles on each
+// lock until maxLockTime
+//
+// the events are logged for fail2ban like
+//
+//	auth: failure from 1.2.3.4 user test
+//	auth: lockout 1.2.3.4 user test for 1m0s
+type lockout struct {
+	maxFailures int
+	window      time.Duration
+	lockTime    time.Duration
+	maxLockTime time.Duration
+
+	mu *sync.Mutex
+	m  map[string]*failureEntry
+}
+
+type failureEntry struct {
+	failures    int
+	first       time.Time
+	locks       int
+	lockedUntil time.Time
+}
+
+const maxLockoutEntries = 100000
+
+func newLockout(c lockoutConf) *lockout {
+	lo := &lockout{
+		maxFailures: c.MaxFailures,
+		window:      c.Window,
+		lockTime:    c.LockTime,
+		maxLockTime: c.MaxLockTime,
+		mu:          new(sync.Mutex),
+		m:           map[string]*failureEntry{},
+	}
+
+	if lo.window == 0 {
+		lo.window = 10 * time.Minute
+	}
+	if lo.lockTime == 0 {
+		lo.lockTime = time.Minute
+	}
+	if lo.maxLockTime == 0 {
+		lo.maxLockTime = time.Hour
+	}
+	return lo
+}
+
+func lockoutKeys(ip, user string) []string {
+	keys := []string{"ip:" + ip}
+	if user != "" {
+		keys = append(keys, "user:"+user)
+	}
+	return keys
+}
+
+// locked returns how long the client or the user is still locked
+func (lo *lockout) locked(ip, user string, now time.Time) time.Duration {
+	lo.mu.Lock()
+	defer lo.mu.Unlock()
+
+	var d time.Duration
+	for _, k := range lockoutKeys(ip, user) {
+		if e, ok := lo.m[k]; ok && e.lockedUntil.After(now) {
+			if d1 := e.lockedUntil.Sub(now); d1 > d {
+				d = d1
+			}
+		}
+	}
+	return d
+}
+
+func (lo *lockout) failure(ip, user string, now time.Time) {
+	log.Printf("auth: failure from %s user %s", ip, user)
+
+	lo.mu.Lock()
+	defer lo.mu.Unlock()
+
+	if len(lo.m) >= maxLockoutEntries {
+		lo.expire(now)
+	}
+
+	for _, k := range lockoutKeys(ip, user) {
+		e, ok := lo.m[k]
+		if !ok {
+			e = &failureEntry{}
+			lo.m[k] = e
+		}
+
+		if now.Sub(e.first) > lo.window {
+			e.failures = 0
+			e.first = now
+		}
+		e.failures++
+
+		if e.failures < lo.maxFailures {
+			continue
+		}
+
+		// exponential backoff
+		d := lo.lockTime << uint(e.locks)
+		if d > lo.maxLockTime || d <= 0 {
+			d = lo.maxLockTime
+		}
+		e.locks++
+		e.failures = 0
+		e.first = now
+		e.lockedUntil = now.Add(d)
+		log.Printf("auth: lockout %s user %s for %s", ip, user, d)
+	}
+}
+
+func (lo *lockout) success(ip, user string) {
+	lo.mu.Lock()
+	defer lo.mu.Unlock()
+
+	for _, k := range lockoutKeys(ip, user) {
+		delete(lo.m, k)
+	}
+}
+
+// expire removes the entries neither locked nor in window,
+// the caller holds the lock
+func (lo *lockout) expire(now time.Time) {
+	for k, e := range lo.m {
+		if now.After(e.lockedUntil) && now.Sub(e.first) > lo.window &&
+			now.Sub(e.lockedUntil) > lo.maxLockTime {
+			delete(lo.m, k)
+		}
+	}
+	if len(lo.m) >= maxLockoutEntries {
+		// under attack from too many addresses,
+		// keep the locked ones
+		for k, e := range lo.m {
+			if now.After(e.lockedUntil) {
+				delete(lo.m, k)
+			}
+		}
+	}
+}
+
+// lockoutAuth wraps the password based authenticator
+// with the failure tracking
+type lockoutAuth struct {
+	authenticator
+	lockout *lockout
+	proxy   bool
+}
+
+func (la lockoutAuth) credentials(r *http.Request) (string, bool) {
+	hdr := "Authorization"
+	if la.proxy {
+		hdr = "Proxy-Authorization"
+	}
+	v := r.Header.Get(hdr)
+	if v == "" {
+		return "", false
+	}
+	return credentialUser(v), true
+}
+
+func (la lockoutAuth) checkAuth(r *http.Request) string {
+	user, ok := la.credentials(r)
+	if !ok {
+		return ""
+	}
+
+	ip := remoteIP(r).String()
+	now := time.Now()
+
+	if la.lockout.locked(ip, user, now) > 0 {
+		return ""
+	}
+
+	u := la.authenticator.checkAuth(r)
+	if u == "" {
+		la.lockout.failure(ip, user, now)
+		return ""
+	}
+
+	la.lockout.success(ip, u)
+	return u
+}
+
+func (la lockoutAuth) requireAuth(w http.ResponseWriter, r *http.Request) {
+	user, _ := la.credentials(r)
+	if d := la.lockout.locked(remoteIP(r).String(), user, time.Now()); d > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(d/time.Second)+1))
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintf(w, "<h1>429 Too Many Requests</h1>")
+		return
+	}
+	la.authenticator.requireAuth(w, r)
+}
+
+// credentialUser returns the user name in the Basic or Digest
+// credentials, empty string when not found
+func credentialUser(v string) string {
+	s := strings.SplitN(v, " ", 2)
+	if len(s) != 2 {
+		return ""
+	}
+
+	switch strings.ToLower(s[0]) {
+	case "basic":
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s[1]))
+		if err != nil {
+			return ""
+		}
+		return strings.SplitN(string(b), ":", 2)[0]
+	case "digest":
+		for _, p := range splitAuthParams(s[1]) {
+			kv := strings.SplitN(p, "=", 2)
+			if len(kv) == 2 && strings.TrimSpace(kv[0]) == "username" {
+				return strings.Trim(strings.TrimSpace(kv[1]), `"`)
+			}
+		}
+	}
+	return ""
+}
+
+// splitAuthParams splits the comma separated params,
+// the comma in quoted string is kept
+func splitAuthParams(s string) []string {
+	var params []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				params = append(params, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(params, s[start:])
+}
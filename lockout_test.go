@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLockout(t *testing.T) {
+	lo := newLockout(lockoutConf{MaxFailures: 3, Window: time.Minute,
+		LockTime: 10 * time.Second, MaxLockTime: 30 * time.Second})
+
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		lo.failure("1.2.3.4", "test", now)
+	}
+	if lo.locked("1.2.3.4", "test", now) != 0 {
+		t.Errorf("locked before max failures")
+	}
+
+	lo.failure("1.2.3.4", "test", now)
+	if d := lo.locked("1.2.3.4", "test", now); d != 10*time.Second {
+		t.Errorf("expected locked 10s, got %s", d)
+	}
+
+	// the user is locked from other address too
+	if lo.locked("5.6.7.8", "test", now) == 0 {
+		t.Errorf("user not locked")
+	}
+	if lo.locked("5.6.7.8", "other", now) != 0 {
+		t.Errorf("other client locked")
+	}
+
+	// lock time doubles, until the max
+	now = now.Add(11 * time.Second)
+	for _, expected := range []time.Duration{20 * time.Second, 30 * time.Second, 30 * time.Second} {
+		for i := 0; i < 3; i++ {
+			lo.failure("1.2.3.4", "test", now)
+		}
+		if d := lo.locked("1.2.3.4", "test", now); d != expected {
+			t.Errorf("expected locked %s, got %s", expected, d)
+		}
+		now = now.Add(expected + time.Second)
+	}
+
+	// the failures out of window are not counted
+	lo.failure("9.9.9.9", "", now)
+	lo.failure("9.9.9.9", "", now.Add(2*time.Minute))
+	lo.failure("9.9.9.9", "", now.Add(2*time.Minute))
+	if lo.locked("9.9.9.9", "", now.Add(2*time.Minute)) != 0 {
+		t.Errorf("failures out of window counted")
+	}
+
+	lo.success("1.2.3.4", "test")
+	if lo.locked("1.2.3.4", "test", now) != 0 {
+		t.Errorf("still locked after success")
+	}
+}
+
+type fixedChecker map[string]string
+
+func (fc fixedChecker) checkPassword(user, realm, password string) bool {
+	p, ok := fc[user]
+	return ok && p == password
+}
+
+func TestLockoutAuth(t *testing.T) {
+	a := withLockout(authConf{Lockout: lockoutConf{MaxFailures: 2}},
+		basicAuthenticator{"test", fixedChecker{"test": "secret"}, true}, true)
+
+	// the empty acl denies all, never go to network
+	h := &handler{enableProxy: true, enableAuth: true, authMethod: a, acl: &proxyACL{}}
+
+	do := func(password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+		r.RemoteAddr = "1.2.3.4:1000"
+		r.SetBasicAuth("test", password)
+		r.Header.Set("Proxy-Authorization", r.Header.Get("Authorization"))
+		r.Header.Del("Authorization")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do("bad"); w.Code != http.StatusProxyAuthRequired {
+		t.Errorf("expected 407, got %d", w.Code)
+	}
+
+	// the failure reaches the max
+	if w := do("bad"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429, got %d", w.Code)
+	}
+
+	// locked, the valid password is not checked
+	w := do("secret")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 429 with Retry-After, got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestCredentialUser(t *testing.T) {
+	testCases := []struct {
+		header, user string
+	}{
+		{"Basic dGVzdDpzZWNyZXQ=", "test"},
+		{`Digest username="te,st", realm="example.com", nonce="abc", uri="/", response="xyz"`, "te,st"},
+		{`Digest realm="example.com", username="test"`, "test"},
+		{"Bearer abc", ""},
+		{"Basic !!!", ""},
+	}
+
+	for _, tc := range testCases {
+		if u := credentialUser(tc.header); u != tc.user {
+			t.Errorf("%s: expected %q, got %q", tc.header, tc.user, u)
+		}
+	}
+}
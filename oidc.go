@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcAuthenticator login the user by OpenID Connect
+//
+// the request without valid session is redirected to the issuer,
+// the issuer redirects back to the redirecturl with the code,
+// the code is exchanged for the ID token, and the identity in the
+// token is kept in a encrypted cookie.
+//
+// the identity is passed to the backend by the headers
+//
+//	X-Remote-User  the user claim, email by default
+//	X-Auth-Email   the email claim
+//	X-Auth-Name    the name claim
+//	X-Auth-Groups  the groups, separated by comma
+type oidcAuthenticator struct {
+	conf         oidcConf
+	aead         cipher.AEAD
+	callbackPath string
+	// the redirecturl is https, the server may be behind a tls proxy
+	secure bool
+	// the client of the issuer, dials by the resolver
+	client *http.Client
+
+	mu       *sync.Mutex
+	verifier *oidc.IDTokenVerifier
+	oauth2   *oauth2.Config
+}
+
+// oidcSession is the content of session cookie,
+// bound to the issuer and client it is issued for
+type oidcSession struct {
+	Issuer   string
+	ClientID string
+	User     string
+	Email    string
+	Name     string
+	Groups   []string
+	// email_verified is false in the claims
+	Unverified bool
+	Expires    int64
+}
+
+// oidcState is kept in cookie during the login
+type oidcState struct {
+	State   string
+	Nonce   string
+	URL     string
+	Expires int64
+}
+
+var identityHeaders = []string{"X-Auth-Email", "X-Auth-Name", "X-Auth-Groups"}
+
+func newOIDCAuthenticator(c oidcConf, res *resolver) (*oidcAuthenticator, error) {
+	if c.Issuer == "" || c.ClientID == "" || c.RedirectURL == "" {
+		return nil, fmt.Errorf("oidc: issuer, clientid and redirecturl required")
+	}
+
+	if c.CookieSecret == "" {
+		return nil, fmt.Errorf("oidc: cookiesecret required")
+	}
+
+	u, err := url.Parse(c.RedirectURL)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: invalid redirecturl: %s", err)
+	}
+
+	if c.CookieName == "" {
+		c.CookieName = "gserver_session"
+	}
+
+	if c.SessionTime == 0 {
+		c.SessionTime = 8 * time.Hour
+	}
+
+	if c.UserClaim == "" {
+		c.UserClaim = "email"
+	}
+
+	if c.GroupsClaim == "" {
+		c.GroupsClaim = "groups"
+	}
+
+	if len(c.Scopes) == 0 {
+		c.Scopes = []string{oidc.ScopeOpenID, "email", "profile"}
+	}
+
+	key := sha256.Sum256([]byte(c.CookieSecret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &oidcAuthenticator{
+		conf:         c,
+		aead:         aead,
+		callbackPath: u.Path,
+		secure:       u.Scheme == "https",
+		client:       &http.Client{Transport: resolvingTransport(res)},
+		mu:           new(sync.Mutex),
+	}, nil
+}
+
+// init discovers the issuer on first use,
+// so the server can start when the issuer is down
+func (oa *oidcAuthenticator) init(ctx context.Context) error {
+	oa.mu.Lock()
+	defer oa.mu.Unlock()
+
+	if oa.verifier != nil {
+		return nil
+	}
+
+	// the provider keeps the client for the keys
+	provider, err := oidc.NewProvider(oidc.ClientContext(ctx, oa.client), oa.conf.Issuer)
+	if err != nil {
+		return err
+	}
+
+	oa.verifier = provider.Verifier(&oidc.Config{ClientID: oa.conf.ClientID})
+	oa.oauth2 = &oauth2.Config{
+		ClientID:     oa.conf.ClientID,
+		ClientSecret: oa.conf.ClientSecret,
+		RedirectURL:  oa.conf.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       oa.conf.Scopes,
+	}
+	return nil
+}
+
+func (oa *oidcAuthenticator) checkAuth(r *http.Request) string {
+	for _, h := range identityHeaders {
+		r.Header.Del(h)
+	}
+
+	c, err := r.Cookie(oa.conf.CookieName)
+	if err != nil {
+		return ""
+	}
+
+	var s oidcSession
+	if err := oa.open(c.Value, &s); err != nil || time.Now().Unix() > s.Expires {
+		return ""
+	}
+
+	// the cookie may be issued by the other rule with the same secret
+	if s.Issuer != oa.conf.Issuer || s.ClientID != oa.conf.ClientID {
+		return ""
+	}
+	if err := oa.allow(s); err != nil {
+		return ""
+	}
+
+	if s.Email != "" {
+		r.Header.Set("X-Auth-Email", s.Email)
+	}
+	if s.Name != "" {
+		r.Header.Set("X-Auth-Name", s.Name)
+	}
+	if len(s.Groups) > 0 {
+		r.Header.Set("X-Auth-Groups", strings.Join(s.Groups, ","))
+	}
+
+	return s.User
+}
+
+// requireAuth redirects the browser to the issuer
+func (oa *oidcAuthenticator) requireAuth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "<h1>401 Unauthorized</h1>")
+		return
+	}
+
+	if err := oa.init(r.Context()); err != nil {
+		log.Printf("oidc: %s", err)
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "<h1>502 Bad Gateway</h1>")
+		return
+	}
+
+	st := oidcState{
+		State:   randomString(),
+		Nonce:   randomString(),
+		URL:     r.URL.RequestURI(),
+		Expires: time.Now().Add(10 * time.Minute).Unix(),
+	}
+
+	v, err := oa.seal(st)
+	if err != nil {
+		log.Printf("oidc: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	oa.setCookie(w, r, oa.conf.CookieName+"_state", v, 10*time.Minute)
+	http.Redirect(w, r, oa.oauth2.AuthCodeURL(st.State, oidc.Nonce(st.Nonce)), http.StatusFound)
+}
+
+// handleCallback completes the login when r is the redirect from issuer,
+// returns false when r is not the callback request
+func (oa *oidcAuthenticator) handleCallback(w http.ResponseWriter, r *http.Request) bool {
+	if r.URL.Path != oa.callbackPath {
+		return false
+	}
+
+	if err := oa.callback(w, r); err != nil {
+		log.Printf("oidc callback: %s", err)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "<h1>403 Forbidden</h1>")
+	}
+	return true
+}
+
+func (oa *oidcAuthenticator) callback(w http.ResponseWriter, r *http.Request) error {
+	if err := oa.init(r.Context()); err != nil {
+		return err
+	}
+
+	if e := r.FormValue("error"); e != "" {
+		return fmt.Errorf("%s: %s", e, r.FormValue("error_description"))
+	}
+
+	c, err := r.Cookie(oa.conf.CookieName + "_state")
+	if err != nil {
+		return fmt.Errorf("state cookie missing")
+	}
+
+	var st oidcState
+	if err := oa.open(c.Value, &st); err != nil {
+		return err
+	}
+
+	if time.Now().Unix() > st.Expires || r.FormValue("state") != st.State {
+		return fmt.Errorf("state mismatch")
+	}
+
+	tok, err := oa.oauth2.Exchange(oidc.ClientContext(r.Context(), oa.client), r.FormValue("code"))
+	if err != nil {
+		return err
+	}
+
+	rawIDToken, ok := tok.Extra("id_token").(string)
+	if !ok {
+		return fmt.Errorf("no id_token in token response")
+	}
+
+	idToken, err := oa.verifier.Verify(r.Context(), rawIDToken)
+	if err != nil {
+		return err
+	}
+
+	if idToken.Nonce != st.Nonce {
+		return fmt.Errorf("nonce mismatch")
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return err
+	}
+
+	s, err := oa.session(claims)
+	if err != nil {
+		return err
+	}
+
+	v, err := oa.seal(s)
+	if err != nil {
+		return err
+	}
+
+	oa.setCookie(w, r, oa.conf.CookieName+"_state", "", -1)
+	oa.setCookie(w, r, oa.conf.CookieName, v, oa.conf.SessionTime)
+
+	target := st.URL
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") {
+		target = "/"
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+	return nil
+}
+
+// session gets the identity from the claims and checks it
+func (oa *oidcAuthenticator) session(claims map[string]interface{}) (oidcSession, error) {
+	str := func(k string) string {
+		s, _ := claims[k].(string)
+		return s
+	}
+
+	s := oidcSession{
+		Issuer:   oa.conf.Issuer,
+		ClientID: oa.conf.ClientID,
+		User:     str(oa.conf.UserClaim),
+		Email:    str("email"),
+		Name:     str("name"),
+		Expires:  time.Now().Add(oa.conf.SessionTime).Unix(),
+	}
+
+	if verified, ok := claims["email_verified"].(bool); ok && !verified {
+		s.Unverified = true
+	}
+
+	if s.User == "" {
+		s.User = str("sub")
+	}
+
+	switch g := claims[oa.conf.GroupsClaim].(type) {
+	case []interface{}:
+		for _, v := range g {
+			if v1, ok := v.(string); ok {
+				s.Groups = append(s.Groups, v1)
+			}
+		}
+	case string:
+		s.Groups = []string{g}
+	}
+
+	return s, oa.allow(s)
+}
+
+// allow checks the session against the allowed domains and groups,
+// on login and on every request
+func (oa *oidcAuthenticator) allow(s oidcSession) error {
+	if len(oa.conf.AllowedDomains) > 0 {
+		if s.Unverified {
+			return fmt.Errorf("email %s not verified", s.Email)
+		}
+		i := strings.LastIndex(s.Email, "@")
+		if i < 0 || !containsFold(oa.conf.AllowedDomains, s.Email[i+1:]) {
+			return fmt.Errorf("email %s not allowed", s.Email)
+		}
+	}
+
+	if len(oa.conf.AllowedGroups) > 0 {
+		allowed := false
+		for _, g := range s.Groups {
+			if containsFold(oa.conf.AllowedGroups, g) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("user %s not in allowed groups", s.User)
+		}
+	}
+
+	return nil
+}
+
+func (oa *oidcAuthenticator) setCookie(w http.ResponseWriter, r *http.Request, name, value string, age time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(age / time.Second),
+		HttpOnly: true,
+		Secure:   oa.secure || r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// seal encrypts v to the cookie value
+func (oa *oidcAuthenticator) seal(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, oa.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(oa.aead.Seal(nonce, nonce, data, nil)), nil
+}
+
+// open decrypts the cookie value to v
+func (oa *oidcAuthenticator) open(s string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+
+	n := oa.aead.NonceSize()
+	if len(data) < n {
+		return fmt.Errorf("invalid cookie")
+	}
+
+	plain, err := oa.aead.Open(nil, data[:n], data[n:], nil)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(plain, v)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// mockIssuer is a minimal OpenID Connect provider
+type mockIssuer struct {
+	*httptest.Server
+	key   *rsa.PrivateKey
+	nonce string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &mockIssuer{key: key}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                m.URL,
+			"authorization_endpoint":                m.URL + "/auth",
+			"token_endpoint":                        m.URL + "/token",
+			"jwks_uri":                              m.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA", "kid": "k1", "alg": "RS256", "use": "sig",
+				"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good-code" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "at",
+			"token_type":   "Bearer",
+			"id_token": m.sign(map[string]interface{}{
+				"iss":    m.URL,
+				"aud":    "client1",
+				"sub":    "1001",
+				"email":  "alice@example.com",
+				"groups": []string{"dev", "ops"},
+				"nonce":  m.nonce,
+				"iat":    time.Now().Unix(),
+				"exp":    time.Now().Add(time.Hour).Unix(),
+			}),
+		})
+	})
+
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *mockIssuer) sign(claims map[string]interface{}) string {
+	enc := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	s := enc(map[string]string{"alg": "RS256", "kid": "k1", "typ": "JWT"}) + "." + enc(claims)
+	h := sha256.Sum256([]byte(s))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, h[:])
+	return s + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := newMockIssuer(t)
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Header.Get("X-Remote-User"), r.Header.Get("X-Auth-Groups"))
+	})
+
+	login := func(domains []string) *httptest.ResponseRecorder {
+		ah, err := newAuthHandler(authConf{Type: "oidc", OIDC: oidcConf{
+			Issuer:         issuer.URL,
+			ClientID:       "client1",
+			ClientSecret:   "secret1",
+			RedirectURL:    "http://app.example.com/oauth2/callback",
+			CookieSecret:   "cookie-secret",
+			AllowedDomains: domains,
+		}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := ah.middleware(ok)
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dash?a=1", nil))
+		if w.Code != http.StatusFound {
+			t.Fatalf("expected redirect to issuer, got %d", w.Code)
+		}
+
+		loc, _ := url.Parse(w.Header().Get("Location"))
+		issuer.nonce = loc.Query().Get("nonce")
+
+		r := httptest.NewRequest(http.MethodGet, "/oauth2/callback?code=good-code&state="+
+			url.QueryEscape(loc.Query().Get("state")), nil)
+		for _, c := range w.Result().Cookies() {
+			r.AddCookie(c)
+		}
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusFound {
+			return w
+		}
+		if l := w.Header().Get("Location"); l != "/dash?a=1" {
+			t.Errorf("expected redirect to original url, got %s", l)
+		}
+
+		r = httptest.NewRequest(http.MethodGet, "/dash", nil)
+		r.Header.Set("X-Auth-Groups", "spoofed")
+		for _, c := range w.Result().Cookies() {
+			if c.Value != "" {
+				r.AddCookie(c)
+			}
+		}
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := login([]string{"example.com"})
+	if w.Code != http.StatusOK || w.Body.String() != "alice@example.com dev,ops" {
+		t.Errorf("expected logged in, got %d %q", w.Code, w.Body.String())
+	}
+
+	w = login([]string{"other.com"})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("disallowed domain, expected 403, got %d", w.Code)
+	}
+}
+
+func TestOIDCSession(t *testing.T) {
+	conf := oidcConf{
+		Issuer:       "https://issuer.example.com",
+		ClientID:     "client1",
+		RedirectURL:  "https://app.example.com/oauth2/callback",
+		CookieSecret: "cookie-secret",
+	}
+	oa, err := newOIDCAuthenticator(conf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := oa.session(map[string]interface{}{"email": "alice@example.com", "groups": []interface{}{"dev"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, _ := oa.seal(s)
+
+	// the cookie is secure behind the tls proxy
+	w := httptest.NewRecorder()
+	oa.setCookie(w, httptest.NewRequest(http.MethodGet, "/", nil), oa.conf.CookieName, v, time.Hour)
+	if c := w.Result().Cookies(); len(c) != 1 || !c[0].Secure {
+		t.Errorf("expected secure cookie")
+	}
+
+	check := func(c oidcConf) string {
+		oa1, err := newOIDCAuthenticator(c, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(&http.Cookie{Name: oa1.conf.CookieName, Value: v})
+		return oa1.checkAuth(r)
+	}
+
+	if u := check(conf); u != "alice@example.com" {
+		t.Errorf("expected alice@example.com, got %q", u)
+	}
+
+	// the other rules with the same cookie secret
+	c := conf
+	c.AllowedDomains = []string{"other.com"}
+	if u := check(c); u != "" {
+		t.Errorf("disallowed domain, got %q", u)
+	}
+
+	c = conf
+	c.AllowedGroups = []string{"ops"}
+	if u := check(c); u != "" {
+		t.Errorf("disallowed group, got %q", u)
+	}
+
+	c = conf
+	c.ClientID = "client2"
+	if u := check(c); u != "" {
+		t.Errorf("other client, got %q", u)
+	}
+}
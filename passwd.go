@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// passwdCommand manages the users in the passwd file,
+// the file is replaced by rename, so the running server
+// never sees a partial file
+func passwdCommand(args []string) {
+	var fn, realm, hashType, password string
+
+	fs := flag.NewFlagSet("passwd", flag.ExitOnError)
+	fs.StringVar(&fn, "f", "passwdfile", "passwd file")
+	fs.StringVar(&realm, "realm", "", "realm, empty for the htpasswd entry usable by basic auth only")
+	fs.StringVar(&hashType, "hash", "", "hash for the htpasswd entry: bcrypt(default), sha512, argon2")
+	fs.StringVar(&password, "p", "", "password, read from terminal or stdin when empty")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s passwd add|del|list|verify [options] [user]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	if len(args) < 1 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	cmd := args[0]
+	fs.Parse(args[1:])
+
+	if cmd == "list" {
+		if err := listPwFile(os.Stdout, fn, realm); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if fs.NArg() != 1 || strings.ContainsAny(fs.Arg(0), ":\r\n") || fs.Arg(0) == "" {
+		fs.Usage()
+		os.Exit(-1)
+	}
+	user := fs.Arg(0)
+
+	if strings.ContainsAny(realm, ":\r\n") {
+		log.Fatal("invalid realm")
+	}
+
+	var err error
+	switch cmd {
+	case "add":
+		if password == "" {
+			password, err = readPassword(true)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		var line string
+		if line, err = pwEntryLine(user, realm, password, hashType); err == nil {
+			err = editPwFile(fn, func(lines []string) ([]string, error) {
+				return setPwEntry(lines, user, realm, line), nil
+			})
+		}
+	case "del":
+		err = editPwFile(fn, func(lines []string) ([]string, error) {
+			lines1, found := delPwEntry(lines, user, realm)
+			if !found {
+				return nil, fmt.Errorf("user %s not found", user)
+			}
+			return lines1, nil
+		})
+	case "verify":
+		if password == "" {
+			password, err = readPassword(false)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		var pw *digestPwFile
+		if pw, err = loadPwFile(fn); err == nil {
+			if !pw.checkPassword(user, realm, password) {
+				fmt.Println("password mismatch")
+				os.Exit(1)
+			}
+			fmt.Println("ok")
+		}
+	default:
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// loadPwFile loads the file without watching it
+func loadPwFile(fn string) (*digestPwFile, error) {
+	pw := &digestPwFile{path: fn}
+	if err := pw.loadFile(); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// readPassword reads the password from terminal without echo,
+// or the first line of stdin
+func readPassword(confirm bool) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	p, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	if confirm {
+		fmt.Fprint(os.Stderr, "Retype password: ")
+		p1, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		if string(p) != string(p1) {
+			return "", fmt.Errorf("password mismatch")
+		}
+	}
+	return string(p), nil
+}
+
+// pwEntryLine returns the file line for the user,
+// the htdigest format when realm is not empty
+func pwEntryLine(user, realm, password, hashType string) (string, error) {
+	if realm != "" {
+		if hashType != "" {
+			return "", fmt.Errorf("-hash is for the htpasswd entry, digest entry is always md5")
+		}
+		h := md5.Sum([]byte(fmt.Sprintf("%s:%s:%s", user, realm, password)))
+		return fmt.Sprintf("%s:%s:%s", user, realm, hex.EncodeToString(h[:])), nil
+	}
+
+	var hashed string
+	switch hashType {
+	case "", "bcrypt":
+		b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+		hashed = string(b)
+	case "sha512":
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		for i := range salt {
+			salt[i] = cryptB64[int(salt[i])%len(cryptB64)]
+		}
+		h, err := shaCrypt(password, "$6$"+string(salt))
+		if err != nil {
+			return "", err
+		}
+		hashed = h
+	case "argon2":
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		var m, t uint32 = 65536, 3
+		var p uint8 = 4
+		key := argon2.IDKey([]byte(password), salt, t, m, p, 32)
+		hashed = fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, m, t, p,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+	default:
+		return "", fmt.Errorf("invalid hash: %s, only bcrypt, sha512, argon2 allowed", hashType)
+	}
+	return user + ":" + hashed, nil
+}
+
+// matchPwEntry reports whether the line is the entry of user in realm,
+// the empty realm matches the htpasswd entry
+func matchPwEntry(line, user, realm string) bool {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return false
+	}
+
+	f := strings.SplitN(line, ":", 3)
+	if f[0] != user {
+		return false
+	}
+	if realm == "" {
+		return len(f) == 2
+	}
+	return len(f) == 3 && f[1] == realm
+}
+
+// setPwEntry replaces the entry of user in place, or appends it
+func setPwEntry(lines []string, user, realm, entry string) []string {
+	for i, l := range lines {
+		if matchPwEntry(l, user, realm) {
+			lines[i] = entry
+			lines1, _ := delPwEntry(lines[i+1:], user, realm)
+			return append(lines[:i+1], lines1...)
+		}
+	}
+	return append(lines, entry)
+}
+
+func delPwEntry(lines []string, user, realm string) ([]string, bool) {
+	found := false
+	out := lines[:0:0]
+	for _, l := range lines {
+		if matchPwEntry(l, user, realm) {
+			found = true
+			continue
+		}
+		out = append(out, l)
+	}
+	return out, found
+}
+
+func listPwFile(w io.Writer, fn, realm string) error {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range strings.Split(string(data), "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || l[0] == '#' {
+			continue
+		}
+		f := strings.SplitN(l, ":", 3)
+		switch {
+		case len(f) == 2 && realm == "":
+			fmt.Fprintln(w, f[0])
+		case len(f) == 3 && (realm == "" || realm == f[1]):
+			fmt.Fprintf(w, "%s %s\n", f[0], f[1])
+		}
+	}
+	return nil
+}
+
+// editPwFile rewrites the passwd file by edit,
+// the new content is validated, and replaces the old one by rename
+func editPwFile(fn string, edit func(lines []string) ([]string, error)) error {
+	var lines []string
+	mode := os.FileMode(0600)
+
+	data, err := ioutil.ReadFile(fn)
+	switch {
+	case err == nil:
+		lines = strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+		if fi, err := os.Stat(fn); err == nil {
+			mode = fi.Mode().Perm()
+		}
+	case os.IsNotExist(err):
+	default:
+		return err
+	}
+
+	if lines, err = edit(lines); err != nil {
+		return err
+	}
+
+	content := strings.Join(lines, "\n") + "\n"
+	if _, err := parsePwFile(strings.NewReader(content), fn); err != nil {
+		return err
+	}
+
+	fp, err := ioutil.TempFile(filepath.Dir(fn), "."+filepath.Base(fn)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+
+	if _, err := io.WriteString(fp, content); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(fp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(fp.Name(), fn)
+}
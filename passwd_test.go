@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPasswdEdit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "passwdfile")
+	ioutil.WriteFile(fn, []byte("# users\ntest:example.com:3441b753b98a6dc702183c989e35970f\n"), 0640)
+
+	add := func(user, realm, password, hashType string) {
+		line, err := pwEntryLine(user, realm, password, hashType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := editPwFile(fn, func(lines []string) ([]string, error) {
+			return setPwEntry(lines, user, realm, line), nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	add("test", "example.com", "new", "")
+	add("test", "other.com", "other", "")
+	add("u1", "", "p1", "bcrypt")
+	add("u2", "", "p2", "sha512")
+	add("u3", "", "p3", "argon2")
+
+	pw, err := loadPwFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		user, realm, password string
+	}{
+		{"test", "example.com", "new"},
+		{"test", "other.com", "other"},
+		{"u1", "", "p1"},
+		{"u2", "", "p2"},
+		{"u3", "", "p3"},
+	} {
+		if !pw.checkPassword(c.user, c.realm, c.password) {
+			t.Errorf("%s@%s: password rejected", c.user, c.realm)
+		}
+	}
+	if pw.checkPassword("test", "example.com", "test") {
+		t.Errorf("old password accepted")
+	}
+
+	if err := editPwFile(fn, func(lines []string) ([]string, error) {
+		lines, _ = delPwEntry(lines, "test", "other.com")
+		return lines, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	listPwFile(&out, fn, "")
+	if s := out.String(); s != "test example.com\nu1\nu2\nu3\n" {
+		t.Errorf("unexpected list %q", s)
+	}
+
+	data, _ := ioutil.ReadFile(fn)
+	if !bytes.HasPrefix(data, []byte("# users\ntest:example.com:")) {
+		t.Errorf("comment or order not kept: %q", data)
+	}
+
+	if fi, _ := os.Stat(fn); fi.Mode().Perm() != 0640 {
+		t.Errorf("file mode changed to %s", fi.Mode())
+	}
+
+	// the invalid result never written
+	if err := editPwFile(fn, func(lines []string) ([]string, error) {
+		return append(lines, "bad:example.com:xyz"), nil
+	}); err == nil {
+		t.Errorf("invalid entry written")
+	}
+
+	if _, err := pwEntryLine("u4", "", "p4", "md5"); err == nil {
+		t.Errorf("unsupported hash accepted")
+	}
+}
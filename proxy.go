@@ -6,7 +6,6 @@ import (
 	"net/http"
 	//"bufio"
 	//"fmt"
-	"io"
 	"log"
 	//"strings"
 	"time"
@@ -67,6 +66,6 @@ func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	copyBuffer(w, resp.Body)
 	resp.Body.Close()
 }
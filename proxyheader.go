@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/net/http/httpguts"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// hopHeaders are for one connection only, never forwarded, rfc 9110 7.6.1
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers and
+// the headers listed in Connection
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, f := range strings.Split(v, ",") {
+			if f = textproto.TrimString(f); f != "" {
+				h.Del(f)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+// upgradeType returns the protocol of Upgrade,
+// empty when the Connection has no upgrade
+func upgradeType(h http.Header) string {
+	if !httpguts.HeaderValuesContainsToken(h["Connection"], "Upgrade") {
+		return ""
+	}
+	return h.Get("Upgrade")
+}
+
+// headerPolicy decides the Via and X-Forwarded-For headers
+// the forward proxy sends
+//
+//	via            add(default)  append the proxy to Via
+//	               strip         remove Via, the proxy is not added
+//	               anonymize     replace Via by the proxy only
+//	xforwardedfor  pass(default) keep the headers as received
+//	               add           append the client address
+//	               strip         remove X-Forwarded-For, Forwarded
+//	                             and X-Real-IP
+//	               anonymize     X-Forwarded-For: unknown
+type headerPolicy struct {
+	via     string
+	viaName string
+	xff     string
+}
+
+var defaultHeaderPolicy = &headerPolicy{via: "add", viaName: "gserver", xff: "pass"}
+
+func newHeaderPolicy(c proxyHeaderConf) (*headerPolicy, error) {
+	hp := &headerPolicy{via: c.Via, viaName: c.ViaName, xff: c.XForwardedFor}
+
+	switch hp.via {
+	case "":
+		hp.via = "add"
+	case "add", "strip", "anonymize":
+	default:
+		return nil, fmt.Errorf("proxyheaders: invalid via %s, only add, strip, anonymize allowed", hp.via)
+	}
+
+	switch hp.xff {
+	case "":
+		hp.xff = "pass"
+	case "pass", "add", "strip", "anonymize":
+	default:
+		return nil, fmt.Errorf("proxyheaders: invalid xforwardedfor %s, only pass, add, strip, anonymize allowed", hp.xff)
+	}
+
+	if hp.viaName == "" {
+		hp.viaName = "gserver"
+	}
+	if strings.ContainsAny(hp.viaName, " ,\t\r\n") {
+		return nil, fmt.Errorf("proxyheaders: invalid vianame %q", hp.viaName)
+	}
+
+	return hp, nil
+}
+
+func viaVersion(major, minor int) string {
+	if major == 1 {
+		return fmt.Sprintf("1.%d", minor)
+	}
+	return fmt.Sprintf("%d", major)
+}
+
+func (hp *headerPolicy) setVia(h http.Header, major, minor int) {
+	via := viaVersion(major, minor) + " " + hp.viaName
+	switch hp.via {
+	case "add":
+		h.Add("Via", via)
+	case "strip":
+		h.Del("Via")
+	case "anonymize":
+		h.Set("Via", via)
+	}
+}
+
+// request sets the headers of the request sent to upstream
+func (hp *headerPolicy) request(r *http.Request) {
+	hp.setVia(r.Header, r.ProtoMajor, r.ProtoMinor)
+
+	switch hp.xff {
+	case "add":
+		ip := remoteIP(r)
+		if ip == nil {
+			break
+		}
+		if prior := r.Header["X-Forwarded-For"]; len(prior) > 0 {
+			r.Header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+ip.String())
+		} else {
+			r.Header.Set("X-Forwarded-For", ip.String())
+		}
+	case "strip":
+		r.Header.Del("X-Forwarded-For")
+		r.Header.Del("Forwarded")
+		r.Header.Del("X-Real-IP")
+	case "anonymize":
+		r.Header.Set("X-Forwarded-For", "unknown")
+		r.Header.Del("Forwarded")
+		r.Header.Del("X-Real-IP")
+	}
+}
+
+// response sets the headers of the response sent to client
+func (hp *headerPolicy) response(resp *http.Response) {
+	hp.setVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+}
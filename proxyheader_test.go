@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRemoveHopHeaders(t *testing.T) {
+	h := http.Header{
+		"Connection":          {"close, X-Foo", "x-bar"},
+		"Keep-Alive":          {"timeout=5"},
+		"Proxy-Connection":    {"keep-alive"},
+		"Proxy-Authorization": {"Basic dGVzdDpzZWNyZXQ="},
+		"Te":                  {"trailers"},
+		"Trailer":             {"X-Sum"},
+		"Upgrade":             {"websocket"},
+		"X-Foo":               {"1"},
+		"X-Bar":               {"2"},
+		"X-Baz":               {"3"},
+	}
+	removeHopHeaders(h)
+
+	if len(h) != 1 || h.Get("X-Baz") != "3" {
+		t.Errorf("unexpected headers %v", h)
+	}
+}
+
+func TestHeaderPolicy(t *testing.T) {
+	testCases := []struct {
+		conf proxyHeaderConf
+		via  string
+		xff  string
+	}{
+		{proxyHeaderConf{}, "1.1 a, 1.1 gserver", "1.1.1.1"},
+		{proxyHeaderConf{Via: "strip", XForwardedFor: "strip"}, "", ""},
+		{proxyHeaderConf{Via: "anonymize", ViaName: "proxy", XForwardedFor: "anonymize"}, "1.1 proxy", "unknown"},
+		{proxyHeaderConf{XForwardedFor: "add"}, "1.1 a, 1.1 gserver", "1.1.1.1, 2.2.2.2"},
+	}
+
+	for i, tc := range testCases {
+		hp, err := newHeaderPolicy(tc.conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+		r.RemoteAddr = "2.2.2.2:1234"
+		r.Header.Set("Via", "1.1 a")
+		r.Header.Set("X-Forwarded-For", "1.1.1.1")
+		r.Header.Set("Forwarded", "for=1.1.1.1")
+		hp.request(r)
+
+		if via := strings.Join(r.Header["Via"], ", "); via != tc.via {
+			t.Errorf("#%d: expected via %q, got %q", i, tc.via, via)
+		}
+		if xff := r.Header.Get("X-Forwarded-For"); xff != tc.xff {
+			t.Errorf("#%d: expected x-forwarded-for %q, got %q", i, tc.xff, xff)
+		}
+	}
+
+	for _, c := range []proxyHeaderConf{{Via: "x"}, {XForwardedFor: "x"}, {ViaName: "a b"}} {
+		if _, err := newHeaderPolicy(c); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+}
+
+func TestProxyHeaders(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Sum")
+		fmt.Fprintf(w, "via=%s te=%s foo=%s", r.Header.Get("Via"), r.Header.Get("Te"), r.Header.Get("X-Foo"))
+		w.Header().Set("X-Sum", "123")
+	}))
+	defer ts.Close()
+
+	ps := httptest.NewServer(&handler{enableProxy: true})
+	defer ps.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ps.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: %s\r\nConnection: X-Foo\r\nX-Foo: 1\r\nTE: trailers\r\n\r\n",
+		ts.URL, strings.TrimPrefix(ts.URL, "http://"))
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(b) != "via=1.1 gserver te=trailers foo=" {
+		t.Errorf("unexpected request headers %q", b)
+	}
+	if via := resp.Header.Get("Via"); via != "1.1 gserver" {
+		t.Errorf("unexpected response via %q", via)
+	}
+	if s := resp.Trailer.Get("X-Sum"); s != "123" {
+		t.Errorf("trailer not forwarded: %v", resp.Trailer)
+	}
+}
+
+func TestProxyUpgrade(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if upgradeType(r.Header) != "echo" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		c, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		brw.Flush()
+		io.Copy(c, brw)
+	}))
+	defer ts.Close()
+
+	ps := httptest.NewServer(&handler{enableProxy: true})
+	defer ps.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ps.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET %s/ws HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n",
+		ts.URL, strings.TrimPrefix(ts.URL, "http://"))
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || upgradeType(resp.Header) != "echo" {
+		t.Fatalf("unexpected response %d %v", resp.StatusCode, resp.Header)
+	}
+
+	fmt.Fprintf(conn, "ping\n")
+	if line, _ := br.ReadString('\n'); line != "ping\n" {
+		t.Errorf("unexpected data %q", line)
+	}
+}
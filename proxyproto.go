@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtoListener reads the PROXY protocol v1 or v2 header
+// sent by the load balancer, the RemoteAddr of the accepted
+// connection is the client address in the header
+//
+// the header is required from the trusted peers, or all the peers
+// when trusted is empty, the other peers are served as is
+type proxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func newProxyProtoListener(l net.Listener, trusted []*net.IPNet) net.Listener {
+	return &proxyProtoListener{l, trusted}
+}
+
+// Accept implements the net.Listener interface, the header is read
+// on first use of the connection, never blocks the accept loop
+func (pl *proxyProtoListener) Accept() (net.Conn, error) {
+	c, err := pl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pl.trusted) > 0 {
+		if a, ok := c.RemoteAddr().(*net.TCPAddr); !ok || !containsIP(pl.trusted, a.IP) {
+			return c, nil
+		}
+	}
+
+	return &proxyConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+const proxyHeaderTimeout = 10 * time.Second
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.remote == nil {
+			c.remote = c.Conn.RemoteAddr()
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.r.Buffered() > 0 {
+		return c.r.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// readProxyHeader returns the source address in the header,
+// nil for the LOCAL command and the UNKNOWN protocol
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	if b, err := r.Peek(len(proxyV2Sig)); err == nil && bytes.Equal(b, proxyV2Sig) {
+		return readProxyHeaderV2(r)
+	}
+
+	if b, err := r.Peek(6); err != nil || string(b) != "PROXY " {
+		return nil, fmt.Errorf("proxy protocol: header missing")
+	}
+	return readProxyHeaderV1(r)
+}
+
+// readProxyHeaderV1 parses the text header like
+//
+//	PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	s := string(line)
+	if !strings.HasSuffix(s, "\r\n") {
+		return nil, fmt.Errorf("proxy protocol: invalid v1 header")
+	}
+
+	f := strings.Fields(s)
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, fmt.Errorf("proxy protocol: invalid v1 header")
+	}
+
+	ip := net.ParseIP(f[2])
+	port, err := strconv.Atoi(f[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("proxy protocol: invalid v1 address")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("proxy protocol: unsupported version %d", hdr[12]>>4)
+	}
+
+	cmd := hdr[12] & 0x0f
+	fam := hdr[13]
+
+	data := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	switch cmd {
+	case 0:
+		// LOCAL, the health check from the proxy itself
+		return nil, nil
+	case 1:
+	default:
+		return nil, fmt.Errorf("proxy protocol: invalid command %d", cmd)
+	}
+
+	switch fam {
+	case 0x11, 0x12:
+		// TCP or UDP over IPv4
+		if len(data) < 12 {
+			return nil, fmt.Errorf("proxy protocol: short address")
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:4]), Port: int(binary.BigEndian.Uint16(data[8:]))}, nil
+	case 0x21, 0x22:
+		// TCP or UDP over IPv6
+		if len(data) < 36 {
+			return nil, fmt.Errorf("proxy protocol: short address")
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:16]), Port: int(binary.BigEndian.Uint16(data[32:]))}, nil
+	}
+
+	// unix socket or unspecified
+	return nil, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(cmd, fam byte, addr []byte) string {
+		b := append([]byte{}, proxyV2Sig...)
+		b = append(b, 0x20|cmd, fam, 0, 0)
+		binary.BigEndian.PutUint16(b[14:], uint16(len(addr)))
+		return string(append(b, addr...))
+	}
+
+	addr4 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 0x1f, 0x90, 0x01, 0xbb}
+	addr6 := make([]byte, 36)
+	addr6[0], addr6[1], addr6[15] = 0x20, 0x01, 1
+	binary.BigEndian.PutUint16(addr6[32:], 443)
+
+	testCases := []struct {
+		header   string
+		expected string
+		fail     bool
+	}{
+		{"PROXY TCP4 1.2.3.4 5.6.7.8 8080 443\r\n", "1.2.3.4:8080", false},
+		{"PROXY TCP6 2001::1 2001::2 8080 443\r\n", "[2001::1]:8080", false},
+		{"PROXY UNKNOWN\r\n", "", false},
+		{"PROXY TCP4 1.2.3.4\r\n", "", true},
+		{"PROXY TCP4 1.2.3.4 5.6.7.8 8080 443\n", "", true},
+		{"GET / HTTP/1.1\r\n", "", true},
+		{v2(1, 0x11, addr4), "1.2.3.4:8080", false},
+		{v2(1, 0x21, addr6), "[2001::1]:443", false},
+		{v2(0, 0x00, nil), "", false},
+		{v2(1, 0x11, addr4[:4]), "", true},
+	}
+
+	for i, tc := range testCases {
+		r := bufio.NewReader(strings.NewReader(tc.header + "GET / HTTP/1.1\r\n"))
+		a, err := readProxyHeader(r)
+		if tc.fail {
+			if err == nil {
+				t.Errorf("#%d: expected error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: %s", i, err)
+			continue
+		}
+		if (a == nil && tc.expected != "") || (a != nil && a.String() != tc.expected) {
+			t.Errorf("#%d: expected %q, got %v", i, tc.expected, a)
+		}
+		if line, _ := r.ReadString('\n'); line != "GET / HTTP/1.1\r\n" {
+			t.Errorf("#%d: payload not kept: %q", i, line)
+		}
+	}
+}
+
+func TestProxyProtoListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	trusted, _ := parseIPNets([]string{"127.0.0.1"})
+	pl := newProxyProtoListener(l, trusted)
+
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("PROXY TCP4 1.2.3.4 5.6.7.8 8080 443\r\nhello\n"))
+	}()
+
+	c, err := pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if a := c.RemoteAddr().String(); a != "1.2.3.4:8080" {
+		t.Errorf("expected 1.2.3.4:8080, got %s", a)
+	}
+
+	line, _ := bufio.NewReader(c).ReadString('\n')
+	if line != "hello\n" {
+		t.Errorf("unexpected payload %q", line)
+	}
+}
@@ -0,0 +1,781 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the defaults of the resolver, used when the config is 0,
+// the negative ttl config disables the cache
+const (
+	defaultDNSMinTTL      = 5 * time.Second
+	defaultDNSMaxTTL      = time.Hour
+	defaultDNSNegativeTTL = 30 * time.Second
+	defaultDNSCacheSize   = 4096
+	defaultDNSTimeout     = 5 * time.Second
+)
+
+// resolver resolves the hosts of the outbound connections,
+// the forward proxy and the reverse proxy backends
+//
+//	hosts    the static addresses, never expire
+//	servers  tried in order, the system resolver when none
+//	         8.8.8.8, udp://8.8.8.8:53   udp, tcp when truncated
+//	         tcp://8.8.8.8:53
+//	         tls://1.1.1.1:853           dns over tls
+//	         https://1.1.1.1/dns-query   dns over https
+//	prefer   ipv4(default) or ipv6 first, ipv4only, ipv6only
+//
+// the answers are cached for the record ttl limited by minttl and
+// maxttl, the names not found for negativettl, the system resolver
+// gives no ttl, minttl is used
+type resolver struct {
+	hosts   map[string][]net.IP
+	servers []*dnsServer
+	prefer  string
+
+	minTTL    time.Duration
+	maxTTL    time.Duration
+	negTTL    time.Duration
+	cacheSize int
+	timeout   time.Duration
+
+	mu       sync.Mutex
+	cache    map[string]*dnsEntry
+	inflight map[string]*dnsCall
+}
+
+type dnsEntry struct {
+	ips    []net.IP
+	err    error
+	expire time.Time
+}
+
+// dnsCall is the lookup in progress, the others wait for it
+type dnsCall struct {
+	done chan struct{}
+	ips  []net.IP
+	err  error
+}
+
+// newResolver returns nil when nothing configured,
+// the nil one is the system resolver
+func newResolver(c resolverConf) (*resolver, error) {
+	if len(c.Hosts) == 0 && len(c.Servers) == 0 && c.Prefer == "" &&
+		c.MinTTL == 0 && c.MaxTTL == 0 && c.NegativeTTL == 0 && c.CacheSize == 0 {
+		return nil, nil
+	}
+
+	r := &resolver{
+		hosts:     map[string][]net.IP{},
+		prefer:    c.Prefer,
+		minTTL:    timeoutOr(c.MinTTL, defaultDNSMinTTL),
+		maxTTL:    timeoutOr(c.MaxTTL, defaultDNSMaxTTL),
+		negTTL:    timeoutOr(c.NegativeTTL, defaultDNSNegativeTTL),
+		cacheSize: c.CacheSize,
+		timeout:   defaultDNSTimeout,
+		cache:     map[string]*dnsEntry{},
+		inflight:  map[string]*dnsCall{},
+	}
+
+	switch r.prefer {
+	case "":
+		r.prefer = "ipv4"
+	case "ipv4", "ipv6", "ipv4only", "ipv6only":
+	default:
+		return nil, fmt.Errorf("resolver: invalid prefer %s, only ipv4, ipv6, ipv4only, ipv6only allowed", r.prefer)
+	}
+
+	if r.cacheSize <= 0 {
+		r.cacheSize = defaultDNSCacheSize
+	}
+
+	for name, addrs := range c.Hosts {
+		for _, a := range addrs {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				return nil, fmt.Errorf("resolver: invalid address %q of %s", a, name)
+			}
+			h := normalizeHost(name)
+			r.hosts[h] = append(r.hosts[h], ip)
+		}
+	}
+
+	for _, s := range c.Servers {
+		ds, err := parseDNSServer(s)
+		if err != nil {
+			return nil, fmt.Errorf("resolver: %s", err)
+		}
+		r.servers = append(r.servers, ds)
+	}
+
+	return r, nil
+}
+
+func notFound(host string) error {
+	return &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// lookup returns the addresses of host in the preferred order
+func (r *resolver) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	if r == nil {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		ips := make([]net.IP, 0, len(addrs))
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+		return ips, nil
+	}
+
+	host = normalizeHost(host)
+
+	ips, ok := r.hosts[host]
+	if !ok {
+		var err error
+		if ips, err = r.cached(ctx, host); err != nil {
+			return nil, err
+		}
+	}
+
+	if ips = r.sort(ips); len(ips) == 0 {
+		return nil, notFound(host)
+	}
+	return ips, nil
+}
+
+// sort orders ips by the preference, a new slice returned
+func (r *resolver) sort(ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	switch r.prefer {
+	case "ipv4only":
+		return v4
+	case "ipv6only":
+		return v6
+	case "ipv6":
+		return append(v6, v4...)
+	}
+	return append(v4, v6...)
+}
+
+// cached returns the cached answer, the concurrent lookups of
+// the same host share one query
+func (r *resolver) cached(ctx context.Context, host string) ([]net.IP, error) {
+	r.mu.Lock()
+	if e, ok := r.cache[host]; ok {
+		if time.Now().Before(e.expire) {
+			r.mu.Unlock()
+			return e.ips, e.err
+		}
+		delete(r.cache, host)
+	}
+
+	call, ok := r.inflight[host]
+	if !ok {
+		call = &dnsCall{done: make(chan struct{})}
+		r.inflight[host] = call
+		go r.resolve(host, call)
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.ips, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// resolve runs without the context of the caller,
+// the other waiters still need the answer
+func (r *resolver) resolve(host string, call *dnsCall) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	var ttl time.Duration
+	if len(r.servers) == 0 {
+		call.ips, call.err = (*resolver)(nil).lookup(ctx, host)
+	} else {
+		call.ips, ttl, call.err = r.query(ctx, host)
+	}
+
+	var de *net.DNSError
+	switch {
+	case call.err == nil:
+		if ttl < r.minTTL {
+			ttl = r.minTTL
+		}
+		if ttl > r.maxTTL {
+			ttl = r.maxTTL
+		}
+	case errors.As(call.err, &de) && de.IsNotFound:
+		if ttl <= 0 || ttl > r.negTTL {
+			ttl = r.negTTL
+		}
+	default:
+		ttl = 0
+	}
+
+	r.mu.Lock()
+	delete(r.inflight, host)
+	if ttl > 0 {
+		r.store(host, &dnsEntry{ips: call.ips, err: call.err, expire: time.Now().Add(ttl)})
+	}
+	r.mu.Unlock()
+
+	close(call.done)
+}
+
+// store adds the entry, the expired ones are removed
+// when the cache is full, then any
+func (r *resolver) store(host string, e *dnsEntry) {
+	if len(r.cache) >= r.cacheSize {
+		now := time.Now()
+		for k, e := range r.cache {
+			if now.After(e.expire) {
+				delete(r.cache, k)
+			}
+		}
+	}
+	for k := range r.cache {
+		if len(r.cache) < r.cacheSize {
+			break
+		}
+		delete(r.cache, k)
+	}
+	r.cache[host] = e
+}
+
+// query asks the servers for A and AAAA in parallel, the ttl
+// is the smallest one of the answers
+func (r *resolver) query(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	var types []dnsmessage.Type
+	if r.prefer != "ipv6only" {
+		types = append(types, dnsmessage.TypeA)
+	}
+	if r.prefer != "ipv4only" {
+		types = append(types, dnsmessage.TypeAAAA)
+	}
+
+	type answer struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+
+	ch := make(chan answer, len(types))
+	for _, t := range types {
+		go func(t dnsmessage.Type) {
+			var a answer
+			for _, ds := range r.servers {
+				a.ips, a.ttl, a.err = ds.query(ctx, host, t)
+				if a.err == nil || errors.Is(a.err, errNoSuchHost) {
+					break
+				}
+			}
+			ch <- a
+		}(t)
+	}
+
+	var ips []net.IP
+	var ttl, negTTL time.Duration
+	var err error
+	notExist := 0
+
+	for range types {
+		a := <-ch
+		switch {
+		case a.err == nil:
+			if len(ips) == 0 || a.ttl < ttl {
+				ttl = a.ttl
+			}
+			ips = append(ips, a.ips...)
+		case errors.Is(a.err, errNoSuchHost):
+			if notExist == 0 || a.ttl < negTTL {
+				negTTL = a.ttl
+			}
+			notExist++
+		default:
+			err = a.err
+		}
+	}
+
+	if len(ips) > 0 {
+		return ips, ttl, nil
+	}
+	if notExist == len(types) {
+		return nil, negTTL, notFound(host)
+	}
+	return nil, 0, &net.DNSError{Err: err.Error(), Name: host}
+}
+
+// errNoSuchHost is NXDOMAIN or no record of the type
+var errNoSuchHost = errors.New("no such host")
+
+// dnsServer is one server of the resolver
+type dnsServer struct {
+	proto string // udp, tcp, tls or https
+	addr  string // host:port, the url for https
+
+	tlsConfig *tls.Config
+	client    *http.Client
+}
+
+func parseDNSServer(s string) (*dnsServer, error) {
+	if !strings.Contains(s, "://") {
+		s = "udp://" + s
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid dns server %s", s)
+	}
+
+	ds := &dnsServer{proto: u.Scheme}
+
+	switch u.Scheme {
+	case "udp", "tcp":
+		ds.addr = hostPort(u, "53")
+	case "tls":
+		ds.addr = hostPort(u, "853")
+		ds.tlsConfig = &tls.Config{ServerName: u.Hostname()}
+	case "https":
+		ds.addr = u.String()
+		ds.client = &http.Client{Transport: &http.Transport{
+			ForceAttemptHTTP2:   true,
+			TLSHandshakeTimeout: defaultTLSHandshakeTimeout,
+			MaxIdleConnsPerHost: 2,
+			IdleConnTimeout:     90 * time.Second,
+		}}
+	default:
+		return nil, fmt.Errorf("invalid dns server %s, only udp, tcp, tls, https allowed", s)
+	}
+
+	return ds, nil
+}
+
+// query returns the addresses and the ttl, errNoSuchHost
+// with the negative ttl when no record
+func (ds *dnsServer) query(ctx context.Context, host string, t dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// the id is 0 for dns over https, rfc 8484 4.1
+	var id uint16
+	if ds.proto != "https" {
+		id = uint16(rand.Uint32())
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: name, Type: t, Class: dnsmessage.ClassINET})
+	q, err := b.Finish()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := ds.exchange(ctx, q, id)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return parseDNSAnswer(resp, id)
+}
+
+func parseDNSAnswer(resp []byte, id uint16) ([]net.IP, time.Duration, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	if h.ID != id || !h.Response {
+		return nil, 0, errors.New("invalid dns response")
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+	default:
+		return nil, 0, fmt.Errorf("dns server: %s", h.RCode)
+	}
+
+	var ips []net.IP
+	var ttl uint32
+	for {
+		ah, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		switch ah.Type {
+		case dnsmessage.TypeA:
+			a, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(a.A[:]))
+		case dnsmessage.TypeAAAA:
+			a, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(a.AAAA[:]))
+		default:
+			p.SkipAnswer()
+			continue
+		}
+
+		if len(ips) == 1 || ah.TTL < ttl {
+			ttl = ah.TTL
+		}
+	}
+
+	if len(ips) > 0 {
+		return ips, time.Duration(ttl) * time.Second, nil
+	}
+
+	// the negative ttl is from the SOA, rfc 2308 5
+	var negTTL time.Duration
+	for {
+		ah, err := p.AuthorityHeader()
+		if err != nil {
+			break
+		}
+		if ah.Type != dnsmessage.TypeSOA {
+			p.SkipAuthority()
+			continue
+		}
+		soa, err := p.SOAResource()
+		if err != nil {
+			break
+		}
+		t := ah.TTL
+		if soa.MinTTL < t {
+			t = soa.MinTTL
+		}
+		negTTL = time.Duration(t) * time.Second
+		break
+	}
+
+	return nil, negTTL, errNoSuchHost
+}
+
+func (ds *dnsServer) exchange(ctx context.Context, q []byte, id uint16) ([]byte, error) {
+	switch ds.proto {
+	case "udp":
+		resp, err := ds.exchangeUDP(ctx, q, id)
+		if err != nil {
+			return nil, err
+		}
+		// truncated, retry by tcp
+		if len(resp) > 2 && resp[2]&0x02 != 0 {
+			return ds.exchangeStream(ctx, q)
+		}
+		return resp, nil
+	case "https":
+		return ds.exchangeHTTPS(ctx, q)
+	}
+	return ds.exchangeStream(ctx, q)
+}
+
+func (ds *dnsServer) exchangeUDP(ctx context.Context, q []byte, id uint16) ([]byte, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "udp", ds.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if t, ok := ctx.Deadline(); ok {
+		c.SetDeadline(t)
+	}
+
+	if _, err := c.Write(q); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 4096)
+	for {
+		n, err := c.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		// drop the late answer of another query
+		if n >= 2 && binary.BigEndian.Uint16(b) == id {
+			return b[:n], nil
+		}
+	}
+}
+
+// exchangeStream sends the query with the 2 bytes length,
+// over tcp or tls
+func (ds *dnsServer) exchangeStream(ctx context.Context, q []byte) ([]byte, error) {
+	var c net.Conn
+	var err error
+	if ds.proto == "tls" {
+		d := &tls.Dialer{Config: ds.tlsConfig}
+		c, err = d.DialContext(ctx, "tcp", ds.addr)
+	} else {
+		var d net.Dialer
+		c, err = d.DialContext(ctx, "tcp", ds.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if t, ok := ctx.Deadline(); ok {
+		c.SetDeadline(t)
+	}
+
+	b := make([]byte, 2+len(q))
+	binary.BigEndian.PutUint16(b, uint16(len(q)))
+	copy(b[2:], q)
+	if _, err := c.Write(b); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(c, b[:2]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(b))
+	if _, err := io.ReadFull(c, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (ds *dnsServer) exchangeHTTPS(ctx context.Context, q []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ds.addr, bytes.NewReader(q))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := ds.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dns server %s: %s", ds.addr, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// resolvingDialer dials the host resolved by r, the addresses g
+// denies are skipped, the others are tried in order
+type resolvingDialer struct {
+	d *net.Dialer
+	r *resolver
+	g *dialGuard
+}
+
+// resolve returns the addresses allowed by the guard
+func (rd *resolvingDialer) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	ips, err := rd.r.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return rd.g.filter(host, ips)
+}
+
+func (rd *resolvingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	// the system resolver and happy eyeballs of net.Dialer,
+	// the unix socket has no host
+	if (rd.r == nil && rd.g == nil) || network == "unix" {
+		return rd.d.DialContext(ctx, network, addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// the timeout covers the lookup and all the addresses
+	if rd.d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rd.d.Timeout)
+		defer cancel()
+	}
+
+	ips, err := rd.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	primaries, fallbacks := splitFamily(ips)
+	if len(fallbacks) == 0 || rd.d.FallbackDelay < 0 {
+		return rd.dialSerial(ctx, network, port, ips)
+	}
+	return rd.dialParallel(ctx, network, port, primaries, fallbacks)
+}
+
+// dialParallel is the happy eyeballs of net.Dialer, the fallbacks
+// start after FallbackDelay or when the primaries failed, the first
+// connection wins
+func (rd *resolvingDialer) dialParallel(ctx context.Context, network, port string, primaries, fallbacks []net.IP) (net.Conn, error) {
+	type dialResult struct {
+		conn    net.Conn
+		err     error
+		primary bool
+		done    bool
+	}
+
+	results := make(chan dialResult)
+	returned := make(chan struct{})
+	defer close(returned)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	start := func(primary bool, ips []net.IP) {
+		conn, err := rd.dialSerial(ctx, network, port, ips)
+		select {
+		case results <- dialResult{conn: conn, err: err, primary: primary, done: true}:
+		case <-returned:
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+
+	go start(true, primaries)
+
+	delay := rd.d.FallbackDelay
+	if delay == 0 {
+		delay = 300 * time.Millisecond
+	}
+	fallbackTimer := time.NewTimer(delay)
+	defer fallbackTimer.Stop()
+
+	var primary, fallback dialResult
+	for {
+		select {
+		case <-fallbackTimer.C:
+			go start(false, fallbacks)
+		case res := <-results:
+			if res.err == nil {
+				return res.conn, nil
+			}
+			if res.primary {
+				primary = res
+			} else {
+				fallback = res
+			}
+			if primary.done && fallback.done {
+				return nil, primary.err
+			}
+			if res.primary && fallbackTimer.Stop() {
+				fallbackTimer.Reset(0)
+			}
+		}
+	}
+}
+
+// dialSerial tries ips in order, each one gets a part of the time
+// left, a dead address does not take all the timeout
+func (rd *resolvingDialer) dialSerial(ctx context.Context, network, port string, ips []net.IP) (net.Conn, error) {
+	var firstErr error
+	for i, ip := range ips {
+		dctx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok {
+			dctx, cancel = context.WithDeadline(ctx, partialDeadline(time.Now(), deadline, len(ips)-i))
+		}
+		conn, err := rd.d.DialContext(dctx, network, net.JoinHostPort(ip.String(), port))
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// partialDeadline splits the time left to the addresses left,
+// 2s at least, as net.Dialer does
+func partialDeadline(now, deadline time.Time, addrs int) time.Time {
+	left := deadline.Sub(now)
+	d := left / time.Duration(addrs)
+	if d < 2*time.Second {
+		d = 2 * time.Second
+		if left < d {
+			d = left
+		}
+	}
+	return now.Add(d)
+}
+
+// splitFamily splits ips to the family of the first one and the other
+func splitFamily(ips []net.IP) (primaries, fallbacks []net.IP) {
+	if len(ips) == 0 {
+		return nil, nil
+	}
+	v4 := ips[0].To4() != nil
+	for _, ip := range ips {
+		if (ip.To4() != nil) == v4 {
+			primaries = append(primaries, ip)
+		} else {
+			fallbacks = append(fallbacks, ip)
+		}
+	}
+	return primaries, fallbacks
+}
+
+func (rd *resolvingDialer) Dial(network, addr string) (net.Conn, error) {
+	return rd.DialContext(context.Background(), network, addr)
+}
+
+// resolvingTransport is the http.DefaultTransport dialing by r,
+// for the clients of the auth backends
+func resolvingTransport(r *resolver) *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	d := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	tr.DialContext = (&resolvingDialer{d: d, r: r}).DialContext
+	return tr
+}
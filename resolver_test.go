@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"github.com/gorilla/mux"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// dnsStub is the dns server for the test, it listens udp and tcp on
+// the same port, big.test is truncated on udp
+type dnsStub struct {
+	records map[string][]string
+	queries int32
+
+	udp net.PacketConn
+	tcp net.Listener
+}
+
+func newDNSStub(t *testing.T) *dnsStub {
+	s := &dnsStub{records: map[string][]string{
+		"a.test.":   {"192.0.2.1", "2001:db8::1"},
+		"v6.test.":  {"2001:db8::2"},
+		"big.test.": {"192.0.2.3"},
+	}}
+
+	var err error
+	if s.udp, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	if s.tcp, err = net.Listen("tcp", s.udp.LocalAddr().String()); err != nil {
+		s.udp.Close()
+		t.Skip(err)
+	}
+
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := s.udp.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			s.udp.WriteTo(s.answer(b[:n], true), addr)
+		}
+	}()
+
+	go s.serveStream(s.tcp)
+
+	return s
+}
+
+func (s *dnsStub) addr() string {
+	return s.udp.LocalAddr().String()
+}
+
+func (s *dnsStub) close() {
+	s.udp.Close()
+	s.tcp.Close()
+}
+
+func (s *dnsStub) serveStream(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			b := make([]byte, 2)
+			if _, err := io.ReadFull(c, b); err != nil {
+				return
+			}
+			q := make([]byte, binary.BigEndian.Uint16(b))
+			if _, err := io.ReadFull(c, q); err != nil {
+				return
+			}
+			resp := s.answer(q, false)
+			binary.BigEndian.PutUint16(b, uint16(len(resp)))
+			c.Write(append(b, resp...))
+		}()
+	}
+}
+
+func (s *dnsStub) answer(q []byte, udp bool) []byte {
+	atomic.AddInt32(&s.queries, 1)
+
+	var p dnsmessage.Parser
+	h, err := p.Start(q)
+	if err != nil {
+		return nil
+	}
+	question, err := p.Question()
+	if err != nil {
+		return nil
+	}
+
+	name := question.Name.String()
+	addrs, ok := s.records[name]
+
+	rh := dnsmessage.Header{ID: h.ID, Response: true, RecursionAvailable: true}
+	if !ok {
+		rh.RCode = dnsmessage.RCodeNameError
+	}
+	if udp && name == "big.test." {
+		rh.Truncated = true
+		addrs = nil
+	}
+
+	b := dnsmessage.NewBuilder(nil, rh)
+	b.StartQuestions()
+	b.Question(question)
+	b.StartAnswers()
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		rrh := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 60}
+		if ip4 := ip.To4(); ip4 != nil && question.Type == dnsmessage.TypeA {
+			r := dnsmessage.AResource{}
+			copy(r.A[:], ip4)
+			b.AResource(rrh, r)
+		} else if ip4 == nil && question.Type == dnsmessage.TypeAAAA {
+			r := dnsmessage.AAAAResource{}
+			copy(r.AAAA[:], ip)
+			b.AAAAResource(rrh, r)
+		}
+	}
+	b.StartAuthorities()
+	if !ok {
+		zone := dnsmessage.MustNewName("test.")
+		b.SOAResource(dnsmessage.ResourceHeader{Name: zone, Class: dnsmessage.ClassINET, TTL: 600},
+			dnsmessage.SOAResource{NS: zone, MBox: zone, MinTTL: 60})
+	}
+	resp, _ := b.Finish()
+	return resp
+}
+
+func (s *dnsStub) count() int {
+	return int(atomic.LoadInt32(&s.queries))
+}
+
+func TestResolverStatic(t *testing.T) {
+	hosts := map[string][]string{"Backend.Test": {"2001:db8::5", "10.0.0.5"}, "v6.test": {"2001:db8::6"}}
+
+	testCases := []struct {
+		prefer string
+		host   string
+		ips    string
+	}{
+		{"", "backend.test", "[10.0.0.5 2001:db8::5]"},
+		{"ipv6", "backend.test.", "[2001:db8::5 10.0.0.5]"},
+		{"ipv6only", "BACKEND.test", "[2001:db8::5]"},
+		{"ipv4only", "v6.test", "error"},
+		{"", "192.0.2.9", "[192.0.2.9]"},
+	}
+
+	for _, tc := range testCases {
+		r, err := newResolver(resolverConf{Hosts: hosts, Prefer: tc.prefer})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ips, err := r.lookup(context.Background(), tc.host)
+		s := fmt.Sprint(ips)
+		if err != nil {
+			s = "error"
+		}
+		if s != tc.ips {
+			t.Errorf("%s %s: expected %s, got %s %v", tc.prefer, tc.host, tc.ips, s, err)
+		}
+	}
+
+	for _, c := range []resolverConf{
+		{Prefer: "x"},
+		{Hosts: map[string][]string{"a": {"x"}}},
+		{Servers: []string{"ftp://1.1.1.1"}},
+	} {
+		if _, err := newResolver(c); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+
+	if r, _ := newResolver(resolverConf{}); r != nil {
+		t.Errorf("expected nil resolver")
+	}
+}
+
+func TestResolverServers(t *testing.T) {
+	stub := newDNSStub(t)
+	defer stub.close()
+
+	// dns over https
+	hs := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		q, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(stub.answer(q, false))
+	}))
+	defer hs.Close()
+
+	// dns over tls
+	tl, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: hs.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+	go stub.serveStream(tl)
+
+	servers := []string{
+		stub.addr(),
+		"tcp://" + stub.addr(),
+		"tls://" + tl.Addr().String(),
+		hs.URL + "/dns-query",
+	}
+
+	for _, s := range servers {
+		r, err := newResolver(resolverConf{Servers: []string{s}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ds := r.servers[0]; ds.tlsConfig != nil {
+			ds.tlsConfig.InsecureSkipVerify = true
+		} else if ds.client != nil {
+			ds.client = hs.Client()
+		}
+
+		ips, err := r.lookup(context.Background(), "a.test")
+		if err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+		if fmt.Sprint(ips) != "[192.0.2.1 2001:db8::1]" {
+			t.Errorf("%s: unexpected addresses %v", s, ips)
+		}
+
+		_, err = r.lookup(context.Background(), "nx.test")
+		if de, ok := err.(*net.DNSError); !ok || !de.IsNotFound {
+			t.Errorf("%s: expected not found, got %v", s, err)
+		}
+	}
+
+	// truncated on udp, retried by tcp
+	r, _ := newResolver(resolverConf{Servers: []string{"udp://" + stub.addr()}, Prefer: "ipv4only"})
+	if ips, err := r.lookup(context.Background(), "big.test"); err != nil || fmt.Sprint(ips) != "[192.0.2.3]" {
+		t.Errorf("tcp fallback failed %v %v", ips, err)
+	}
+
+	// the failed server is skipped
+	r, _ = newResolver(resolverConf{Servers: []string{"tcp://127.0.0.1:1", stub.addr()}, Prefer: "ipv6only"})
+	if ips, err := r.lookup(context.Background(), "v6.test"); err != nil || fmt.Sprint(ips) != "[2001:db8::2]" {
+		t.Errorf("next server not used %v %v", ips, err)
+	}
+}
+
+func TestResolverCache(t *testing.T) {
+	stub := newDNSStub(t)
+	defer stub.close()
+
+	r, err := newResolver(resolverConf{Servers: []string{stub.addr()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the concurrent lookups share the query, A and AAAA
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.lookup(context.Background(), "a.test")
+		}()
+	}
+	wg.Wait()
+	r.lookup(context.Background(), "a.test")
+
+	if n := stub.count(); n != 2 {
+		t.Errorf("expected 2 queries, got %d", n)
+	}
+
+	// negative
+	r.lookup(context.Background(), "nx.test")
+	r.lookup(context.Background(), "nx.test")
+	if n := stub.count(); n != 4 {
+		t.Errorf("expected 4 queries, got %d", n)
+	}
+
+	// the ttl 60 is limited by maxttl
+	r, _ = newResolver(resolverConf{Servers: []string{stub.addr()}, MaxTTL: 50 * time.Millisecond, NegativeTTL: -1})
+	for i := 0; i < 2; i++ {
+		r.lookup(context.Background(), "a.test")
+		r.lookup(context.Background(), "nx.test")
+	}
+	if n := stub.count(); n != 10 {
+		t.Errorf("expected 10 queries, got %d", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	r.lookup(context.Background(), "a.test")
+	if n := stub.count(); n != 12 {
+		t.Errorf("expected 12 queries, got %d", n)
+	}
+}
+
+func TestProxyResolver(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.Host)
+	}))
+	defer ts.Close()
+
+	res, _ := newResolver(resolverConf{Hosts: map[string][]string{"backend.test": {"127.0.0.1"}}})
+	ur, err := newUpstreamRouter(nil, nil, timeoutConf{}, poolConf{}, nil, res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ps := httptest.NewServer(&handler{enableProxy: true, upstreams: ur, resolver: res})
+	defer ps.Close()
+
+	u, _ := url.Parse(ps.URL)
+	c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	resp, err := c.Get("http://backend.test:" + port + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if !strings.HasPrefix(string(b), "hello backend.test") {
+		t.Errorf("unexpected response %q", b)
+	}
+}
+
+// the auth backends and the url backends use the resolver too
+func TestBackendResolver(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Auth-User", "alice")
+		fmt.Fprintf(w, "hello %s", r.Host)
+	}))
+	defer ts.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go fcgi.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "fastcgi %s", r.URL.Path)
+	}))
+
+	res, _ := newResolver(resolverConf{Hosts: map[string][]string{"backend.test": {"127.0.0.1"}}})
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	_, fport, _ := net.SplitHostPort(ln.Addr().String())
+
+	a, err := newAuthenticator(authConf{Backend: "request", AuthRequest: "http://backend.test:" + port + "/auth"}, false, res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := a.checkAuth(httptest.NewRequest(http.MethodGet, "/", nil)); u != "alice" {
+		t.Errorf("auth request: expected alice, got %q", u)
+	}
+
+	p, _ := strconv.Atoi(port)
+	router := mux.NewRouter()
+	registerHTTPHandler(rule{URLPrefix: "/app/", Target: target{Type: "http", Host: "backend.test", Port: p}},
+		timeoutConf{}, res, router)
+	// the system resolver without the resolver config
+	registerHTTPHandler(rule{URLPrefix: "/local/", Target: target{Type: "http", Host: "127.0.0.1", Port: p}},
+		timeoutConf{}, nil, router)
+
+	for _, u := range []string{"/app/a", "/local/b"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, u, nil))
+		if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "hello ") {
+			t.Errorf("reverse %s: unexpected response %d %q", u, w.Code, w.Body.String())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	newFastCGI("tcp", "backend.test:"+fport, "/srv/www", res).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/c.php", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "fastcgi /c.php" {
+		t.Errorf("fastcgi: unexpected response %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestResolvingDialerFallback(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	// the ipv6 address never answers
+	d := timeoutConf{}.dialer()
+	d.ControlContext = func(ctx context.Context, network, address string, c syscall.RawConn) error {
+		if strings.HasPrefix(address, "[2001:db8::") {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}
+
+	testCases := []struct {
+		hosts []string
+		max   time.Duration
+	}{
+		// the ipv4 fallback starts after 300ms
+		{[]string{"2001:db8::1", "2001:db8::2", "127.0.0.1"}, 2 * time.Second},
+		{[]string{"127.0.0.1", "2001:db8::1"}, time.Second},
+	}
+
+	for _, tc := range testCases {
+		res, _ := newResolver(resolverConf{Hosts: map[string][]string{"dual.test": tc.hosts}, Prefer: "ipv6"})
+		rd := &resolvingDialer{d: d, r: res}
+
+		start := time.Now()
+		conn, err := rd.DialContext(context.Background(), "tcp", net.JoinHostPort("dual.test", port))
+		if err != nil {
+			t.Fatalf("%v: %s", tc.hosts, err)
+		}
+		conn.Close()
+		if el := time.Since(start); el > tc.max {
+			t.Errorf("%v: dial took %s", tc.hosts, el)
+		}
+	}
+}
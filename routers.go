@@ -3,8 +3,6 @@ package main
 import (
 	"crypto/tls"
 	"fmt"
-	auth "github.com/fangdingjun/go-http-auth"
-	"github.com/fangdingjun/gofast"
 	loghandler "github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"io"
@@ -50,6 +48,82 @@ func initRouters(cfg conf) {
 		router := mux.NewRouter()
 		domains := []string{}
 		certs := []tls.Certificate{}
+		cache := newFdCache(l.OpenFileCache)
+
+		res, err := newResolver(l.Resolver)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var proxyAuth, socksAuth authenticator
+		var localAuth *authHandler
+		if l.EnableAuth {
+			c := authConf{Type: l.AuthType, Realm: l.Realm, PasswdFile: l.PasswdFile}
+			if l.Auth != nil {
+				c = *l.Auth
+			}
+			if proxyAuth, err = newAuthenticator(c, true, res); err != nil {
+				log.Fatal(err)
+			}
+			// local resources such as webdav shares use the normal
+			// www-authenticate headers, not the proxy ones
+			if localAuth, err = newAuthHandler(c, res); err != nil {
+				log.Fatal(err)
+			}
+
+			if l.SocksPort != 0 || l.SniffProtocol {
+				// socks carries the plain password only
+				c.Type = "basic"
+				if socksAuth, err = newAuthenticator(c, true, res); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+
+		if l.SocksPort != 0 && !l.EnableProxy {
+			log.Fatalf("socksport %d: enableproxy required", l.SocksPort)
+		}
+
+		access, err := newAccessList(l.Access)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		trusted, err := parseIPNets(l.TrustedProxies)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		guard, err := newDialGuard(l.ProxyGuard)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		filter, err := newDomainFilter(l.ProxyFilter)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		upstreams, err := newUpstreamRouter(l.ParentProxy, l.ProxyRoutes, l.Timeouts, l.ProxyPool, guard, res)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		headers, err := newHeaderPolicy(l.ProxyHeaders)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var acl *proxyACL
+		if len(l.ProxyACL) > 0 {
+			groupFile := ""
+			if l.Auth != nil {
+				groupFile = l.Auth.GroupFile
+			}
+			if acl, err = newProxyACL(l.ProxyACL, groupFile); err != nil {
+				log.Fatal(err)
+			}
+		}
 
 		// initial virtual host
 		for _, h := range l.Vhost {
@@ -65,45 +139,90 @@ func initRouters(cfg conf) {
 					log.Fatal(err)
 				}
 			}
+			policy, err := newFsPolicy(h.FollowSymlinks, h.DenyDotfiles, h.DenyFiles)
+			if err != nil {
+				log.Fatal(err)
+			}
 			r := router.Host(h2).Subrouter()
+			if al, err := newAccessList(h.Access); err != nil {
+				log.Fatal(err)
+			} else if al != nil {
+				r.Use(al.middleware)
+			}
+			if h.Auth != nil {
+				ah, err := newAuthHandler(*h.Auth, res)
+				if err != nil {
+					log.Fatal(err)
+				}
+				r.Use(ah.middleware)
+			}
+			// the vhost auth replaces the server one
+			la := localAuth
+			if h.Auth != nil {
+				la = nil
+			}
 			for _, rule := range h.URLRules {
+				sr := ruleRouter(rule, res, r)
 				switch rule.Type {
 				case "alias":
-					registerAliasHandler(rule, r)
+					registerAliasHandler(rule, policy, cache, sr)
 				case "uwsgi":
-					registerUwsgiHandler(rule, r)
+					registerUwsgiHandler(rule, res, sr)
 				case "fastcgi":
-					registerFastCGIHandler(rule, h.Docroot, r)
+					registerFastCGIHandler(rule, h.Docroot, res, sr)
 				case "reverse":
-					registerHTTPHandler(rule, r)
+					registerHTTPHandler(rule, l.Timeouts, res, sr)
+				case "webdav":
+					registerWebdavHandler(rule, policy, la, sr)
+				case "upload":
+					registerUploadHandler(rule, policy, la, sr)
 				default:
 					fmt.Printf("invalid type: %s\n", rule.Type)
 				}
 			}
-			r.PathPrefix("/").Handler(http.FileServer(http.Dir(h.Docroot)))
+			r.PathPrefix("/").Handler(newStaticHandler(newSafeFS(h.Docroot, policy), cache))
 		}
 
 		// default host config
+		policy, err := newFsPolicy(l.FollowSymlinks, l.DenyDotfiles, l.DenyFiles)
+		if err != nil {
+			log.Fatal(err)
+		}
 		for _, rule := range l.URLRules {
+			sr := ruleRouter(rule, res, router)
 			switch rule.Type {
 			case "alias":
-				registerAliasHandler(rule, router)
+				registerAliasHandler(rule, policy, cache, sr)
 			case "uwsgi":
-				registerUwsgiHandler(rule, router)
+				registerUwsgiHandler(rule, res, sr)
 			case "fastcgi":
 				docroot := l.Docroot
 				if rule.Docroot != "" {
 					docroot = rule.Docroot
 				}
-				registerFastCGIHandler(rule, docroot, router)
+				registerFastCGIHandler(rule, docroot, res, sr)
 			case "reverse":
-				registerHTTPHandler(rule, router)
+				registerHTTPHandler(rule, l.Timeouts, res, sr)
+			case "webdav":
+				registerWebdavHandler(rule, policy, localAuth, sr)
+			case "upload":
+				registerUploadHandler(rule, policy, localAuth, sr)
 			default:
 				fmt.Printf("invalid type: %s\n", rule.Type)
 			}
 		}
 
-		router.PathPrefix("/").Handler(http.FileServer(http.Dir(l.Docroot)))
+		router.PathPrefix("/").Handler(newStaticHandler(newSafeFS(l.Docroot, policy), cache))
+
+		if proxyAuth != nil && (len(certs) == 0 || l.SniffProtocol) {
+			a := proxyAuth
+			if la, ok := a.(lockoutAuth); ok {
+				a = la.authenticator
+			}
+			if _, ok := a.(basicAuthenticator); ok {
+				log.Printf("warning: basic auth on http %s:%d sends the password in clear text", l.Host, l.Port)
+			}
+		}
 
 		go func(l server) {
 			addr := fmt.Sprintf("%s:%d", l.Host, l.Port)
@@ -112,19 +231,82 @@ func initRouters(cfg conf) {
 				enableProxy:  l.EnableProxy,
 				enableAuth:   l.EnableAuth,
 				localDomains: domains,
+				authMethod:   proxyAuth,
+				acl:          acl,
+				access:       access,
+				upstreams:    upstreams,
+				headers:      headers,
+				guard:        guard,
+				filter:       filter,
+				resolver:     res,
+				timeouts:     l.Timeouts,
 			}
 
-			if l.EnableAuth {
-				if l.PasswdFile == "" {
-					log.Fatal("passwdfile required")
+			serveSocks := func(ln net.Listener) {
+				s := &socksServer{handler: hdlr, auth: socksAuth}
+				if err := s.serve(ln); err != nil {
+					log.Fatal(err)
 				}
-				du, err := newDigestSecret(l.PasswdFile)
+			}
+
+			if l.SocksPort != 0 {
+				addr := fmt.Sprintf("%s:%d", l.Host, l.SocksPort)
+				ln, err := net.Listen("tcp", addr)
 				if err != nil {
 					log.Fatal(err)
 				}
-				digestAuth := auth.NewDigestAuthenticator(l.Realm, du.getPw)
-				digestAuth.Headers = auth.ProxyHeaders
-				hdlr.authMethod = digestAuth
+				if l.ProxyProtocol {
+					ln = newProxyProtoListener(ln, trusted)
+				}
+				log.Printf("listen socks on %s", addr)
+				go serveSocks(ln)
+			}
+
+			ln, err := net.Listen("tcp", addr)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if l.ProxyProtocol {
+				ln = newProxyProtoListener(ln, trusted)
+			}
+
+			logHandler := newRealIPHandler(loghandler.CombinedLoggingHandler(w, hdlr), trusted)
+
+			newServer := func() *http.Server {
+				return &http.Server{
+					Addr:              addr,
+					Handler:           logHandler,
+					ReadHeaderTimeout: l.Timeouts.readHeader(),
+					ReadTimeout:       l.Timeouts.read(),
+					WriteTimeout:      l.Timeouts.write(),
+					IdleTimeout:       l.Timeouts.idle(),
+				}
+			}
+
+			if l.SniffProtocol {
+				sl := newSniffListener(ln, l.Timeouts.readHeader())
+				go sl.serve()
+
+				if l.EnableProxy {
+					log.Printf("listen socks on %s", addr)
+					go serveSocks(sl.socks)
+				} else {
+					sl.socks.Close()
+				}
+
+				if len(certs) > 0 {
+					// the tls one is served below
+					log.Printf("listen http on %s", addr)
+					go func() {
+						if err := newServer().Serve(sl.http); err != nil {
+							log.Fatal(err)
+						}
+					}()
+					ln = sl.tls
+				} else {
+					sl.tls.Close()
+					ln = sl.http
+				}
 			}
 
 			if len(certs) > 0 {
@@ -134,22 +316,16 @@ func initRouters(cfg conf) {
 
 				tlsconfig.BuildNameToCertificate()
 
-				srv := http.Server{
-					Addr:      addr,
-					TLSConfig: tlsconfig,
-					Handler:   loghandler.CombinedLoggingHandler(w, hdlr),
-				}
+				srv := newServer()
+				srv.TLSConfig = tlsconfig
 				log.Printf("listen https on %s", addr)
-				if err := srv.ListenAndServeTLS("", ""); err != nil {
+				if err := srv.ServeTLS(ln, "", ""); err != nil {
 					log.Fatal(err)
 				}
 
 			} else {
 				log.Printf("listen http on %s", addr)
-				if err := http.ListenAndServe(
-					addr,
-					loghandler.CombinedLoggingHandler(w, hdlr),
-				); err != nil {
+				if err := newServer().Serve(ln); err != nil {
 					log.Fatal(err)
 				}
 			}
@@ -157,12 +333,12 @@ func initRouters(cfg conf) {
 	}
 }
 
-func registerAliasHandler(r rule, router *mux.Router) {
+func registerAliasHandler(r rule, policy fsPolicy, cache *fdCache, router *mux.Router) {
 	switch r.Target.Type {
 	case "file":
 		registerFileHandler(r, router)
 	case "dir":
-		registerDirHandler(r, router)
+		registerDirHandler(r, policy, cache, router)
 	default:
 		fmt.Printf("invalid type: %s, only file, dir allowed\n", r.Target.Type)
 		os.Exit(-1)
@@ -176,14 +352,14 @@ func registerFileHandler(r rule, router *mux.Router) {
 		})
 }
 
-func registerDirHandler(r rule, router *mux.Router) {
+func registerDirHandler(r rule, policy fsPolicy, cache *fdCache, router *mux.Router) {
 	p := strings.TrimRight(r.URLPrefix, "/")
 	router.PathPrefix(r.URLPrefix).Handler(
 		http.StripPrefix(p,
-			http.FileServer(http.Dir(r.Target.Path))))
+			newStaticHandler(newSafeFS(r.Target.Path, policy), cache)))
 }
 
-func registerUwsgiHandler(r rule, router *mux.Router) {
+func registerUwsgiHandler(r rule, res *resolver, router *mux.Router) {
 	var p string
 	switch r.Target.Type {
 	case "unix":
@@ -198,14 +374,16 @@ func registerUwsgiHandler(r rule, router *mux.Router) {
 	if r.IsRegex {
 		m1 := myURLMatch{regexp.MustCompile(r.URLPrefix)}
 		u := NewUwsgi(r.Target.Type, p, "")
+		u.resolver = res
 		router.MatcherFunc(m1.match).Handler(u)
 	} else {
 		u := NewUwsgi(r.Target.Type, p, r.URLPrefix)
+		u.resolver = res
 		router.PathPrefix(r.URLPrefix).Handler(u)
 	}
 }
 
-func registerFastCGIHandler(r rule, docroot string, router *mux.Router) {
+func registerFastCGIHandler(r rule, docroot string, res *resolver, router *mux.Router) {
 	var n, p string
 	switch r.Target.Type {
 	case "unix":
@@ -219,7 +397,7 @@ func registerFastCGIHandler(r rule, docroot string, router *mux.Router) {
 		os.Exit(-1)
 	}
 
-	u := gofast.NewHandler(gofast.NewPHPFS(docroot), n, p)
+	u := newFastCGI(n, p, docroot, res)
 	if r.IsRegex {
 		m1 := myURLMatch{regexp.MustCompile(r.URLPrefix)}
 		router.MatcherFunc(m1.match).Handler(u)
@@ -228,7 +406,7 @@ func registerFastCGIHandler(r rule, docroot string, router *mux.Router) {
 	}
 }
 
-func registerHTTPHandler(r rule, router *mux.Router) {
+func registerHTTPHandler(r rule, t timeoutConf, res *resolver, router *mux.Router) {
 	var u http.Handler
 	var addr string
 	switch r.Target.Type {
@@ -242,7 +420,11 @@ func registerHTTPHandler(r rule, router *mux.Router) {
 			Host:   addr,
 			Path:   r.Target.Path,
 		}
-		u = httputil.NewSingleHostReverseProxy(u1)
+		rp := httputil.NewSingleHostReverseProxy(u1)
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.DialContext = (&resolvingDialer{d: t.dialer(), r: res}).DialContext
+		rp.Transport = tr
+		u = rp
 	default:
 		fmt.Printf("invalid scheme: %s, only support unix, http", r.Target.Type)
 		os.Exit(-1)
@@ -252,6 +434,38 @@ func registerHTTPHandler(r rule, router *mux.Router) {
 		http.StripPrefix(p, u))
 }
 
+// ruleRouter returns the router the rule should be registered on,
+// a sub router with the middleware when the rule needs it
+func ruleRouter(r rule, res *resolver, router *mux.Router) *mux.Router {
+	var mw []mux.MiddlewareFunc
+
+	if al, err := newAccessList(r.Access); err != nil {
+		log.Fatal(err)
+	} else if al != nil {
+		mw = append(mw, al.middleware)
+	}
+
+	if r.SecureLink.Secret != "" {
+		mw = append(mw, newSecureLink(r.SecureLink).middleware)
+	}
+
+	if r.Auth != nil {
+		ah, err := newAuthHandler(*r.Auth, res)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mw = append(mw, ah.middleware)
+	}
+
+	if len(mw) == 0 {
+		return router
+	}
+
+	sr := router.NewRoute().Subrouter()
+	sr.Use(mw...)
+	return sr
+}
+
 type myURLMatch struct {
 	re *regexp.Regexp
 }
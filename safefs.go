@@ -0,0 +1,394 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// symlink policies
+const (
+	symlinkNever      = "never"
+	symlinkOwnerMatch = "owner-match"
+	symlinkAlways     = "always"
+)
+
+// fsPolicy control what files can be served from a document root
+type fsPolicy struct {
+	// followSymlinks is one of never, owner-match, always
+	followSymlinks string
+
+	// denyDotfiles hides the files or directories start with "."
+	denyDotfiles bool
+
+	// denyFiles are glob patterns, matched against each path
+	// component and the whole path relative to the root
+	denyFiles []string
+}
+
+func newFsPolicy(followSymlinks string, denyDotfiles bool, denyFiles []string) (fsPolicy, error) {
+	p := fsPolicy{
+		followSymlinks: followSymlinks,
+		denyDotfiles:   denyDotfiles,
+		denyFiles:      denyFiles,
+	}
+
+	switch followSymlinks {
+	case "":
+		p.followSymlinks = symlinkAlways
+	case symlinkNever, symlinkOwnerMatch, symlinkAlways:
+	default:
+		return p, fmt.Errorf("invalid followsymlinks: %s, only never, owner-match, always allowed", followSymlinks)
+	}
+
+	for _, pattern := range denyFiles {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return p, fmt.Errorf("invalid denyfiles pattern %s: %s", pattern, err)
+		}
+	}
+
+	return p, nil
+}
+
+// denied reports whether the slash separated path
+// relative to the root is hidden by the policy
+func (p fsPolicy) denied(name string) bool {
+	name = strings.Trim(name, "/")
+	if name == "" {
+		return false
+	}
+
+	for _, pattern := range p.denyFiles {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	for _, c := range strings.Split(name, "/") {
+		if p.denyDotfiles && c[0] == '.' {
+			return true
+		}
+		for _, pattern := range p.denyFiles {
+			if ok, _ := path.Match(pattern, c); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// safeFS is a http.FileSystem like http.Dir,
+// but the resolved path never leave the root directory
+// and the files hidden by the policy are not visible
+type safeFS struct {
+	root   string
+	policy fsPolicy
+
+	// id is the root and the policy, the opened files are
+	// shared by the safeFS with the same id only
+	id string
+}
+
+func newSafeFS(root string, p fsPolicy) *safeFS {
+	if root == "" {
+		root = "."
+	}
+	id := fmt.Sprintf("%s\x00%s %v %q", root, p.followSymlinks, p.denyDotfiles, p.denyFiles)
+	return &safeFS{root: root, policy: p, id: id}
+}
+
+// Open implements the http.FileSystem interface
+func (fs *safeFS) Open(name string) (http.File, error) {
+	f, err := fs.open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &safeFile{f, fs, path.Clean("/" + name)}, nil
+}
+
+// open opens the file under the root follow the policy
+func (fs *safeFS) open(name string) (*os.File, error) {
+	return fs.openFile(name, os.O_RDONLY, 0)
+}
+
+// openFile is open with the flag and perm of os.OpenFile,
+// the denied files can not be created
+func (fs *safeFS) openFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	name = path.Clean("/" + name)
+
+	if err := fs.check("open", name, flag&os.O_CREATE != 0); err != nil {
+		return nil, err
+	}
+
+	rel := strings.TrimLeft(name, "/")
+	if rel == "" {
+		rel = "."
+	}
+
+	switch fs.policy.followSymlinks {
+	case symlinkNever:
+		return openBeneath(fs.root, rel, flag, perm, true)
+	case symlinkOwnerMatch:
+		if err := checkSymlinkOwner(fs.root, rel); err != nil {
+			return nil, err
+		}
+	}
+
+	return openBeneath(fs.root, rel, flag, perm, false)
+}
+
+// check returns an error when the policy hides name,
+// not exist for read and permission denied for write
+func (fs *safeFS) check(op, name string, write bool) error {
+	if !fs.policy.denied(name) {
+		return nil
+	}
+	if write {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrPermission}
+	}
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+// stat returns the info of the file the name resolved to
+func (fs *safeFS) stat(name string) (os.FileInfo, error) {
+	f, err := fs.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// parent opens the parent directory of name,
+// the last path component is returned with it
+func (fs *safeFS) parent(op, name string) (*os.File, string, error) {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return nil, "", &os.PathError{Op: op, Path: name, Err: os.ErrPermission}
+	}
+
+	if err := fs.check(op, name, true); err != nil {
+		return nil, "", err
+	}
+
+	dir, base := path.Split(name)
+	d, err := fs.openFile(dir, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	return d, base, nil
+}
+
+// mkdir creates the directory under the root
+func (fs *safeFS) mkdir(name string, perm os.FileMode) error {
+	d, base, err := fs.parent("mkdir", name)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return mkdirAt(d, base, perm)
+}
+
+// mkdirAll creates the directory and the missing parents under the root
+func (fs *safeFS) mkdirAll(name string, perm os.FileMode) error {
+	p := "/"
+	for _, c := range strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/") {
+		if c == "" {
+			continue
+		}
+		p = path.Join(p, c)
+		if err := fs.mkdir(p, perm); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeAll removes name and the children, the symlinks
+// are removed themselves, never followed
+func (fs *safeFS) removeAll(name string) error {
+	d, base, err := fs.parent("remove", name)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return removeAllAt(d, base)
+}
+
+// rename moves oldName to newName, both under the root
+func (fs *safeFS) rename(oldName, newName string) error {
+	od, ob, err := fs.parent("rename", oldName)
+	if err != nil {
+		return err
+	}
+	defer od.Close()
+
+	nd, nb, err := fs.parent("rename", newName)
+	if err != nil {
+		return err
+	}
+	defer nd.Close()
+
+	return renameAt(od, ob, nd, nb)
+}
+
+// moveIn moves the file src from outside of the root to name,
+// it is copied when src is on another filesystem
+func (fs *safeFS) moveIn(src, name string) error {
+	sd, err := os.Open(filepath.Dir(src))
+	if err != nil {
+		return err
+	}
+	defer sd.Close()
+
+	nd, nb, err := fs.parent("rename", name)
+	if err != nil {
+		return err
+	}
+	defer nd.Close()
+
+	err = renameAt(sd, filepath.Base(src), nd, nb)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := fs.openFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// checkSymlinkOwner make sure every symlink in the path
+// has the same owner as its target
+func checkSymlinkOwner(root, rel string) error {
+	p := root
+	for _, c := range strings.Split(rel, "/") {
+		p = filepath.Join(p, c)
+
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			// created by the caller, or not found by it
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if fi.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		ti, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+
+		u1, ok1 := fileOwner(fi)
+		u2, ok2 := fileOwner(ti)
+		if !ok1 || !ok2 || u1 != u2 {
+			return &os.PathError{Op: "open", Path: rel, Err: os.ErrPermission}
+		}
+	}
+	return nil
+}
+
+// openChecked resolves the symlinks and checks the result is under root,
+// it is used when the kernel can not do it for us
+func openChecked(root, rel string, flag int, perm os.FileMode, noSymlinks bool) (*os.File, error) {
+	full := filepath.Join(root, filepath.FromSlash(rel))
+
+	if noSymlinks {
+		p := root
+		for _, c := range strings.Split(rel, "/") {
+			p = filepath.Join(p, c)
+			fi, err := os.Lstat(p)
+			if os.IsNotExist(err) && flag&os.O_CREATE != 0 {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			if fi.Mode()&os.ModeSymlink != 0 {
+				return nil, &os.PathError{Op: "open", Path: rel, Err: os.ErrPermission}
+			}
+		}
+	}
+
+	rootReal, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+
+	real, err := filepath.EvalSymlinks(full)
+	if os.IsNotExist(err) && flag&os.O_CREATE != 0 {
+		// a new file in the existing directory, but not a dangling symlink
+		dir, err := filepath.EvalSymlinks(filepath.Dir(full))
+		if err != nil {
+			return nil, err
+		}
+		real = filepath.Join(dir, filepath.Base(full))
+		if _, err := os.Lstat(real); err == nil {
+			return nil, &os.PathError{Op: "open", Path: rel, Err: os.ErrPermission}
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	if real != rootReal && !strings.HasPrefix(real, rootReal+string(filepath.Separator)) {
+		return nil, &os.PathError{Op: "open", Path: rel, Err: os.ErrPermission}
+	}
+
+	return os.OpenFile(real, flag, perm)
+}
+
+// safeFile hides the denied entries from the directory listing
+type safeFile struct {
+	*os.File
+	fs   *safeFS
+	name string
+}
+
+// Readdir implements the http.File interface
+func (f *safeFile) Readdir(n int) ([]os.FileInfo, error) {
+	fis, err := f.File.Readdir(n)
+	ret := fis[:0]
+	for _, fi := range fis {
+		if f.fs.policy.denied(path.Join(f.name, fi.Name())) {
+			continue
+		}
+		ret = append(ret, fi)
+	}
+	return ret, err
+}
+
+// ReadDir hides the denied entries as Readdir does
+func (f *safeFile) ReadDir(n int) ([]os.DirEntry, error) {
+	des, err := f.File.ReadDir(n)
+	ret := des[:0]
+	for _, de := range des {
+		if f.fs.policy.denied(path.Join(f.name, de.Name())) {
+			continue
+		}
+		ret = append(ret, de)
+	}
+	return ret, err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// openBeneath opens rel under root by openat2(2),
+// the kernel refuses any resolution escape from the root
+func openBeneath(root, rel string, flag int, perm os.FileMode, noSymlinks bool) (*os.File, error) {
+	dir, err := os.Open(root)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	how := &unix.OpenHow{
+		Flags:   uint64(flag) | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_MAGICLINKS,
+	}
+	if flag&os.O_CREATE != 0 {
+		how.Mode = uint64(perm.Perm())
+	}
+	if noSymlinks {
+		how.Resolve |= unix.RESOLVE_NO_SYMLINKS
+	}
+
+	for {
+		fd, err := unix.Openat2(int(dir.Fd()), rel, how)
+		switch err {
+		case nil:
+			return os.NewFile(uintptr(fd), filepath.Join(root, rel)), nil
+		case unix.EINTR, unix.EAGAIN:
+			continue
+		case unix.ENOSYS:
+			// kernel older than 5.6
+			return openChecked(root, rel, flag, perm, noSymlinks)
+		case unix.EXDEV, unix.ELOOP:
+			return nil, &os.PathError{Op: "openat2", Path: rel, Err: os.ErrPermission}
+		default:
+			return nil, &os.PathError{Op: "openat2", Path: rel, Err: err}
+		}
+	}
+}
+
+func fileOwner(fi os.FileInfo) (uint32, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return st.Uid, true
+}
+
+// mkdirAt creates the directory base in dir
+func mkdirAt(dir *os.File, base string, perm os.FileMode) error {
+	if err := unix.Mkdirat(int(dir.Fd()), base, uint32(perm.Perm())); err != nil {
+		return &os.PathError{Op: "mkdirat", Path: base, Err: err}
+	}
+	return nil
+}
+
+// removeAllAt removes base in dir and its children,
+// the symlinks are never followed
+func removeAllAt(dir *os.File, base string) error {
+	return removeAllFd(int(dir.Fd()), base)
+}
+
+func removeAllFd(dirfd int, base string) error {
+	err := unix.Unlinkat(dirfd, base, 0)
+	switch err {
+	case nil, unix.ENOENT:
+		return nil
+	case unix.EISDIR, unix.EPERM:
+	default:
+		return &os.PathError{Op: "unlinkat", Path: base, Err: err}
+	}
+
+	fd, err := unix.Openat(dirfd, base, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "openat", Path: base, Err: err}
+	}
+
+	d := os.NewFile(uintptr(fd), base)
+	names, err := d.Readdirnames(-1)
+	for _, n := range names {
+		if err == nil {
+			err = removeAllFd(fd, n)
+		}
+	}
+	d.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := unix.Unlinkat(dirfd, base, unix.AT_REMOVEDIR); err != nil && err != unix.ENOENT {
+		return &os.PathError{Op: "unlinkat", Path: base, Err: err}
+	}
+	return nil
+}
+
+// renameAt renames oldBase in oldDir to newBase in newDir
+func renameAt(oldDir *os.File, oldBase string, newDir *os.File, newBase string) error {
+	if err := unix.Renameat(int(oldDir.Fd()), oldBase, int(newDir.Fd()), newBase); err != nil {
+		return &os.LinkError{Op: "renameat", Old: oldBase, New: newBase, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+func openBeneath(root, rel string, flag int, perm os.FileMode, noSymlinks bool) (*os.File, error) {
+	return openChecked(root, rel, flag, perm, noSymlinks)
+}
+
+// mkdirAt creates the directory base in dir,
+// dir is the resolved path opened by openChecked
+func mkdirAt(dir *os.File, base string, perm os.FileMode) error {
+	return os.Mkdir(filepath.Join(dir.Name(), base), perm)
+}
+
+// removeAllAt removes base in dir and its children
+func removeAllAt(dir *os.File, base string) error {
+	return os.RemoveAll(filepath.Join(dir.Name(), base))
+}
+
+// renameAt renames oldBase in oldDir to newBase in newDir
+func renameAt(oldDir *os.File, oldBase string, newDir *os.File, newBase string) error {
+	return os.Rename(filepath.Join(oldDir.Name(), oldBase), filepath.Join(newDir.Name(), newBase))
+}
+
+// fileOwner is not supported, owner-match denies all symlinks
+func fileOwner(fi os.FileInfo) (uint32, bool) {
+	return 0, false
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSafeFS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "safefs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	os.MkdirAll(filepath.Join(root, "sub", ".git"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "sub", "a.txt"), []byte("a"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "sub", "a.bak"), []byte("a"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "sub", ".git", "config"), []byte("a"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("s"), 0644)
+	os.Symlink(filepath.Join(dir, "secret"), filepath.Join(root, "out"))
+	os.Symlink("sub/a.txt", filepath.Join(root, "in"))
+
+	testData := []struct {
+		follow string
+		name   string
+		ok     bool
+	}{
+		{"always", "/sub/a.txt", true},
+		{"always", "/sub/../sub/a.txt", true},
+		{"always", "/sub/a.bak", false},
+		{"always", "/sub/.git/config", false},
+		{"always", "/in", true},
+		{"always", "/out", false},
+		{"owner-match", "/in", true},
+		{"never", "/in", false},
+		{"never", "/sub/a.txt", true},
+	}
+
+	for _, d := range testData {
+		p, err := newFsPolicy(d.follow, true, []string{"*.bak"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := newSafeFS(root, p).Open(d.name)
+		if f != nil {
+			f.Close()
+		}
+		if (err == nil) != d.ok {
+			t.Errorf("%s %s: expected ok %v, got error %v", d.follow, d.name, d.ok, err)
+		}
+	}
+
+	if _, err := newFsPolicy("sometimes", false, nil); err == nil {
+		t.Errorf("invalid followsymlinks accepted")
+	}
+}
+
+func TestSafeFSWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "safefs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	os.MkdirAll(root, 0755)
+	os.MkdirAll(outside, 0755)
+	ioutil.WriteFile(filepath.Join(outside, "keep"), []byte("k"), 0644)
+	os.Symlink(outside, filepath.Join(root, "out"))
+	os.Symlink(filepath.Join(outside, "new"), filepath.Join(root, "dangling"))
+
+	p, _ := newFsPolicy("always", true, nil)
+	fs := newSafeFS(root, p)
+
+	create := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	for _, name := range []string{"/out/x", "/dangling", "/.htaccess"} {
+		if f, err := fs.openFile(name, create, 0644); err == nil {
+			f.Close()
+			t.Errorf("%s: created", name)
+		}
+	}
+	for _, name := range []string{"/out/x", "/dangling"} {
+		if f, err := openChecked(root, name[1:], create, 0644, false); err == nil {
+			f.Close()
+			t.Errorf("%s: created by the fallback", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new")); err == nil {
+		t.Errorf("file created outside of the root")
+	}
+
+	if err := fs.mkdirAll("/a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.mkdir("/out/c", 0755); err == nil {
+		t.Errorf("directory created outside of the root")
+	}
+	if err := fs.mkdir("/.git", 0755); !os.IsPermission(err) {
+		t.Errorf("denied directory, expected permission error, got %v", err)
+	}
+
+	f, err := fs.openFile("/a/b/c.txt", create, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("c"))
+	f.Close()
+
+	if err := fs.rename("/a/b/c.txt", "/out/c.txt"); err == nil {
+		t.Errorf("renamed to outside of the root")
+	}
+	if err := fs.rename("/a/b/c.txt", "/a/d.txt"); err != nil {
+		t.Errorf("rename: %s", err)
+	}
+
+	// the symlink is removed, not the target
+	if err := fs.removeAll("/out"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.removeAll("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "keep")); err != nil {
+		t.Errorf("file outside of the root removed")
+	}
+	if fis, _ := ioutil.ReadDir(root); len(fis) != 1 || fis[0].Name() != "dangling" {
+		t.Errorf("unexpected files left in the root")
+	}
+}
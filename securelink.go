@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// secureLink verifies the signed url
+//
+// the url must carry two query parameters,
+//
+//	expires    unix timestamp after which the url is invalid
+//	signature  base64url(HMAC-SHA256(secret, path "\n" expires "\n" ip))
+//
+// ip is the client address when checkip is enabled, or empty
+type secureLink struct {
+	secret  []byte
+	checkIP bool
+}
+
+func newSecureLink(c secureLinkConf) *secureLink {
+	return &secureLink{
+		secret:  []byte(c.Secret),
+		checkIP: c.CheckIP,
+	}
+}
+
+func (sl *secureLink) sign(path string, expires int64, ip string) string {
+	if !sl.checkIP {
+		ip = ""
+	}
+	mac := hmac.New(sha256.New, sl.secret)
+	fmt.Fprintf(mac, "%s\n%d\n%s", path, expires, ip)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// middleware returns a http.Handler which only pass the request
+// with valid signature to h
+func (sl *secureLink) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+		sig := q.Get("signature")
+		if err != nil || sig == "" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "<h1>403 Forbidden</h1>")
+			return
+		}
+
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+
+		expected := sl.sign(r.URL.Path, expires, ip)
+		if !hmac.Equal([]byte(sig), []byte(expected)) {
+			log.Printf("securelink: invalid signature for %s from %s", r.URL.Path, r.RemoteAddr)
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "<h1>403 Forbidden</h1>")
+			return
+		}
+
+		if time.Now().Unix() > expires {
+			w.WriteHeader(http.StatusGone)
+			fmt.Fprintf(w, "<h1>410 Gone</h1>")
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// signURL appends the expires and signature parameters to u
+func (sl *secureLink) signURL(u *url.URL, ttl time.Duration, ip string) {
+	expires := time.Now().Add(ttl).Unix()
+	q := u.Query()
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	q.Set("signature", sl.sign(u.Path, expires, ip))
+	u.RawQuery = q.Encode()
+}
+
+// findSecureLink search the config for the rule protects the url
+func findSecureLink(cfg conf, u *url.URL) (secureLinkConf, bool) {
+	host := u.Hostname()
+
+	match := func(rules []rule) (secureLinkConf, bool) {
+		for _, r := range rules {
+			if r.SecureLink.Secret == "" || r.IsRegex {
+				continue
+			}
+			if strings.HasPrefix(u.Path, r.URLPrefix) {
+				return r.SecureLink, true
+			}
+		}
+		return secureLinkConf{}, false
+	}
+
+	for _, l := range cfg {
+		for _, h := range l.Vhost {
+			h2 := h.Hostname
+			if h1, _, err := net.SplitHostPort(h.Hostname); err == nil {
+				h2 = h1
+			}
+			if host != h2 {
+				continue
+			}
+			if c, ok := match(h.URLRules); ok {
+				return c, true
+			}
+		}
+		if c, ok := match(l.URLRules); ok {
+			return c, true
+		}
+	}
+	return secureLinkConf{}, false
+}
+
+// signCommand implements the "gserver sign" sub command
+func signCommand(args []string) {
+	var configfile, secret, ip string
+	var checkIP bool
+	var ttl time.Duration
+
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	fs.StringVar(&configfile, "c", "config.yaml", "config file, used to find the secret")
+	fs.StringVar(&secret, "secret", "", "secret, override the one in config file")
+	fs.BoolVar(&checkIP, "checkip", false, "bind to client ip, used with -secret")
+	fs.StringVar(&ip, "ip", "", "client ip, required when the rule enabled checkip")
+	fs.DurationVar(&ttl, "ttl", time.Hour, "valid duration")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s sign [options] url\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	u, err := url.Parse(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	c := secureLinkConf{Secret: secret, CheckIP: checkIP}
+	if secret == "" {
+		cfg, err := loadConfig(configfile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var ok bool
+		if c, ok = findSecureLink(cfg, u); !ok {
+			log.Fatalf("no securelink rule for %s", u)
+		}
+	}
+
+	if c.CheckIP && ip == "" {
+		log.Fatal("the rule checks client ip, -ip required")
+	}
+
+	newSecureLink(c).signURL(u, ttl, ip)
+	fmt.Println(u.String())
+}
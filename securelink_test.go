@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSecureLink(t *testing.T) {
+	router := mux.NewRouter()
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ok")
+	})
+
+	rl := rule{URLPrefix: "/priv/", SecureLink: secureLinkConf{Secret: "s3cret", CheckIP: true}}
+	ruleRouter(rl, nil, router).PathPrefix(rl.URLPrefix).Handler(ok)
+	router.PathPrefix("/").Handler(ok)
+
+	get := func(u string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, u, nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if c := get("/public/a.iso"); c != http.StatusOK {
+		t.Errorf("unprotected path, expected 200, got %d", c)
+	}
+
+	if c := get("/priv/a.iso"); c != http.StatusForbidden {
+		t.Errorf("unsigned url, expected 403, got %d", c)
+	}
+
+	sl := newSecureLink(rl.SecureLink)
+
+	u, _ := url.Parse("/priv/a.iso")
+	sl.signURL(u, time.Minute, "10.0.0.1")
+	if c := get(u.String()); c != http.StatusOK {
+		t.Errorf("signed url, expected 200, got %d", c)
+	}
+
+	u, _ = url.Parse("/priv/a.iso")
+	sl.signURL(u, time.Minute, "10.0.0.2")
+	if c := get(u.String()); c != http.StatusForbidden {
+		t.Errorf("signed for other ip, expected 403, got %d", c)
+	}
+
+	u, _ = url.Parse("/priv/a.iso")
+	sl.signURL(u, -time.Minute, "10.0.0.1")
+	if c := get(u.String()); c != http.StatusGone {
+		t.Errorf("expired url, expected 410, got %d", c)
+	}
+}
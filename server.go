@@ -5,11 +5,23 @@ import (
 	//"fmt"
 	"log"
 	//"net/http"
+	"os"
 )
 
 var logfile string
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "sign":
+			signCommand(os.Args[2:])
+			return
+		case "passwd":
+			passwdCommand(os.Args[2:])
+			return
+		}
+	}
+
 	var configfile string
 	flag.StringVar(&configfile, "c", "config.yaml", "config file")
 	flag.StringVar(&logfile, "log", "", "log file")
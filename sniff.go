@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// sniffListener shares one port between the protocols,
+// the accepted connection is dispatched by the first byte
+//
+//	0x16       tls handshake, http/1.1 or h2 by ALPN
+//	0x04 0x05  socks4a, socks5
+//	others     plain http
+//
+// the connection is closed when the listener of
+// its protocol is closed
+type sniffListener struct {
+	ln    net.Listener
+	http  *chanListener
+	tls   *chanListener
+	socks *chanListener
+
+	// the client must send the first byte in timeout
+	timeout time.Duration
+}
+
+func newSniffListener(ln net.Listener, timeout time.Duration) *sniffListener {
+	return &sniffListener{
+		ln:      ln,
+		timeout: timeout,
+		http:    newChanListener(ln.Addr()),
+		tls:     newChanListener(ln.Addr()),
+		socks:   newChanListener(ln.Addr()),
+	}
+}
+
+// serve accepts the connections until the listener fails,
+// the error is returned by the Accept of all the protocols
+func (sl *sniffListener) serve() {
+	for {
+		c, err := sl.ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			sl.http.closeWithError(err)
+			sl.tls.closeWithError(err)
+			sl.socks.closeWithError(err)
+			return
+		}
+		go sl.dispatch(c)
+	}
+}
+
+func (sl *sniffListener) dispatch(c net.Conn) {
+	if sl.timeout > 0 {
+		c.SetReadDeadline(time.Now().Add(sl.timeout))
+	}
+	b := make([]byte, 1)
+	n, err := c.Read(b)
+	if err != nil || n == 0 {
+		c.Close()
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+
+	l := sl.http
+	switch b[0] {
+	case 0x16:
+		l = sl.tls
+	case 0x04, 0x05:
+		l = sl.socks
+	}
+
+	l.put(&sniffConn{c, b})
+}
+
+// sniffConn returns the sniffed bytes first
+type sniffConn struct {
+	net.Conn
+	peeked []byte
+}
+
+func (sc *sniffConn) Read(b []byte) (int, error) {
+	if len(sc.peeked) > 0 {
+		n := copy(b, sc.peeked)
+		sc.peeked = sc.peeked[n:]
+		return n, nil
+	}
+	return sc.Conn.Read(b)
+}
+
+// chanListener is the net.Listener gets the connections from channel
+type chanListener struct {
+	addr net.Addr
+	ch   chan net.Conn
+	done chan struct{}
+	once *sync.Once
+	err  error
+}
+
+func newChanListener(addr net.Addr) *chanListener {
+	return &chanListener{
+		addr: addr,
+		ch:   make(chan net.Conn),
+		done: make(chan struct{}),
+		once: new(sync.Once),
+		err:  net.ErrClosed,
+	}
+}
+
+func (cl *chanListener) put(c net.Conn) {
+	select {
+	case cl.ch <- c:
+	case <-cl.done:
+		c.Close()
+	}
+}
+
+func (cl *chanListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-cl.ch:
+		return c, nil
+	case <-cl.done:
+		return nil, cl.err
+	}
+}
+
+func (cl *chanListener) closeWithError(err error) {
+	cl.once.Do(func() {
+		cl.err = err
+		close(cl.done)
+	})
+}
+
+func (cl *chanListener) Close() error {
+	cl.closeWithError(net.ErrClosed)
+	return nil
+}
+
+func (cl *chanListener) Addr() net.Addr {
+	return cl.addr
+}
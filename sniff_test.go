@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	socks "golang.org/x/net/proxy"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSniffListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	addr := ln.Addr().String()
+
+	sl := newSniffListener(ln, 5*time.Second)
+	go sl.serve()
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tls := "plain"
+		if r.TLS != nil {
+			tls = "tls"
+		}
+		fmt.Fprintf(w, "%s %s %s", tls, r.Proto, r.URL.Path)
+	})
+
+	go http.Serve(sl.http, h)
+
+	ts := httptest.NewUnstartedServer(h)
+	ts.Listener.Close()
+	ts.Listener = sl.tls
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	go (&socksServer{handler: &handler{enableProxy: true}}).serve(sl.socks)
+
+	get := func(c *http.Client, u string) string {
+		resp, err := c.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	if s := get(http.DefaultClient, "http://"+addr+"/a"); s != "plain HTTP/1.1 /a" {
+		t.Errorf("unexpected response %q", s)
+	}
+
+	if s := get(ts.Client(), "https://"+addr+"/b"); s != "tls HTTP/2.0 /b" {
+		t.Errorf("unexpected response %q", s)
+	}
+
+	// the socks client reaches the http server on the same port
+	d, _ := socks.SOCKS5("tcp", addr, nil, socks.Direct)
+	c := &http.Client{Transport: &http.Transport{Dial: d.Dial}}
+	if s := get(c, "http://"+addr+"/c"); s != "plain HTTP/1.1 /c" {
+		t.Errorf("unexpected response %q", s)
+	}
+}
+
+func TestSniffListenerClosed(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sl := newSniffListener(ln, 5*time.Second)
+	go sl.serve()
+
+	// no socks here
+	sl.socks.Close()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Write([]byte{5, 1, 0})
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Errorf("expected closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Errorf("expected closed, got %v", err)
+	}
+
+	// the error of the listener goes to all the protocols
+	ln.Close()
+	if _, err := sl.http.Accept(); err == nil || !strings.Contains(err.Error(), "closed") {
+		t.Errorf("expected closed error, got %v", err)
+	}
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// socksServer is the SOCKS5 and SOCKS4a front end of the forward
+// proxy, it shares the auth, acl and upstreams with the http proxy
+//
+// SOCKS5 supports CONNECT and UDP ASSOCIATE, the username/password
+// method is required when the auth is enabled, SOCKS4a supports
+// CONNECT only, and is refused when the auth is enabled, it has no
+// password
+type socksServer struct {
+	*handler
+
+	// auth checks the username and password,
+	// the basic one of the proxy auth config
+	auth authenticator
+}
+
+// socks5 reply codes
+const (
+	socks5Succeeded          = 0x00
+	socks5Failure            = 0x01
+	socks5NotAllowed         = 0x02
+	socks5NetUnreachable     = 0x03
+	socks5HostUnreachable    = 0x04
+	socks5ConnRefused        = 0x05
+	socks5CmdNotSupported    = 0x07
+	socks5AddrTypeNotSupport = 0x08
+)
+
+func (s *socksServer) serve(ln net.Listener) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.serveConn(c)
+	}
+}
+
+func (s *socksServer) serveConn(c net.Conn) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("recover %+v", err)
+		}
+	}()
+
+	if s.access != nil {
+		if ip := connIP(c.RemoteAddr()); !s.access.allowed(ip) {
+			log.Printf("access: %s denied", ip)
+			c.Close()
+			return
+		}
+	}
+
+	if d := s.timeouts.readHeader(); d > 0 {
+		c.SetDeadline(time.Now().Add(d))
+	}
+
+	br := bufio.NewReader(c)
+	ver, err := br.ReadByte()
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	switch ver {
+	case 5:
+		err = s.serveSocks5(c, br)
+	case 4:
+		err = s.serveSocks4(c, br)
+	default:
+		err = fmt.Errorf("invalid version %d", ver)
+	}
+
+	if err != nil {
+		log.Printf("socks: %s: %s", c.RemoteAddr(), err)
+		c.Close()
+	}
+}
+
+func (s *socksServer) serveSocks5(c net.Conn, br *bufio.Reader) error {
+	n, err := br.ReadByte()
+	if err != nil {
+		return err
+	}
+	methods := make([]byte, n)
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return err
+	}
+
+	method := byte(0x00)
+	if s.enableAuth {
+		method = 0x02
+	}
+	if !bytesContain(methods, method) {
+		c.Write([]byte{5, 0xff})
+		return errors.New("no acceptable auth method")
+	}
+	if _, err := c.Write([]byte{5, method}); err != nil {
+		return err
+	}
+
+	user := ""
+	if s.enableAuth {
+		if user, err = s.socks5Auth(c, br); err != nil {
+			return err
+		}
+	}
+
+	// the request
+	hdr := make([]byte, 3)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return err
+	}
+	if hdr[0] != 5 {
+		return fmt.Errorf("invalid version %d", hdr[0])
+	}
+
+	host, port, err := readSocksAddr(br)
+	if err != nil {
+		if err == errAddrType {
+			socks5Reply(c, socks5AddrTypeNotSupport, nil)
+		}
+		return err
+	}
+
+	switch hdr[1] {
+	case 1:
+		return s.socks5Connect(c, br, user, host, port)
+	case 3:
+		return s.socks5UDP(c, br, user, host, port)
+	default:
+		socks5Reply(c, socks5CmdNotSupported, nil)
+		return fmt.Errorf("command %d not supported", hdr[1])
+	}
+}
+
+// socks5Auth runs the username/password sub negotiation, rfc 1929
+func (s *socksServer) socks5Auth(c net.Conn, br *bufio.Reader) (string, error) {
+	ver, err := br.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if ver != 1 {
+		return "", fmt.Errorf("invalid auth version %d", ver)
+	}
+
+	user, err := readSocksString(br)
+	if err != nil {
+		return "", err
+	}
+	password, err := readSocksString(br)
+	if err != nil {
+		return "", err
+	}
+
+	u := s.checkPassword(c.RemoteAddr(), user, password)
+	if u == "" {
+		c.Write([]byte{1, 1})
+		return "", fmt.Errorf("auth failed for user %s", user)
+	}
+
+	_, err = c.Write([]byte{1, 0})
+	return u, err
+}
+
+// checkPassword verify the password by the proxy authenticator,
+// the credentials are passed as the basic Proxy-Authorization
+func (s *socksServer) checkPassword(addr net.Addr, user, password string) string {
+	r := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{},
+		Header:     http.Header{},
+		RemoteAddr: addr.String(),
+	}
+	r.SetBasicAuth(user, password)
+	r.Header.Set("Proxy-Authorization", r.Header.Get("Authorization"))
+	r.Header.Del("Authorization")
+	return s.auth.checkAuth(r)
+}
+
+func (s *socksServer) socks5Connect(c net.Conn, br *bufio.Reader, user, host string, port int) error {
+	if !s.checkACL(user, http.MethodConnect, host, port, c.RemoteAddr().String()) {
+		socks5Reply(c, socks5NotAllowed, nil)
+		return nil
+	}
+
+	if s.filter.blocked(host) {
+		log.Printf("proxy filter: socks %s from %s blocked", host, c.RemoteAddr())
+		socks5Reply(c, socks5NotAllowed, nil)
+		return nil
+	}
+
+	if !s.guard.checkConnect("SOCKS", host, port, c.RemoteAddr().String()) {
+		socks5Reply(c, socks5NotAllowed, nil)
+		return nil
+	}
+
+	conn, err := s.dial(host, port)
+	if err != nil {
+		socks5Reply(c, socks5ErrorCode(err), nil)
+		return err
+	}
+
+	if err := socks5Reply(c, socks5Succeeded, conn.LocalAddr()); err != nil {
+		conn.Close()
+		return err
+	}
+
+	pipeAndClose(conn, s.filter.tunnel(&bufConn{c, br}, host, c.RemoteAddr().String()), s.timeouts.tunnelIdle())
+	return nil
+}
+
+func (s *socksServer) serveSocks4(c net.Conn, br *bufio.Reader) error {
+	hdr := make([]byte, 7)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return err
+	}
+
+	userID, err := br.ReadString(0)
+	if err != nil {
+		return err
+	}
+
+	port := int(binary.BigEndian.Uint16(hdr[1:3]))
+	host := net.IP(hdr[3:7]).String()
+
+	// socks4a, 0.0.0.x means the domain name follows
+	if hdr[3] == 0 && hdr[4] == 0 && hdr[5] == 0 && hdr[6] != 0 {
+		if host, err = br.ReadString(0); err != nil {
+			return err
+		}
+		host = host[:len(host)-1]
+	}
+
+	reply := func(code byte) error {
+		_, err := c.Write([]byte{0, code, 0, 0, 0, 0, 0, 0})
+		return err
+	}
+
+	if s.enableAuth {
+		reply(0x5b)
+		return fmt.Errorf("socks4 user %s: auth required", userID[:len(userID)-1])
+	}
+
+	if hdr[0] != 1 {
+		reply(0x5b)
+		return fmt.Errorf("socks4 command %d not supported", hdr[0])
+	}
+
+	if !s.checkACL("", http.MethodConnect, host, port, c.RemoteAddr().String()) {
+		reply(0x5b)
+		return nil
+	}
+
+	if s.filter.blocked(host) {
+		log.Printf("proxy filter: socks %s from %s blocked", host, c.RemoteAddr())
+		reply(0x5b)
+		return nil
+	}
+
+	if !s.guard.checkConnect("SOCKS", host, port, c.RemoteAddr().String()) {
+		reply(0x5b)
+		return nil
+	}
+
+	conn, err := s.dial(host, port)
+	if err != nil {
+		reply(0x5b)
+		return err
+	}
+
+	if err := reply(0x5a); err != nil {
+		conn.Close()
+		return err
+	}
+
+	pipeAndClose(conn, s.filter.tunnel(&bufConn{c, br}, host, c.RemoteAddr().String()), s.timeouts.tunnelIdle())
+	return nil
+}
+
+// dial connects to the destination like the CONNECT method
+func (s *socksServer) dial(host string, port int) (net.Conn, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	up := s.upstreams.pick(host)
+
+	ctx, cancel := withTimeout(context.Background(), s.timeouts.dial())
+	defer cancel()
+
+	conn, err := up.dial(ctx, addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s via %s: %w", addr, up.name, err)
+	}
+	return conn, nil
+}
+
+// socks5UDP serves UDP ASSOCIATE, the datagrams are always sent
+// directly, the association ends when the tcp connection closed
+//
+// only the datagrams from the client address and from the
+// destinations the client has sent to are relayed
+func (s *socksServer) socks5UDP(c net.Conn, br *bufio.Reader, user, host string, port int) error {
+	clientIP := connIP(c.RemoteAddr())
+
+	var client *net.UDPAddr
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() && port != 0 {
+		client = &net.UDPAddr{IP: ip, Port: port}
+	}
+
+	localIP := connIP(c.LocalAddr())
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		socks5Reply(c, socks5Failure, nil)
+		return err
+	}
+	defer pc.Close()
+
+	if err := socks5Reply(c, socks5Succeeded, pc.LocalAddr()); err != nil {
+		return err
+	}
+
+	c.SetDeadline(time.Time{})
+
+	// the association lives as long as the tcp connection
+	go func() {
+		io.Copy(io.Discard, br)
+		c.Close()
+		pc.Close()
+	}()
+
+	relay := &socksUDPRelay{
+		s:       s,
+		pc:      pc,
+		user:    user,
+		from:    c.RemoteAddr().String(),
+		client:  client,
+		peers:   map[string]bool{},
+		allowed: map[string]bool{},
+	}
+
+	idle := s.timeouts.tunnelIdle()
+
+	b := make([]byte, 65535)
+	for {
+		if idle > 0 {
+			pc.SetReadDeadline(time.Now().Add(idle))
+		}
+		n, addr, err := pc.ReadFromUDP(b)
+		if err != nil {
+			c.Close()
+			return nil
+		}
+
+		if relay.client == nil && addr.IP.Equal(clientIP) {
+			relay.client = addr
+		}
+
+		if relay.client != nil && addr.IP.Equal(relay.client.IP) && addr.Port == relay.client.Port {
+			relay.fromClient(b[:n])
+		} else {
+			relay.fromPeer(b[:n], addr)
+		}
+	}
+}
+
+type socksUDPRelay struct {
+	s      *socksServer
+	pc     *net.UDPConn
+	user   string
+	from   string
+	client *net.UDPAddr
+
+	// the destinations the client has sent to
+	peers   map[string]bool
+	allowed map[string]bool
+}
+
+func (ur *socksUDPRelay) fromClient(b []byte) {
+	// RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT DATA
+	if len(b) < 4 || b[2] != 0 {
+		// fragment not supported
+		return
+	}
+
+	r := &byteReader{b: b[3:]}
+	host, port, err := readSocksAddr(r)
+	if err != nil {
+		return
+	}
+
+	dst := net.JoinHostPort(host, strconv.Itoa(port))
+
+	allowed, ok := ur.allowed[dst]
+	if !ok {
+		allowed = ur.s.checkACL(ur.user, "UDP", host, port, ur.from) && !ur.s.filter.blocked(host)
+		ur.allowed[dst] = allowed
+	}
+	if !allowed {
+		return
+	}
+
+	// the datagram goes to the vetted address
+	ctx, cancel := withTimeout(context.Background(), ur.s.timeouts.dial())
+	ips, err := ur.s.dialer().resolve(ctx, host)
+	cancel()
+	if err != nil {
+		return
+	}
+	addr := &net.UDPAddr{IP: ips[0], Port: port}
+
+	ur.peers[addr.String()] = true
+
+	ur.pc.WriteToUDP(r.b, addr)
+}
+
+func (ur *socksUDPRelay) fromPeer(b []byte, addr *net.UDPAddr) {
+	if ur.client == nil {
+		return
+	}
+
+	if !ur.peers[addr.String()] {
+		return
+	}
+
+	hdr := append([]byte{0, 0, 0}, socksAddr(addr)...)
+	ur.pc.WriteToUDP(append(hdr, b...), ur.client)
+}
+
+var errAddrType = errors.New("address type not supported")
+
+// readSocksAddr reads ATYP DST.ADDR DST.PORT
+func readSocksAddr(r io.ByteReader) (string, int, error) {
+	atyp, err := r.ReadByte()
+	if err != nil {
+		return "", 0, err
+	}
+
+	var b []byte
+	switch atyp {
+	case 1:
+		b = make([]byte, net.IPv4len+2)
+	case 4:
+		b = make([]byte, net.IPv6len+2)
+	case 3:
+		n, err := r.ReadByte()
+		if err != nil {
+			return "", 0, err
+		}
+		b = make([]byte, int(n)+2)
+	default:
+		return "", 0, errAddrType
+	}
+
+	for i := range b {
+		if b[i], err = r.ReadByte(); err != nil {
+			return "", 0, err
+		}
+	}
+
+	port := int(binary.BigEndian.Uint16(b[len(b)-2:]))
+	if atyp == 3 {
+		return string(b[:len(b)-2]), port, nil
+	}
+	return net.IP(b[:len(b)-2]).String(), port, nil
+}
+
+// socksAddr encodes addr as ATYP BND.ADDR BND.PORT,
+// 0.0.0.0:0 when addr is not a ip address
+func socksAddr(addr net.Addr) []byte {
+	var ip net.IP
+	port := 0
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	var b []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append([]byte{1}, ip4...)
+	} else if ip != nil {
+		b = append([]byte{4}, ip.To16()...)
+	} else {
+		b = []byte{1, 0, 0, 0, 0}
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+func socks5Reply(c net.Conn, code byte, addr net.Addr) error {
+	_, err := c.Write(append([]byte{5, code, 0}, socksAddr(addr)...))
+	return err
+}
+
+func socks5ErrorCode(err error) byte {
+	switch {
+	case errors.Is(err, errDestinationDenied):
+		return socks5NotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5ConnRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5NetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return socks5HostUnreachable
+	}
+	var de *net.DNSError
+	if errors.As(err, &de) {
+		return socks5HostUnreachable
+	}
+	return socks5Failure
+}
+
+func readSocksString(br *bufio.Reader) (string, error) {
+	n, err := br.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(br, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func bytesContain(b []byte, c byte) bool {
+	for _, v := range b {
+		if v == c {
+			return true
+		}
+	}
+	return false
+}
+
+// connIP returns the ip address of the tcp or udp address
+func connIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// byteReader reads the datagram in place
+type byteReader struct {
+	b []byte
+}
+
+func (r *byteReader) ReadByte() (byte, error) {
+	if len(r.b) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	c := r.b[0]
+	r.b = r.b[1:]
+	return c, nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	socks "golang.org/x/net/proxy"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startSocks(t *testing.T, s *socksServer) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go s.serve(ln)
+	return ln.Addr().String()
+}
+
+func socksGet(d socks.Dialer, addr, path string) (string, error) {
+	c, err := d.Dial("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	fmt.Fprintf(c, "GET %s HTTP/1.0\r\nHost: test\r\n\r\n", path)
+	b, err := io.ReadAll(c)
+	if err != nil {
+		return "", err
+	}
+	s := string(b)
+	return s[strings.Index(s, "\r\n\r\n")+4:], nil
+}
+
+func TestSocks5(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "target %s", r.URL.Path)
+	}))
+	defer target.Close()
+	taddr := strings.TrimPrefix(target.URL, "http://")
+
+	auth := basicAuthenticator{"test", fixedChecker{"test": "secret"}, true}
+	s := &socksServer{
+		handler: &handler{enableProxy: true, enableAuth: true, authMethod: auth},
+		auth:    auth,
+	}
+	addr := startSocks(t, s)
+
+	d, _ := socks.SOCKS5("tcp", addr, &socks.Auth{User: "test", Password: "secret"}, socks.Direct)
+	body, err := socksGet(d, taddr, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "target /a" {
+		t.Errorf("unexpected response %q", body)
+	}
+
+	d, _ = socks.SOCKS5("tcp", addr, &socks.Auth{User: "test", Password: "bad"}, socks.Direct)
+	if _, err := socksGet(d, taddr, "/a"); err == nil {
+		t.Errorf("expected error with bad password")
+	}
+
+	d, _ = socks.SOCKS5("tcp", addr, nil, socks.Direct)
+	if _, err := socksGet(d, taddr, "/a"); err == nil {
+		t.Errorf("expected error without auth")
+	}
+
+	// the ports of the guard apply to socks too
+	s.guard, _ = newDialGuard(proxyGuardConf{Deny: []string{"192.0.2.0/24"}, ConnectPorts: []string{"443"}})
+	d, _ = socks.SOCKS5("tcp", addr, &socks.Auth{User: "test", Password: "secret"}, socks.Direct)
+	if _, err := socksGet(d, taddr, "/a"); err == nil {
+		t.Errorf("expected error denied by connectports")
+	}
+	s.guard = nil
+
+	// the empty acl denies all
+	s.acl = &proxyACL{}
+	d, _ = socks.SOCKS5("tcp", addr, &socks.Auth{User: "test", Password: "secret"}, socks.Direct)
+	if _, err := socksGet(d, taddr, "/a"); err == nil {
+		t.Errorf("expected error denied by acl")
+	}
+}
+
+func TestSocks4a(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "target %s", r.URL.Path)
+	}))
+	defer target.Close()
+
+	_, p, _ := net.SplitHostPort(strings.TrimPrefix(target.URL, "http://"))
+	var port uint16
+	fmt.Sscan(p, &port)
+
+	s := &socksServer{handler: &handler{enableProxy: true}}
+	addr := startSocks(t, s)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	req := []byte{4, 1, 0, 0, 0, 0, 0, 1}
+	binary.BigEndian.PutUint16(req[2:], port)
+	req = append(req, "user\x00localhost\x00"...)
+	c.Write(req)
+
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0x5a {
+		t.Fatalf("expected 0x5a, got %#x", reply[1])
+	}
+
+	fmt.Fprintf(c, "GET /b HTTP/1.0\r\nHost: test\r\n\r\n")
+	b, _ := io.ReadAll(c)
+	if !bytes.HasSuffix(b, []byte("target /b")) {
+		t.Errorf("unexpected response %q", b)
+	}
+
+	// the ports of the guard apply to socks4 too
+	s.guard, _ = newDialGuard(proxyGuardConf{Deny: []string{"192.0.2.0/24"}, ConnectPorts: []string{"443"}})
+	c, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write(req)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0x5b {
+		t.Errorf("connectports: expected 0x5b, got %#x", reply[1])
+	}
+	s.guard = nil
+
+	// socks4 has no password
+	s.enableAuth = true
+	c, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write(req)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0x5b {
+		t.Errorf("expected 0x5b, got %#x", reply[1])
+	}
+}
+
+func TestSocks5UDP(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, a, err := echo.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(append([]byte("echo "), b[:n]...), a)
+		}
+	}()
+
+	s := &socksServer{handler: &handler{enableProxy: true}}
+	addr := startSocks(t, s)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	br := bufio.NewReader(c)
+	c.Write([]byte{5, 1, 0})
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(br, method); err != nil || method[1] != 0 {
+		t.Fatalf("method negotiation failed: %v %v", method, err)
+	}
+
+	c.Write([]byte{5, 3, 0, 1, 0, 0, 0, 0, 0, 0})
+	hdr := make([]byte, 3)
+	if _, err := io.ReadFull(br, hdr); err != nil || hdr[1] != 0 {
+		t.Fatalf("udp associate failed: %v %v", hdr, err)
+	}
+	host, port, err := readSocksAddr(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uc, err := net.Dial("udp", net.JoinHostPort(host, fmt.Sprint(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+
+	dgram := append([]byte{0, 0, 0}, socksAddr(echo.LocalAddr())...)
+	uc.Write(append(dgram, "hello"...))
+
+	uc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 1500)
+	n, err := uc.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the reply carries the address of the echo server
+	if !bytes.Equal(b[:len(dgram)], dgram) || string(b[len(dgram):n]) != "echo hello" {
+		t.Errorf("unexpected datagram %q", b[:n])
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// staticHandler serves the regular files by http.ServeContent
+// with *os.File as the content, so the body is sent by sendfile(2)
+// on plain http connection; directories, index.html and redirects
+// are still handled by http.FileServer
+type staticHandler struct {
+	fs         *safeFS
+	cache      *fdCache
+	fileServer http.Handler
+}
+
+func newStaticHandler(fs *safeFS, cache *fdCache) *staticHandler {
+	return &staticHandler{
+		fs:         fs,
+		cache:      cache,
+		fileServer: http.FileServer(fs),
+	}
+}
+
+// ServeHTTP implements the http.Handler interface
+func (sh *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upath := r.URL.Path
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) ||
+		strings.HasSuffix(upath, "/") || strings.HasSuffix(upath, "/index.html") {
+		sh.fileServer.ServeHTTP(w, r)
+		return
+	}
+
+	name := path.Clean("/" + upath)
+
+	f, fi, err := sh.cache.get(sh.fs, name)
+	if err != nil {
+		sh.fileServer.ServeHTTP(w, r)
+		return
+	}
+
+	if !fi.Mode().IsRegular() {
+		f.Close()
+		sh.fileServer.ServeHTTP(w, r)
+		return
+	}
+
+	defer sh.cache.put(sh.fs, name, f, fi)
+
+	if r.TLS != nil || r.ProtoMajor == 2 {
+		// sendfile is not possible, use the pooled buffer
+		w = pooledWriter{w}
+	}
+
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
+
+// pooledWriter copies the body with the pooled buffer
+type pooledWriter struct {
+	http.ResponseWriter
+}
+
+// ReadFrom implements the io.ReaderFrom interface
+func (pw pooledWriter) ReadFrom(src io.Reader) (int64, error) {
+	return copyBuffer(writerOnly{pw.ResponseWriter}, src)
+}
+
+// writerOnly hides the ReadFrom method of the underlying writer
+type writerOnly struct {
+	io.Writer
+}
+
+// fdCache keeps the opened files for reuse,
+// a file is used by only one request at the same time,
+// so the file offset is not shared
+type fdCache struct {
+	max      int
+	valid    time.Duration
+	inactive time.Duration
+
+	mu        *sync.Mutex
+	entries   map[string]*fdEntry
+	lastSweep time.Time
+}
+
+type fdEntry struct {
+	fi      os.FileInfo
+	files   []*os.File
+	checked time.Time
+	used    time.Time
+}
+
+// max idle files kept for one path
+const maxIdleFiles = 8
+
+// newFdCache creates the cache holds at most max paths,
+// nil is returned when max is zero, the nil cache opens
+// the file every time
+func newFdCache(max int) *fdCache {
+	if max <= 0 {
+		return nil
+	}
+	return &fdCache{
+		max:      max,
+		valid:    2 * time.Second,
+		inactive: 30 * time.Second,
+		mu:       new(sync.Mutex),
+		entries:  map[string]*fdEntry{},
+	}
+}
+
+// key includes the policy, the file opened by a permissive
+// policy must not be served under a strict one
+func (c *fdCache) key(fs *safeFS, name string) string {
+	return fs.id + "\x00" + name
+}
+
+// get returns a opened file, the file must be returned by put
+func (c *fdCache) get(fs *safeFS, name string) (*os.File, os.FileInfo, error) {
+	if c != nil {
+		if f, fi := c.take(fs, name); f != nil {
+			return f, fi, nil
+		}
+	}
+
+	f, err := fs.open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return f, fi, nil
+}
+
+func (c *fdCache) take(fs *safeFS, name string) (*os.File, os.FileInfo) {
+	k := c.key(fs, name)
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sweep(now)
+
+	e, ok := c.entries[k]
+	if !ok || len(e.files) == 0 {
+		return nil, nil
+	}
+
+	if now.Sub(e.checked) > c.valid {
+		// the file may be replaced or removed
+		fi, err := os.Stat(filepath.Join(fs.root, filepath.FromSlash(name)))
+		if err != nil || !os.SameFile(fi, e.fi) ||
+			!fi.ModTime().Equal(e.fi.ModTime()) || fi.Size() != e.fi.Size() {
+			c.remove(k, e)
+			return nil, nil
+		}
+		e.checked = now
+	}
+
+	e.used = now
+	f := e.files[len(e.files)-1]
+	e.files = e.files[:len(e.files)-1]
+	return f, e.fi
+}
+
+// put returns the file to cache
+func (c *fdCache) put(fs *safeFS, name string, f *os.File, fi os.FileInfo) {
+	if c == nil {
+		f.Close()
+		return
+	}
+
+	k := c.key(fs, name)
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[k]
+	if ok && !os.SameFile(e.fi, fi) {
+		// the entry was replaced while the file in use
+		f.Close()
+		return
+	}
+
+	if !ok {
+		if len(c.entries) >= c.max {
+			c.evict()
+		}
+		e = &fdEntry{fi: fi, checked: now}
+		c.entries[k] = e
+	}
+
+	if len(e.files) >= maxIdleFiles {
+		f.Close()
+		return
+	}
+
+	e.used = now
+	e.files = append(e.files, f)
+}
+
+func (c *fdCache) remove(k string, e *fdEntry) {
+	for _, f := range e.files {
+		f.Close()
+	}
+	delete(c.entries, k)
+}
+
+// evict removes the least recently used entry
+func (c *fdCache) evict() {
+	var k1 string
+	var e1 *fdEntry
+	for k, e := range c.entries {
+		if e1 == nil || e.used.Before(e1.used) {
+			k1, e1 = k, e
+		}
+	}
+	if e1 != nil {
+		c.remove(k1, e1)
+	}
+}
+
+// sweep closes the files not used for a while
+func (c *fdCache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < c.inactive {
+		return
+	}
+	c.lastSweep = now
+	for k, e := range c.entries {
+		if now.Sub(e.used) > c.inactive {
+			c.remove(k, e)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStaticHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("0123456789"), 0644)
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+
+	p, _ := newFsPolicy("", false, nil)
+	sh := newStaticHandler(newSafeFS(dir, p), newFdCache(10))
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/a.txt", nil)
+		r.Header.Set("Range", "bytes=2-4")
+		sh.ServeHTTP(w, r)
+		if w.Code != http.StatusPartialContent || w.Body.String() != "234" {
+			t.Fatalf("range request, got %d %q", w.Code, w.Body.String())
+		}
+	}
+
+	// replaced file must not be served from the cache
+	ioutil.WriteFile(filepath.Join(dir, "b.txt"), []byte("new"), 0644)
+	os.Rename(filepath.Join(dir, "b.txt"), filepath.Join(dir, "a.txt"))
+	sh.cache.valid = 0
+
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/a.txt", nil))
+	if w.Body.String() != "new" {
+		t.Errorf("expected new content, got %q", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/sub", nil))
+	if w.Code != http.StatusMovedPermanently {
+		t.Errorf("directory without slash, expected 301, got %d", w.Code)
+	}
+}
+
+func TestStaticCachePolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, ".env"), []byte("secret"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "a.bak"), []byte("backup"), 0644)
+
+	cache := newFdCache(10)
+	p1, _ := newFsPolicy("", false, nil)
+	p2, _ := newFsPolicy("never", true, []string{"*.bak"})
+	loose := newStaticHandler(newSafeFS(dir, p1), cache)
+	strict := newStaticHandler(newSafeFS(dir, p2), cache)
+
+	for _, name := range []string{"/.env", "/a.bak"} {
+		w := httptest.NewRecorder()
+		loose.ServeHTTP(w, httptest.NewRequest(http.MethodGet, name, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", name, w.Code)
+		}
+
+		// the file opened by the loose policy is in the cache now
+		w = httptest.NewRecorder()
+		strict.ServeHTTP(w, httptest.NewRequest(http.MethodGet, name, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404 by the strict policy, got %d", name, w.Code)
+		}
+	}
+}
+
+const benchFileSize = 64 << 20
+
+func benchmarkStatic(b *testing.B, h func(dir string) http.Handler, tls bool) {
+	dir, err := ioutil.TempDir("", "static")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), benchFileSize/16)
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.iso"), data, 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	var srv *httptest.Server
+	if tls {
+		srv = httptest.NewTLSServer(h(dir))
+	} else {
+		srv = httptest.NewServer(h(dir))
+	}
+	defer srv.Close()
+
+	client := srv.Client()
+
+	b.SetBytes(benchFileSize)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		resp, err := client.Get(srv.URL + "/a.iso")
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+func fileServer(dir string) http.Handler {
+	return http.FileServer(http.Dir(dir))
+}
+
+func staticServer(dir string) http.Handler {
+	p, _ := newFsPolicy("", false, nil)
+	return newStaticHandler(newSafeFS(dir, p), newFdCache(100))
+}
+
+func BenchmarkFileServer(b *testing.B)       { benchmarkStatic(b, fileServer, false) }
+func BenchmarkStaticHandler(b *testing.B)    { benchmarkStatic(b, staticServer, false) }
+func BenchmarkFileServerTLS(b *testing.B)    { benchmarkStatic(b, fileServer, true) }
+func BenchmarkStaticHandlerTLS(b *testing.B) { benchmarkStatic(b, staticServer, true) }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// the default timeouts, used when the config is 0,
+// the negative config disables the timeout
+const (
+	defaultReadHeaderTimeout     = 10 * time.Second
+	defaultIdleTimeout           = 2 * time.Minute
+	defaultDialTimeout           = 10 * time.Second
+	defaultTLSHandshakeTimeout   = 10 * time.Second
+	defaultResponseHeaderTimeout = 30 * time.Second
+	defaultTunnelIdleTimeout     = 5 * time.Minute
+)
+
+func timeoutOr(d, def time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+	if d == 0 {
+		return def
+	}
+	return d
+}
+
+func (t timeoutConf) readHeader() time.Duration {
+	return timeoutOr(t.ReadHeader, defaultReadHeaderTimeout)
+}
+
+// read and write are not limited by default,
+// the large file upload and download take long
+func (t timeoutConf) read() time.Duration {
+	return timeoutOr(t.Read, 0)
+}
+
+func (t timeoutConf) write() time.Duration {
+	return timeoutOr(t.Write, 0)
+}
+
+func (t timeoutConf) idle() time.Duration {
+	return timeoutOr(t.Idle, defaultIdleTimeout)
+}
+
+func (t timeoutConf) dial() time.Duration {
+	return timeoutOr(t.Dial, defaultDialTimeout)
+}
+
+func (t timeoutConf) tlsHandshake() time.Duration {
+	return timeoutOr(t.TLSHandshake, defaultTLSHandshakeTimeout)
+}
+
+func (t timeoutConf) responseHeader() time.Duration {
+	return timeoutOr(t.ResponseHeader, defaultResponseHeaderTimeout)
+}
+
+func (t timeoutConf) tunnelIdle() time.Duration {
+	return timeoutOr(t.TunnelIdle, defaultTunnelIdleTimeout)
+}
+
+// dialer tries ipv6 and ipv4 addresses in parallel, rfc 6555,
+// the ipv4 one starts after FallbackDelay
+func (t timeoutConf) dialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout:       t.dial(),
+		KeepAlive:     30 * time.Second,
+		FallbackDelay: 300 * time.Millisecond,
+	}
+}
+
+// withTimeout is context.WithTimeout, no deadline when d is 0
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// idleTimer calls the func when no data read in d,
+// it is used to close the idle tunnel
+//
+// the read seen by the deadline of copy is reported up to w late,
+// the timer waits d+w, so the func is called in d to d+2w after
+// the last read, never before d
+type idleTimer struct {
+	d time.Duration
+	w time.Duration
+	t *time.Timer
+}
+
+// newIdleTimer returns nil when d is 0, the nil one does nothing
+func newIdleTimer(d time.Duration, f func()) *idleTimer {
+	if d <= 0 {
+		return nil
+	}
+	w := d / 4
+	return &idleTimer{d, w, time.AfterFunc(d+w, f)}
+}
+
+func (it *idleTimer) stop() {
+	if it != nil {
+		it.t.Stop()
+	}
+}
+
+func (it *idleTimer) touch() {
+	it.t.Reset(it.d + it.w)
+}
+
+// copy is copyBuffer with the idle check, the tcp connection is not
+// wrapped, so splice still works, the read deadline ends the copy
+// every w to see whether any data was read, the other conns like
+// h2Conn may not support the deadline and are read by idleReader
+func (it *idleTimer) copy(dst io.Writer, src io.Reader) {
+	if it == nil {
+		copyBuffer(dst, src)
+		return
+	}
+
+	c, ok := src.(*net.TCPConn)
+	if !ok {
+		copyBuffer(dst, it.reader(src))
+		return
+	}
+
+	for {
+		if err := c.SetReadDeadline(time.Now().Add(it.w)); err != nil {
+			return
+		}
+		n, err := copyBuffer(dst, src)
+		if n > 0 {
+			it.touch()
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			return
+		}
+	}
+}
+
+// reader resets the timer on every read
+func (it *idleTimer) reader(r io.Reader) io.Reader {
+	if it == nil {
+		return r
+	}
+	return &idleReader{r, it}
+}
+
+type idleReader struct {
+	r  io.Reader
+	it *idleTimer
+}
+
+func (ir *idleReader) Read(b []byte) (int, error) {
+	n, err := ir.r.Read(b)
+	if n > 0 {
+		ir.it.touch()
+	}
+	return n, err
+}
+
+// clearDeadline removes the deadline set by the http server,
+// it is kept on the hijacked connection
+func clearDeadline(c interface{}) {
+	if c, ok := c.(interface{ SetDeadline(time.Time) error }); ok {
+		c.SetDeadline(time.Time{})
+	}
+}
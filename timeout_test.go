@@ -0,0 +1,176 @@
+package main
+
+import (
+	"github.com/go-yaml/yaml"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTimeoutConf(t *testing.T) {
+	var c timeoutConf
+	if err := yaml.Unmarshal([]byte("readheader: 5s\nwrite: -1s\ntunnelidle: 1h\n"), &c); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		d        time.Duration
+		expected time.Duration
+	}{
+		{"readheader", c.readHeader(), 5 * time.Second},
+		{"read", c.read(), 0},
+		{"write", c.write(), 0},
+		{"idle", c.idle(), defaultIdleTimeout},
+		{"dial", c.dial(), defaultDialTimeout},
+		{"tlshandshake", c.tlsHandshake(), defaultTLSHandshakeTimeout},
+		{"responseheader", c.responseHeader(), defaultResponseHeaderTimeout},
+		{"tunnelidle", c.tunnelIdle(), time.Hour},
+	}
+
+	for _, tc := range testCases {
+		if tc.d != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.expected, tc.d)
+		}
+	}
+}
+
+func TestPipeIdleTimeout(t *testing.T) {
+	a1, a2 := net.Pipe()
+	b1, b2 := net.Pipe()
+
+	done := make(chan struct{})
+	go func() {
+		pipeAndClose(a2, b1, 200*time.Millisecond)
+		close(done)
+	}()
+
+	// the activity keeps the tunnel open
+	go io.Copy(io.Discard, b2)
+	for i := 0; i < 5; i++ {
+		if _, err := a1.Write([]byte("ping")); err != nil {
+			t.Fatalf("tunnel closed while active: %s", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle tunnel not closed")
+	}
+
+	if _, err := a1.Write([]byte("ping")); err == nil {
+		t.Errorf("expected closed")
+	}
+}
+
+func TestIdleCopy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	dial := func() (net.Conn, net.Conn) {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, <-accepted
+	}
+
+	// src and dst are the raw tcp connections
+	w, src := dial()
+	dst, r := dial()
+	defer w.Close()
+	defer src.Close()
+	defer dst.Close()
+	defer r.Close()
+
+	fired := make(chan struct{})
+	it := newIdleTimer(200*time.Millisecond, func() { close(fired) })
+	defer it.stop()
+
+	go func() {
+		for i := 0; i < 6; i++ {
+			w.Write([]byte("ping"))
+			time.Sleep(100 * time.Millisecond)
+		}
+		w.Close()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		it.copy(dst, src)
+		dst.Close()
+		close(done)
+	}()
+
+	b, _ := io.ReadAll(r)
+	<-done
+	if len(b) != 24 {
+		t.Errorf("expected 24 bytes, got %d", len(b))
+	}
+
+	select {
+	case <-fired:
+		t.Errorf("timer fired while active")
+	default:
+	}
+
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Errorf("timer not fired after idle")
+	}
+}
+
+// the h2Conn has no read deadline, the data read from it
+// keeps the tunnel open
+func TestPipeIdleH2Conn(t *testing.T) {
+	pr, pw := io.Pipe()
+	_, w := io.Pipe()
+	hc := &h2Conn{w: w, r: pr, addr: "example.com:443", cancel: func() {}}
+	a1, a2 := net.Pipe()
+
+	done := make(chan struct{})
+	go func() {
+		pipeAndClose(hc, a2, 200*time.Millisecond)
+		close(done)
+	}()
+
+	// one way download longer than the idle time
+	go func() {
+		for i := 0; i < 6; i++ {
+			if _, err := pw.Write([]byte("ping")); err != nil {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+
+	b := make([]byte, 24)
+	if _, err := io.ReadFull(a1, b); err != nil {
+		t.Fatalf("tunnel closed while active: %s", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle tunnel not closed")
+	}
+	a1.Close()
+}
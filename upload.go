@@ -0,0 +1,439 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/gorilla/mux"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the partial files not written in uploadPartExpire are removed,
+// checked once in uploadCleanInterval
+const (
+	uploadPartExpire    = 24 * time.Hour
+	uploadCleanInterval = time.Hour
+)
+
+// uploadHandler accept files by PUT and store them into a directory
+//
+// the file is written to a temporary file in tempDir first, which is
+// outside of the served directory, and moved to the final name when
+// the upload completed, so the partial file never be served or listed.
+// the move is a rename when tempDir is on the same filesystem as dir,
+// a copy otherwise. the default tempDir is in the cache directory of
+// the user, private to the server, the partial files not written in
+// uploadPartExpire are removed.
+//
+// large file can be sent in chunks by Content-Range header,
+//
+//	PUT /upload/a.iso
+//	Content-Range: bytes 0-1048575/4194304
+//
+// HEAD on the same url returns the received size in the Range header,
+// the client continues from there after the connection broken.
+//
+// the checksum of the whole file is verified when the client sends a
+// Digest header (sha-256 or md5, RFC 3230) or X-Checksum-Sha256 header
+// with the last chunk.
+type uploadHandler struct {
+	fs      *safeFS
+	tempDir string
+	prefix  string
+	maxSize int64
+	exts    []string
+
+	mu        *sync.Mutex
+	running   map[string]bool
+	lastClean time.Time
+}
+
+func newUploadHandler(fs *safeFS, tempDir, prefix string, maxSize int64, exts []string) *uploadHandler {
+	if tempDir == "" {
+		tempDir = defaultUploadTempDir()
+	}
+	return &uploadHandler{
+		fs:      fs,
+		tempDir: tempDir,
+		prefix:  strings.TrimRight(prefix, "/"),
+		maxSize: maxSize,
+		exts:    exts,
+		mu:      new(sync.Mutex),
+		running: map[string]bool{},
+	}
+}
+
+// ServeHTTP implements the http.Handler interface
+func (u *uploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, u.prefix))
+	if name == "/" || strings.HasSuffix(r.URL.Path, "/") {
+		http.Error(w, "file name required", http.StatusBadRequest)
+		return
+	}
+
+	if !u.allowedExt(name) {
+		http.Error(w, "file type not allowed", http.StatusForbidden)
+		return
+	}
+
+	if err := u.fs.check("open", name, true); err != nil {
+		http.Error(w, "file name not allowed", http.StatusForbidden)
+		return
+	}
+
+	dst := name
+	part := u.partName(dst)
+
+	switch r.Method {
+	case http.MethodHead:
+		u.status(w, dst, part)
+	case http.MethodPut:
+		if !u.lock(dst) {
+			http.Error(w, "upload in progress", http.StatusConflict)
+			return
+		}
+		defer u.unlock(dst)
+		u.put(w, r, dst, part)
+	default:
+		w.Header().Set("Allow", "HEAD, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (u *uploadHandler) allowedExt(name string) bool {
+	if len(u.exts) == 0 {
+		return true
+	}
+	ext := strings.ToLower(path.Ext(name))
+	for _, e := range u.exts {
+		if strings.ToLower(e) == ext || strings.ToLower("."+e) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// partName returns the temporary file of dst, the name is the hash
+// of the absolute path, so the rules share the same tempDir safely
+func (u *uploadHandler) partName(dst string) string {
+	root, err := filepath.Abs(u.fs.root)
+	if err != nil {
+		root = u.fs.root
+	}
+	sum := sha256.Sum256([]byte(filepath.Join(root, filepath.FromSlash(dst))))
+	return filepath.Join(u.tempDir, hex.EncodeToString(sum[:16])+".part")
+}
+
+// defaultUploadTempDir returns the directory in the user cache,
+// a new random one in the system temp when there is no home
+func defaultUploadTempDir() string {
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "gserver", "upload")
+	}
+	dir, err := os.MkdirTemp("", "gserver-upload")
+	if err != nil {
+		log.Fatal(err)
+	}
+	return dir
+}
+
+// expireParts removes the stale partial files
+func (u *uploadHandler) expireParts(now time.Time) {
+	u.mu.Lock()
+	if now.Sub(u.lastClean) < uploadCleanInterval {
+		u.mu.Unlock()
+		return
+	}
+	u.lastClean = now
+	u.mu.Unlock()
+
+	names, _ := filepath.Glob(filepath.Join(u.tempDir, "*.part"))
+	for _, fn := range names {
+		if fi, err := os.Lstat(fn); err == nil && now.Sub(fi.ModTime()) > uploadPartExpire {
+			os.Remove(fn)
+		}
+	}
+}
+
+func (u *uploadHandler) lock(dst string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.running[dst] {
+		return false
+	}
+	u.running[dst] = true
+	return true
+}
+
+func (u *uploadHandler) unlock(dst string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.running, dst)
+}
+
+// status reports how many bytes of a interrupted upload received
+func (u *uploadHandler) status(w http.ResponseWriter, dst, part string) {
+	if fi, err := os.Stat(part); err == nil {
+		if fi.Size() > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", fi.Size()-1))
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	if fi, err := u.fs.stat(dst); err == nil && fi.Mode().IsRegular() {
+		w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func (u *uploadHandler) put(w http.ResponseWriter, r *http.Request, dst, part string) {
+	start, end, total, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the whole file in one request
+	whole := start < 0
+	if whole {
+		start, end, total = 0, r.ContentLength-1, r.ContentLength
+	}
+
+	if u.maxSize > 0 && (total > u.maxSize || end >= u.maxSize) {
+		http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err := os.MkdirAll(u.tempDir, 0700); err != nil {
+		log.Printf("upload: %s", err)
+		http.Error(w, "create directory failed", http.StatusInternalServerError)
+		return
+	}
+	u.expireParts(time.Now())
+
+	flags := os.O_RDWR | os.O_CREATE
+	if start == 0 {
+		flags |= os.O_TRUNC
+	}
+
+	fp, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		log.Printf("upload: %s", err)
+		http.Error(w, "create file failed", http.StatusInternalServerError)
+		return
+	}
+
+	defer fp.Close()
+
+	if start > 0 {
+		fi, err := fp.Stat()
+		if err != nil || fi.Size() != start {
+			var size int64
+			if fi != nil {
+				size = fi.Size()
+			}
+			if size > 0 {
+				w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", size-1))
+			}
+			http.Error(w, "range not continuous with received data",
+				http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if _, err := fp.Seek(start, io.SeekStart); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var body io.Reader = r.Body
+	if end >= start {
+		body = io.LimitReader(r.Body, end-start+1)
+	} else if u.maxSize > 0 {
+		// unknown length, allow one more byte to detect the overflow
+		body = io.LimitReader(r.Body, u.maxSize-start+1)
+	}
+
+	n, err := io.Copy(fp, body)
+	if err != nil {
+		// keep the received data, the client can resume it
+		log.Printf("upload %s: %s", dst, err)
+		http.Error(w, "receive data failed", http.StatusBadRequest)
+		return
+	}
+
+	if end >= start && n != end-start+1 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", start+n-1))
+		http.Error(w, "incomplete body", http.StatusBadRequest)
+		return
+	}
+
+	if u.maxSize > 0 && start+n > u.maxSize {
+		fp.Close()
+		os.Remove(part)
+		http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if !whole && (total < 0 || start+n < total) {
+		// more chunks follow
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", start+n-1))
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	if err := verifyChecksum(fp, r.Header); err != nil {
+		fp.Close()
+		os.Remove(part)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := fp.Sync(); err != nil {
+		log.Printf("upload %s: %s", dst, err)
+		http.Error(w, "write file failed", http.StatusInternalServerError)
+		return
+	}
+	fp.Close()
+
+	status := http.StatusCreated
+	if _, err := u.fs.stat(dst); err == nil {
+		status = http.StatusNoContent
+	}
+
+	err = u.fs.mkdirAll(path.Dir(dst), 0755)
+	if err == nil {
+		err = u.fs.moveIn(part, dst)
+	}
+	if os.IsPermission(err) {
+		log.Printf("upload %s: %s", dst, err)
+		http.Error(w, "file name not allowed", http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Printf("upload %s: %s", dst, err)
+		http.Error(w, "rename file failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(status)
+}
+
+// parseContentRange parse the header like "bytes 0-99/200",
+// total is -1 when the length is "*",
+// start is -1 when the header is empty
+func parseContentRange(s string) (start, end, total int64, err error) {
+	if s == "" {
+		return -1, -1, -1, nil
+	}
+
+	errInvalid := fmt.Errorf("invalid Content-Range: %s", s)
+
+	if !strings.HasPrefix(s, "bytes ") {
+		return 0, 0, 0, errInvalid
+	}
+
+	s = strings.TrimSpace(s[6:])
+	i := strings.Index(s, "/")
+	if i < 0 {
+		return 0, 0, 0, errInvalid
+	}
+
+	total = -1
+	if s[i+1:] != "*" {
+		if total, err = strconv.ParseInt(s[i+1:], 10, 64); err != nil {
+			return 0, 0, 0, errInvalid
+		}
+	}
+
+	r := strings.SplitN(s[:i], "-", 2)
+	if len(r) != 2 {
+		return 0, 0, 0, errInvalid
+	}
+	if start, err = strconv.ParseInt(r[0], 10, 64); err != nil {
+		return 0, 0, 0, errInvalid
+	}
+	if end, err = strconv.ParseInt(r[1], 10, 64); err != nil {
+		return 0, 0, 0, errInvalid
+	}
+
+	if start < 0 || end < start || (total >= 0 && end >= total) {
+		return 0, 0, 0, errInvalid
+	}
+
+	return start, end, total, nil
+}
+
+// verifyChecksum compare the file content with the checksum
+// in the request header
+func verifyChecksum(fp *os.File, hdr http.Header) error {
+	var h hash.Hash
+	var expected string
+	var encode func([]byte) string
+
+	if v := hdr.Get("X-Checksum-Sha256"); v != "" {
+		h, expected, encode = sha256.New(), strings.ToLower(v), hex.EncodeToString
+	}
+
+	if v := hdr.Get("Digest"); v != "" && h == nil {
+	digests:
+		for _, d := range strings.Split(v, ",") {
+			kv := strings.SplitN(strings.TrimSpace(d), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch strings.ToLower(kv[0]) {
+			case "sha-256":
+				h = sha256.New()
+			case "md5":
+				h = md5.New()
+			default:
+				continue
+			}
+			expected, encode = kv[1], base64.StdEncoding.EncodeToString
+			break digests
+		}
+	}
+
+	if h == nil {
+		return nil
+	}
+
+	if _, err := fp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(h, fp); err != nil {
+		return err
+	}
+
+	if encode(h.Sum(nil)) != expected {
+		return fmt.Errorf("checksum mismatch")
+	}
+
+	return nil
+}
+
+func registerUploadHandler(r rule, policy fsPolicy, a *authHandler, router *mux.Router) {
+	if r.Target.Type != "dir" {
+		fmt.Printf("invalid type: %s, only dir allowed\n", r.Target.Type)
+		os.Exit(-1)
+	}
+
+	h := newUploadHandler(newSafeFS(r.Target.Path, policy), r.TempDir, r.URLPrefix, r.MaxSize, r.AllowedExt)
+	router.PathPrefix(r.URLPrefix).Handler(ruleAuth(r, a, h))
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmp, err := ioutil.TempDir("", "upload-part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	u := newUploadHandler(newSafeFS(dir, fsPolicy{}), tmp, "/upload/", 100, []string{".txt"})
+	data := "hello, world"
+	sum := sha256.Sum256([]byte(data))
+
+	put := func(body, crange string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPut, "/upload/a/b.txt", strings.NewReader(body))
+		r.Header.Set("Content-Range", crange)
+		r.Header.Set("X-Checksum-Sha256", hex.EncodeToString(sum[:]))
+		u.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := put(data[:5], "bytes 0-4/12"); w.Code != http.StatusAccepted {
+		t.Fatalf("first chunk, expected 202, got %d", w.Code)
+	}
+
+	if w := put(data[8:], "bytes 8-11/12"); w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("gap chunk, expected 416, got %d", w.Code)
+	}
+
+	// the partial file is not in the served directory
+	if fis, _ := ioutil.ReadDir(dir); len(fis) != 0 {
+		t.Errorf("unexpected file %s in the served directory", fis[0].Name())
+	}
+
+	w := httptest.NewRecorder()
+	u.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/upload/a/b.txt", nil))
+	if r := w.Header().Get("Range"); r != "bytes=0-4" {
+		t.Fatalf("expected Range bytes=0-4, got %q", r)
+	}
+
+	if w := put(data[5:], "bytes 5-11/12"); w.Code != http.StatusCreated {
+		t.Fatalf("last chunk, expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	d, err := ioutil.ReadFile(filepath.Join(dir, "a", "b.txt"))
+	if err != nil || string(d) != data {
+		t.Fatalf("file content %q, err %v", d, err)
+	}
+	if fis, _ := ioutil.ReadDir(tmp); len(fis) != 0 {
+		t.Errorf("partial file %s left", fis[0].Name())
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPut, "/upload/c.exe", strings.NewReader(data))
+	u.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("disallowed ext, expected 403, got %d", w.Code)
+	}
+}
+
+func TestUploadPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	os.MkdirAll(root, 0755)
+	os.MkdirAll(outside, 0755)
+	os.Symlink(outside, filepath.Join(root, "out"))
+
+	p, _ := newFsPolicy("never", true, nil)
+	u := newUploadHandler(newSafeFS(root, p), filepath.Join(dir, "tmp"), "/upload/", 0, nil)
+
+	for _, name := range []string{"/upload/out/a.txt", "/upload/.git/config", "/upload/.a.txt"} {
+		w := httptest.NewRecorder()
+		u.ServeHTTP(w, httptest.NewRequest(http.MethodPut, name, strings.NewReader("hello")))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: expected 403, got %d", name, w.Code)
+		}
+	}
+
+	if fis, _ := ioutil.ReadDir(outside); len(fis) != 0 {
+		t.Errorf("file written outside of the directory")
+	}
+	if _, err := os.Stat(filepath.Join(root, ".git")); err == nil {
+		t.Errorf("denied directory created")
+	}
+}
+
+func TestUploadChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmp, err := ioutil.TempDir("", "upload-part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	u := newUploadHandler(newSafeFS(dir, fsPolicy{}), tmp, "/upload/", 0, nil)
+	data := "hello, world"
+	sha := sha256.Sum256([]byte(data))
+	md := md5.Sum([]byte(data))
+	sha64 := base64.StdEncoding.EncodeToString(sha[:])
+	md64 := base64.StdEncoding.EncodeToString(md[:])
+
+	testCases := []struct {
+		header string
+		value  string
+		code   int
+	}{
+		{"X-Checksum-Sha256", hex.EncodeToString(sha[:]), http.StatusCreated},
+		{"X-Checksum-Sha256", strings.Repeat("0", 64), http.StatusBadRequest},
+		{"Digest", "sha-256=" + sha64, http.StatusCreated},
+		{"Digest", "md5=" + md64, http.StatusCreated},
+		{"Digest", "md5=" + sha64, http.StatusBadRequest},
+		// the first supported one is used
+		{"Digest", "sha-256=" + sha64 + ", md5=" + sha64, http.StatusCreated},
+		{"Digest", "unixsum=1, md5=" + md64, http.StatusCreated},
+		{"Digest", "md5=" + sha64 + ", sha-256=" + sha64, http.StatusBadRequest},
+	}
+
+	for i, tc := range testCases {
+		name := fmt.Sprintf("/upload/%d.txt", i)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPut, name, strings.NewReader(data))
+		r.Header.Set(tc.header, tc.value)
+		u.ServeHTTP(w, r)
+		if w.Code != tc.code {
+			t.Errorf("%s: %s, expected %d, got %d", tc.header, tc.value, tc.code, w.Code)
+		}
+		_, err := os.Stat(filepath.Join(dir, filepath.Base(name)))
+		if (err == nil) != (tc.code == http.StatusCreated) {
+			t.Errorf("%s: %s, unexpected file state %v", tc.header, tc.value, err)
+		}
+	}
+}
+
+func TestUploadExpireParts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmp, err := ioutil.TempDir("", "upload-part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	old := filepath.Join(tmp, "old.part")
+	recent := filepath.Join(tmp, "recent.part")
+	ioutil.WriteFile(old, []byte("a"), 0644)
+	ioutil.WriteFile(recent, []byte("a"), 0644)
+	mtime := time.Now().Add(-2 * uploadPartExpire)
+	os.Chtimes(old, mtime, mtime)
+
+	u := newUploadHandler(newSafeFS(dir, fsPolicy{}), tmp, "/upload/", 0, nil)
+	w := httptest.NewRecorder()
+	u.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/upload/a.txt", strings.NewReader("abc")))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", w.Code)
+	}
+
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("stale partial file not removed")
+	}
+	if _, err := os.Stat(recent); err != nil {
+		t.Errorf("recent partial file removed: %s", err)
+	}
+}
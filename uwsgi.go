@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	//"fmt"
 	uwsgi "github.com/fangdingjun/go-uwsgi"
+	"log"
 	"net"
 	"net/http"
 	"strconv"
@@ -13,6 +15,10 @@ import (
 type Uwsgi struct {
 	Passenger *uwsgi.Passenger
 	URLPrefix string
+
+	// resolves the tcp host on each request,
+	// the passenger dials by itself
+	resolver *resolver
 }
 
 // NewUwsgi create a new Uwsgi
@@ -35,7 +41,33 @@ func (u *Uwsgi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // UwsgiPass pass the request to uwsgi interface
 func (u *Uwsgi) UwsgiPass(w http.ResponseWriter, r *http.Request) {
 	params := buildParams(r, u.URLPrefix)
-	u.Passenger.UwsgiPass(w, r, params)
+	p := u.Passenger
+	if u.resolver != nil && p.Net == "tcp" {
+		addr, err := u.resolve(r.Context(), p.Addr)
+		if err != nil {
+			log.Printf("uwsgi %s: %s", p.Addr, err)
+			http.Error(w, "502 Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		p = &uwsgi.Passenger{Net: p.Net, Addr: addr}
+	}
+	p.UwsgiPass(w, r, params)
+}
+
+// resolve returns addr with the first address of the host
+func (u *Uwsgi) resolve(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	ips, err := u.resolver.lookup(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", errNoSuchHost
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
 }
 
 func buildParams(req *http.Request, urlPrefix string) map[string][]string {
@@ -93,6 +125,14 @@ func buildParams(req *http.Request, urlPrefix string) map[string][]string {
 	header["SERVER_PROTOCOL"] = []string{req.Proto}
 	header["QUERY_STRING"] = []string{req.URL.RawQuery}
 
+	if user := remoteUser(req); user != "" {
+		header["REMOTE_USER"] = []string{user}
+	}
+
+	for k, v := range authParams(req) {
+		header[k] = []string{v}
+	}
+
 	if ctype := req.Header.Get("Content-Type"); ctype != "" {
 		header["CONTENT_TYPE"] = []string{ctype}
 	}
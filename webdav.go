@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/mux"
+	"golang.org/x/net/webdav"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// webdavHandler serves a directory over webdav,
+// write methods are rejected when the share is read only
+type webdavHandler struct {
+	handler  *webdav.Handler
+	readOnly bool
+}
+
+func newWebdavHandler(fs *safeFS, prefix string, readOnly bool) *webdavHandler {
+	return &webdavHandler{
+		handler: &webdav.Handler{
+			Prefix:     strings.TrimRight(prefix, "/"),
+			FileSystem: webdavFS{fs},
+			LockSystem: webdav.NewMemLS(),
+			Logger: func(r *http.Request, err error) {
+				if err != nil {
+					log.Printf("webdav %s %s: %s", r.Method, r.URL.Path, err)
+				}
+			},
+		},
+		readOnly: readOnly,
+	}
+}
+
+// ServeHTTP implements the http.Handler interface
+func (wd *webdavHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if wd.readOnly && !isReadMethod(r.Method) {
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PROPFIND")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "<h1>405 Method Not Allowed</h1>")
+		return
+	}
+	wd.handler.ServeHTTP(w, r)
+}
+
+// webdavFS is the webdav.FileSystem on safeFS,
+// the share follows the symlink and deny policy of the static files
+type webdavFS struct {
+	fs *safeFS
+}
+
+func (w webdavFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return w.fs.mkdir(name, perm)
+}
+
+func (w webdavFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	f, err := w.fs.openFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &safeFile{f, w.fs, path.Clean("/" + name)}, nil
+}
+
+func (w webdavFS) RemoveAll(ctx context.Context, name string) error {
+	return w.fs.removeAll(name)
+}
+
+func (w webdavFS) Rename(ctx context.Context, oldName, newName string) error {
+	return w.fs.rename(oldName, newName)
+}
+
+func (w webdavFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return w.fs.stat(name)
+}
+
+func isReadMethod(m string) bool {
+	switch m {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		return true
+	}
+	return false
+}
+
+// ruleAuth protects h by the server auth a,
+// the rule with its own auth is checked by that one only
+func ruleAuth(r rule, a *authHandler, h http.Handler) http.Handler {
+	if a == nil || r.Auth != nil {
+		return h
+	}
+	return a.middleware(h)
+}
+
+func registerWebdavHandler(r rule, policy fsPolicy, a *authHandler, router *mux.Router) {
+	if r.Target.Type != "dir" {
+		fmt.Printf("invalid type: %s, only dir allowed\n", r.Target.Type)
+		os.Exit(-1)
+	}
+
+	h := newWebdavHandler(newSafeFS(r.Target.Path, policy), r.URLPrefix, r.ReadOnly)
+	router.PathPrefix(r.URLPrefix).Handler(ruleAuth(r, a, h))
+}
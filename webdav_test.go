@@ -0,0 +1,194 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWebdavReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webdav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := newWebdavHandler(newSafeFS(dir, fsPolicy{}), "/dav/", true)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPut, "/dav/a.txt", strings.NewReader("hello"))
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT on read only share, expected 405, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("PROPFIND", "/dav/", nil)
+	r.Header.Set("Depth", "1")
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusMultiStatus {
+		t.Errorf("PROPFIND, expected 207, got %d", w.Code)
+	}
+
+	h.readOnly = false
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPut, "/dav/a.txt", strings.NewReader("hello"))
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Errorf("PUT, expected 201, got %d", w.Code)
+	}
+}
+
+func TestWebdavPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webdav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	os.MkdirAll(root, 0755)
+	os.MkdirAll(outside, 0755)
+	ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("s"), 0644)
+	ioutil.WriteFile(filepath.Join(root, ".hidden"), []byte("h"), 0644)
+	os.Symlink(outside, filepath.Join(root, "out"))
+
+	p, _ := newFsPolicy("never", true, nil)
+	h := newWebdavHandler(newSafeFS(root, p), "/dav/", false)
+
+	do := func(method, name, body string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, name, strings.NewReader(body))
+		r.Header.Set("Depth", "1")
+		h.ServeHTTP(w, r)
+		if method == "PROPFIND" && strings.Contains(w.Body.String(), ".hidden") {
+			t.Errorf("dot file listed")
+		}
+		return w.Code
+	}
+
+	for _, c := range []struct {
+		method, name string
+	}{
+		{http.MethodGet, "/dav/out/secret"},
+		{http.MethodGet, "/dav/.hidden"},
+		{http.MethodPut, "/dav/out/new"},
+		{http.MethodPut, "/dav/.git"},
+		{"MKCOL", "/dav/.git"},
+		{"MKCOL", "/dav/out/dir"},
+	} {
+		if code := do(c.method, c.name, "x"); code < 300 {
+			t.Errorf("%s %s: expected failure, got %d", c.method, c.name, code)
+		}
+	}
+
+	if code := do("PROPFIND", "/dav/", ""); code != http.StatusMultiStatus {
+		t.Errorf("PROPFIND, expected 207, got %d", code)
+	}
+
+	do(http.MethodDelete, "/dav/out", "")
+	do(http.MethodDelete, "/dav/out/secret", "")
+
+	if fis, _ := ioutil.ReadDir(outside); len(fis) != 1 {
+		t.Errorf("the files outside of the share changed")
+	}
+	if _, err := os.Stat(filepath.Join(root, ".git")); err == nil {
+		t.Errorf("denied file created")
+	}
+}
+
+func TestWebdavWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webdav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := newWebdavHandler(newSafeFS(dir, fsPolicy{}), "/dav/", false)
+
+	for _, c := range []struct {
+		method, name, dst string
+		code              int
+	}{
+		{"MKCOL", "/dav/a/", "", http.StatusCreated},
+		{http.MethodPut, "/dav/a/b.txt", "", http.StatusCreated},
+		{"COPY", "/dav/a/", "/dav/c/", http.StatusCreated},
+		{"MOVE", "/dav/c/b.txt", "/dav/d.txt", http.StatusCreated},
+		{http.MethodDelete, "/dav/a/", "", http.StatusNoContent},
+		{http.MethodGet, "/dav/d.txt", "", http.StatusOK},
+	} {
+		var body io.Reader
+		if c.method == http.MethodPut {
+			body = strings.NewReader("hello")
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(c.method, c.name, body)
+		if c.dst != "" {
+			r.Header.Set("Destination", "http://example.com"+c.dst)
+		}
+		h.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("%s %s: expected %d, got %d", c.method, c.name, c.code, w.Code)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "a")); err == nil {
+		t.Errorf("directory not removed")
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "d.txt")); string(b) != "hello" {
+		t.Errorf("unexpected content %q", b)
+	}
+}
+
+func TestWebdavAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webdav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the server auth is digest, the rules use basic
+	local, err := newAuthHandler(authConf{Type: "digest", Realm: "example.com", PasswdFile: "passwdfile"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	for _, r := range []rule{
+		{URLPrefix: "/server/"},
+		{URLPrefix: "/user/", Auth: &authConf{Type: "basic", Realm: "example.com", PasswdFile: "passwdfile", Users: []string{"test"}}},
+		{URLPrefix: "/other/", Auth: &authConf{Type: "basic", Realm: "example.com", PasswdFile: "passwdfile", Users: []string{"u1"}}},
+	} {
+		r.Type = "webdav"
+		r.Target = target{Type: "dir", Path: dir}
+		registerWebdavHandler(r, fsPolicy{}, local, ruleRouter(r, nil, router))
+	}
+
+	for _, c := range []struct {
+		prefix string
+		code   int
+		auth   string
+	}{
+		{"/server/", http.StatusUnauthorized, "Digest"},
+		{"/user/", http.StatusMultiStatus, ""},
+		{"/other/", http.StatusForbidden, ""},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("PROPFIND", c.prefix, nil)
+		r.SetBasicAuth("test", "test")
+		router.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("%s: expected %d, got %d", c.prefix, c.code, w.Code)
+		}
+		if a := w.Header().Get("WWW-Authenticate"); !strings.HasPrefix(a, c.auth) || (c.auth == "" && a != "") {
+			t.Errorf("%s: unexpected challenge %q", c.prefix, a)
+		}
+	}
+}